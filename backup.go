@@ -0,0 +1,218 @@
+package beck
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// backupFile is a file of the data directory copied by a backup. only the first size bytes are copied, or the whole
+// file when size is negative. optional files are skipped when missing
+type backupFile struct {
+	path     string
+	size     int64
+	optional bool
+}
+
+// Backup copies a consistent view of the database into dstDir, which is created if it does not exist and must
+// otherwise be empty. Reads and writes proceed during the backup, and the copy holds the keys as they were when it
+// started. Merges wait for the backup to complete. The copy can be opened as a database of its own
+func (db *BeckDB) Backup(dstDir string) error {
+	if err := createEmptyDir(dstDir); err != nil {
+		return err
+	}
+
+	// merges are the only writers that remove datafiles, so holding them off keeps every listed file on disk
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	files, err := db.backupFiles()
+	if err != nil {
+		return err
+	}
+
+	// old datafiles are never modified and the active datafile is only appended to, so the listed bytes are copied
+	// without holding the db lock
+	for _, file := range files {
+		err := copyFile(file.path, filepath.Join(dstDir, filepath.Base(file.path)), file.size)
+		if file.optional && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to back up %s: %w", file.path, err)
+		}
+	}
+	return writeManifest(filepath.Join(dstDir, manifestFileName), &manifest{ByteOrder: db.enc.String()})
+}
+
+// backupFiles lists the files a backup copies. the active datafile is flushed and only copied up to its current
+// size, so records appended after the listing are left out
+func (db *BeckDB) backupFiles() ([]backupFile, error) {
+	db.lock()
+	defer db.unlock()
+
+	files := make([]backupFile, 0, 2*len(db.oldDataFiles)+2)
+	for fileID := range db.oldDataFiles {
+		files = append(files,
+			backupFile{path: getDatafilePath(db.cfg.DataDir, fileID), size: -1},
+			backupFile{path: getHintFilePath(db.cfg.DataDir, fileID), size: -1, optional: true},
+		)
+	}
+	if db.cfg.ReadOnly {
+		return files, nil
+	}
+
+	if err := db.activeDatafile.flush(); err != nil {
+		return nil, err
+	}
+	files = append(files, backupFile{path: getDatafilePath(db.cfg.DataDir, db.activeIndex), size: int64(db.activeDatafile.bufferedSize())})
+
+	// the active datafile of a database keeping its keys only in hint files has its hint file written alongside
+	if db.activeDatafile.hint != nil {
+		path := getHintFilePath(db.cfg.DataDir, db.activeIndex)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, backupFile{path: path, size: fi.Size()})
+	}
+	return files, nil
+}
+
+// createEmptyDir creates dir if it does not exist. ErrDirectoryNotEmpty is returned if it exists with any entries
+func createEmptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrDirectoryNotEmpty, dir)
+	}
+	return nil
+}
+
+// copyFile copies the first size bytes of src to a new file at dst, or all of src when size is negative, and syncs
+// the copy to disk
+func copyFile(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, size)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Restore copies the database backed up in srcDir into the data directory of cfg and returns the number of records
+// restored. The data directory is created if it does not exist and must otherwise be empty. Every record is checked
+// against its checksum before it's copied, and the restored database is then opened with cfg to replay it, so cfg
+// must hold the encryption key and key settings the backup was written with
+func Restore(srcDir string, cfg *Config) (int, error) {
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+	if err := createEmptyDir(cfg.DataDir); err != nil {
+		return 0, err
+	}
+
+	enc, cleared, err := readManifest(srcDir)
+	if err != nil {
+		return 0, err
+	}
+	var aead cipher.AEAD
+	if cfg.EncryptionKey != nil {
+		if aead, err = newAEAD(cfg.EncryptionKey); err != nil {
+			return 0, err
+		}
+	}
+
+	datafiles, err := getDatafiles(srcDir)
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, dfPath := range datafiles {
+		fileID, err := getFileID(dfPath)
+		if err != nil || slices.Contains(cleared, fileID) {
+			continue
+		}
+		n, err := verifyDatafile(dfPath, enc, aead)
+		if err != nil {
+			return 0, fmt.Errorf("failed to verify datafile %s: %w", dfPath, err)
+		}
+		if err := copyFile(dfPath, getDatafilePath(cfg.DataDir, fileID), -1); err != nil {
+			return 0, err
+		}
+		// hint files are verified against their datafile when the restored database is opened
+		err = copyFile(getHintFilePath(srcDir, fileID), getHintFilePath(cfg.DataDir, fileID), -1)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		restored += n
+	}
+	if err := writeManifest(filepath.Join(cfg.DataDir, manifestFileName), &manifest{ByteOrder: enc.String()}); err != nil {
+		return 0, err
+	}
+
+	// replay the restored database without modifying it
+	validateCfg := *cfg
+	validateCfg.ReadOnly = true
+	validateCfg.HintCheck = HintCheckFull
+	validateCfg.StrictRecovery = true
+	db, err := Open(&validateCfg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open restored database: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
+
+// verifyDatafile checks every record of the datafile at path against its checksum and returns the number of records
+func verifyDatafile(path string, enc binary.ByteOrder, aead cipher.AEAD) (int, error) {
+	df, err := NewDatafile(path, true, false, 0, enc)
+	if err != nil {
+		return 0, err
+	}
+	defer df.close()
+	df.aead = aead
+
+	records := df.scan(0, defaultReadAheadSize)
+	count := 0
+	for {
+		_, _, err := records.next()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+}
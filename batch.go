@@ -0,0 +1,77 @@
+package beck
+
+// Batch collects puts and deletes to be applied to the datastore atomically with a single write.
+// Operations are applied in the order they were added
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    string
+	val    []byte
+	delete bool
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds a key-value pair to the batch
+func (b *Batch) Put(key string, val []byte) {
+	b.ops = append(b.ops, batchOp{key: key, val: val})
+}
+
+// Delete adds the removal of a key to the batch. Deleting a missing key is not an error
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of operations in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Write applies all operations of the batch to the datastore. All records are appended to the active datafile with
+// a single write and the keydir is updated under one lock acquisition, so readers observe either none or all of the
+// batch. No operation is applied if any entry is invalid
+func (db *BeckDB) Write(b *Batch) error {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	records := make([]*record, len(b.ops))
+	for idx, op := range b.ops {
+		db.cache.remove(op.key)
+		if op.delete {
+			records[idx] = newRecord(op.key, tombstoneVal, 0)
+			continue
+		}
+		if err := db.validateEntry(op.key, op.val); err != nil {
+			return err
+		}
+		records[idx] = newRecord(op.key, op.val, 0)
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	sizes, offsets, err := db.activeDatafile.appendBatch(records)
+	if err != nil {
+		return err
+	}
+
+	for idx, op := range b.ops {
+		if op.delete {
+			db.keyDir.delete(op.key)
+			db.keyDir.markDead(db.activeIndex, sizes[idx])
+			db.metrics.deletes.Add(1)
+			continue
+		}
+		db.keyDir.put(op.key, db.activeIndex, sizes[idx], len(op.val), offsets[idx], 0)
+		db.metrics.puts.Add(1)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package beck
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// valueCache is a least recently used cache of values read from disk. each value is tagged with the location of
+// the record it was read from, so a value is only served while the keydir still points at that record.
+// it has its own lock so cache hits do not contend with datafile reads
+type valueCache struct {
+	capacity int
+	// most recently used entries are at the front
+	ll    *list.List
+	items map[string]*list.Element
+	mu    sync.Mutex
+}
+
+// cacheEntry is a cached value and the record it was read from
+type cacheEntry struct {
+	key            string
+	fileID         int
+	recordPosition uint64
+	val            []byte
+}
+
+// newValueCache creates a cache holding up to capacity values. nil is returned if capacity is not positive,
+// and all methods of a nil cache are no-ops
+func newValueCache(capacity int) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached value of key if it was read from the record the header points at
+func (c *valueCache) get(key string, h *header) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.fileID != h.fileID || entry.recordPosition != h.recordPosition {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return bytes.Clone(entry.val), true
+}
+
+// add caches a copy of the value read from the record the header points at, evicting the least recently used
+// value if the cache is full
+func (c *valueCache) add(key string, h *header, val []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, fileID: h.fileID, recordPosition: h.recordPosition, val: bytes.Clone(val)}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// remove invalidates the cached value of key
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// purge invalidates all cached values
+func (c *valueCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	clear(c.items)
+}
@@ -0,0 +1,55 @@
+package beck
+
+import (
+	"fmt"
+)
+
+// Clear atomically removes every key from the database. The datafiles are discarded and writes continue in a fresh
+// active datafile. Reads in progress complete against the discarded datafiles, which are removed once they do.
+// A crash during the clear leaves the database either intact or cleared, and the next Open finishes the clear
+func (db *BeckDB) Clear() error {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	// a merge running meanwhile would bring the cleared keys back once it swaps in its merged files
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.lock()
+	defer db.unlock()
+
+	activeFileID := nextActiveFileID(db.activeIndex)
+	newActiveDatafile, err := db.openActiveDatafile(activeFileID)
+	if err != nil {
+		return fmt.Errorf("failed to create datafile %d: %w", activeFileID, err)
+	}
+
+	// the discarded datafiles are recorded before any is removed, so they are all discarded on the next open if the
+	// clear is interrupted
+	db.oldDataFiles[db.activeIndex] = db.activeDatafile
+	fileIDs := make([]int, 0, len(db.oldDataFiles))
+	for fileID := range db.oldDataFiles {
+		fileIDs = append(fileIDs, fileID)
+	}
+	if err := db.writeManifestCleared(fileIDs); err != nil {
+		delete(db.oldDataFiles, db.activeIndex)
+		newActiveDatafile.purge()
+		return err
+	}
+
+	removeErr := db.cleanupStaleDatafiles(fileIDs)
+	db.activeDatafile = newActiveDatafile
+	db.activeIndex = activeFileID
+	// versions carry on from the old keydir so a key written after the clear never repeats a version seen before it.
+	// the clear removes every key
+	keyDir := NewKeyDir()
+	keyDir.version = db.keyDir.version + 1
+	keyDir.deleted = keyDir.version
+	db.keyDir = keyDir
+	db.cache.purge()
+	if removeErr != nil {
+		return fmt.Errorf("failed to remove cleared datafiles: %w", removeErr)
+	}
+	return db.writeManifestCleared(nil)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerClient records a new client connection in the server registry
+func (srv *Server) registerClient(conn net.Conn) *client {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.lastClientID++
+	c := &client{id: srv.lastClientID, conn: conn, createdAt: time.Now(), proto: RESP2}
+	c.lastActive.Store(c.createdAt.UnixNano())
+
+	// unix socket clients share the address of the socket, so they are told apart by their id
+	c.addr = connAddr(conn)
+	if conn.LocalAddr().Network() == "unix" {
+		c.addr = fmt.Sprintf("%s:%d", c.addr, c.id)
+	}
+	srv.clients[c.addr] = c
+	return c
+}
+
+// connAddr returns the address of the client of a connection. unix socket clients have no address of their own and
+// are given the path of the socket
+func connAddr(conn net.Conn) string {
+	if conn.LocalAddr().Network() == "unix" {
+		return conn.LocalAddr().String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+// unregisterClient removes a client connection from the server registry
+func (srv *Server) unregisterClient(c *client) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	delete(srv.clients, c.addr)
+}
+
+// clientCmd implements the CLIENT LIST and CLIENT KILL subcommands.
+// CLIENT KILL accepts both the legacy form (CLIENT KILL ip:port) and the filter form (CLIENT KILL ADDR ip:port)
+func (s *Server) clientCmd(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'CLIENT' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulkStr) {
+	case "LIST":
+		return s.clientList()
+	case "KILL":
+		switch {
+		case len(args) == 2:
+			return s.clientKill(args[1].bulkStr)
+		case len(args) == 3 && strings.ToUpper(args[1].bulkStr) == "ADDR":
+			return s.clientKill(args[2].bulkStr)
+		default:
+			return Value{typ: Error, str: "Err syntax error"}
+		}
+	default:
+		return Value{typ: Error, str: "Err unknown subcommand '" + args[0].bulkStr + "'"}
+	}
+}
+
+// clientList replies with one line per connected client holding its id, address, age and idle time in seconds
+func (s *Server) clientList() Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var sb strings.Builder
+	for addr, c := range s.clients {
+		age := now.Sub(c.createdAt)
+		idle := now.Sub(time.Unix(0, c.lastActive.Load()))
+		fmt.Fprintf(&sb, "id=%d addr=%s age=%d idle=%d\n", c.id, addr, int(age.Seconds()), int(idle.Seconds()))
+	}
+
+	return Value{typ: Verbatim, bulkStr: sb.String()}
+}
+
+// hello implements the redis HELLO command. an optional protocol version switches the replies of the connection
+// to resp2 or resp3, and the reply is a map describing the server in the negotiated protocol. clients may
+// authenticate along with it as HELLO protover AUTH username password, in which case the protocol is only switched
+// once they are authenticated
+func (s *Server) hello(c *client, args []Value) Value {
+	if len(args) != 0 && len(args) != 1 && (len(args) != 4 || strings.ToUpper(args[1].bulkStr) != "AUTH") {
+		return Value{typ: Error, str: "Err syntax error"}
+	}
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0].bulkStr)
+		if err != nil {
+			return Value{typ: Error, str: "Err Protocol version is not an integer or out of range"}
+		}
+		if proto != RESP2 && proto != RESP3 {
+			return Value{typ: Error, str: "NOPROTO unsupported protocol version"}
+		}
+		if len(args) == 4 {
+			if res := s.auth(c, args[2:]); res.typ == Error {
+				return res
+			}
+		}
+		c.proto = proto
+	}
+
+	return Value{typ: Map, array: []Value{
+		{typ: BulkString, bulkStr: "server"}, {typ: BulkString, bulkStr: "beckdb"},
+		{typ: BulkString, bulkStr: "proto"}, {typ: Integer, num: c.proto},
+		{typ: BulkString, bulkStr: "id"}, {typ: Integer, num: int(c.id)},
+		{typ: BulkString, bulkStr: "mode"}, {typ: BulkString, bulkStr: "standalone"},
+		{typ: BulkString, bulkStr: "role"}, {typ: BulkString, bulkStr: "master"},
+		{typ: BulkString, bulkStr: "modules"}, {typ: Array, array: []Value{}},
+	}}
+}
+
+// defaultUser is the only user of the server, as AUTH sees it
+const defaultUser = "default"
+
+// auth implements the redis AUTH command as AUTH password or AUTH username password, authenticating the connection
+// when the password is the one of the server
+func (s *Server) auth(c *client, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'AUTH' command"}
+	}
+	if s.cfg.RequirePass == "" {
+		return Value{typ: Error, str: "Err AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+	}
+
+	user, pass := defaultUser, args[0].bulkStr
+	if len(args) == 2 {
+		user, pass = args[0].bulkStr, args[1].bulkStr
+	}
+	// both are compared in constant time so the reply time reveals nothing about the password
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(defaultUser))
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.cfg.RequirePass))
+	if userOK&passOK != 1 {
+		return ErrWrongPass
+	}
+
+	c.authenticated = true
+	return AckVal
+}
+
+// clientKill closes the connection of the client with the given address
+func (s *Server) clientKill(addr string) Value {
+	s.mu.Lock()
+	c, ok := s.clients[addr]
+	delete(s.clients, addr)
+	s.mu.Unlock()
+
+	if !ok {
+		return Value{typ: Error, str: "Err No such client"}
+	}
+
+	// closing the connection unblocks its handler which then exits
+	c.conn.Close()
+	return AckVal
+}
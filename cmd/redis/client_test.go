@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer serves the test server on a random local port and returns its address
+func startTestServer(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go srv.serve(ln)
+	return ln.Addr().String()
+}
+
+// sendCommand writes a command as a resp array of bulk strings and reads back the reply
+func sendCommand(t *testing.T, conn net.Conn, args ...string) *Value {
+	t.Helper()
+
+	req := Value{typ: Array, array: bulkArgs(args...)}
+	_, err := conn.Write(req.Marshal())
+	require.NoError(t, err)
+
+	res, err := NewResp(conn).Read()
+	require.NoError(t, err)
+	return res
+}
+
+// test that connected clients can be listed and killed by address
+func TestClientListAndKill(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn1, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn1.Close()
+	conn2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	// ensure the second client is registered before listing
+	require.Equal(t, "PONG", sendCommand(t, conn2, "PING").str)
+
+	res := sendCommand(t, conn1, "CLIENT", "LIST")
+	require.Equal(t, BulkString, res.typ)
+	require.Contains(t, res.bulkStr, "addr="+conn1.LocalAddr().String())
+	require.Contains(t, res.bulkStr, "addr="+conn2.LocalAddr().String())
+
+	// kill the second client and confirm its connection was closed
+	res = sendCommand(t, conn1, "CLIENT", "KILL", "ADDR", conn2.LocalAddr().String())
+	require.Equal(t, AckVal.str, res.str)
+
+	_, err = NewResp(conn2).Read()
+	require.Error(t, err)
+
+	res = sendCommand(t, conn1, "CLIENT", "KILL", "ADDR", conn2.LocalAddr().String())
+	require.Equal(t, Error, res.typ)
+
+	res = sendCommand(t, conn1, "CLIENT", "LIST")
+	require.Equal(t, 1, strings.Count(res.bulkStr, "\n"))
+}
+
+// test that unknown commands are rejected with the redis error and only close the connection in strict mode
+func TestUnknownCommand(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		srv := newTestServer(t)
+		srv.cfg.StrictCommands = strict
+		addr := startTestServer(t, srv)
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		res := sendCommand(t, conn, "FOO", "bar", "baz")
+		require.Equal(t, Error, res.typ)
+		require.Equal(t, "Err unknown command 'FOO', with args beginning with: 'bar' 'baz' ", res.str)
+
+		req := Value{typ: Array, array: bulkArgs("PING")}
+		_, err = conn.Write(req.Marshal())
+		if err == nil {
+			res, err = NewResp(conn).Read()
+		}
+		if strict {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, "PONG", res.str)
+	}
+}
+
+// test that connections idle past the idle timeout are closed while active ones are kept
+func TestIdleTimeout(t *testing.T) {
+	srv := newTestServer(t)
+	srv.cfg.IdleTimeout = 100 * time.Millisecond
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	require.Equal(t, "PONG", sendCommand(t, idle, "PING").str)
+
+	// commands sent within the timeout keep the connection open
+	for range 5 {
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, "PONG", sendCommand(t, conn, "PING").str)
+	}
+
+	// the server closes the idle connection, so the read ends
+	require.NoError(t, idle.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = idle.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// test that connections beyond the limit are rejected with an error, and accepted again once others close
+func TestMaxConns(t *testing.T) {
+	srv := newTestServer(t)
+	srv.cfg.MaxConns = 2
+	addr := startTestServer(t, srv)
+
+	conns := make([]net.Conn, 10)
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for idx := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns[idx], errs[idx] = net.Dial("tcp", addr)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// rejected connections are sent the error unprompted, while accepted ones wait for a command
+	var accepted []net.Conn
+	for _, conn := range conns {
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		res, err := NewResp(conn).Read()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			accepted = append(accepted, conn)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, Value{typ: Error, str: "Err max number of clients reached"}, *res)
+	}
+	require.Len(t, accepted, 2)
+	for _, conn := range accepted {
+		require.NoError(t, conn.SetReadDeadline(time.Time{}))
+		require.Equal(t, "PONG", sendCommand(t, conn, "PING").str)
+	}
+
+	// a closed connection frees its slot
+	accepted[0].Close()
+	require.Eventually(t, func() bool { return srv.conns.Load() == 1 }, time.Second, 10*time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "PONG", sendCommand(t, conn, "PING").str)
+}
+
+// test that shutdown answers in-flight commands before closing connections, and forcibly closes the connections of
+// commands still running after the timeout
+func TestDrain(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	require.Equal(t, "PONG", sendCommand(t, idle, "PING").str)
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+
+	// commands wait for the transaction lock, which keeps the command in flight until it's released
+	srv.txMu.Lock()
+	time.AfterFunc(200*time.Millisecond, srv.txMu.Unlock)
+	req := Value{typ: Array, array: bulkArgs("SET", "name", "mrshabel")}
+	_, err = busy.Write(req.Marshal())
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	require.Zero(t, srv.drain(time.Second))
+	// the in-flight command is answered before its connection is closed
+	resp := NewResp(busy)
+	res, err := resp.Read()
+	require.NoError(t, err)
+	require.Equal(t, AckVal, *res)
+	_, err = resp.Read()
+	require.ErrorIs(t, err, io.EOF)
+	_, err = idle.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// new connections are refused
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+
+	val, err := srv.db.Get("name")
+	require.NoError(t, err)
+	require.Equal(t, "mrshabel", string(val))
+
+	// commands outlasting the timeout have their connections closed
+	srv = newTestServer(t)
+	srv.txMu.Lock()
+	time.AfterFunc(time.Second, srv.txMu.Unlock)
+	busy, err = net.Dial("tcp", startTestServer(t, srv))
+	require.NoError(t, err)
+	defer busy.Close()
+	_, err = busy.Write(req.Marshal())
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, srv.drain(50*time.Millisecond))
+}
+
+// test that clients of a server with a password must authenticate before running commands
+func TestAuth(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// servers without a password accept every command, but not AUTH
+	require.Equal(t, AckVal, *sendCommand(t, conn, "SET", "name", "mrshabel"))
+	require.Equal(t, Error, sendCommand(t, conn, "AUTH", "secret").typ)
+
+	srv = newTestServer(t)
+	srv.cfg.RequirePass = "secret"
+	addr = startTestServer(t, srv)
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, ErrNoAuth, *sendCommand(t, conn, "SET", "name", "mrshabel"))
+	require.Equal(t, ErrNoAuth, *sendCommand(t, conn, "MULTI"))
+	require.Equal(t, "PONG", sendCommand(t, conn, "PING").str)
+	require.Equal(t, Array, sendCommand(t, conn, "HELLO").typ)
+	require.Equal(t, ErrWrongPass, *sendCommand(t, conn, "AUTH", "wrong"))
+	require.Equal(t, ErrWrongPass, *sendCommand(t, conn, "AUTH", "admin", "secret"))
+	require.Equal(t, ErrNoAuth, *sendCommand(t, conn, "GET", "name"))
+
+	require.Equal(t, AckVal, *sendCommand(t, conn, "AUTH", "secret"))
+	require.Equal(t, AckVal, *sendCommand(t, conn, "SET", "name", "mrshabel"))
+
+	// authentication is kept per connection, and can be done along with HELLO
+	other, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer other.Close()
+	require.Equal(t, ErrNoAuth, *sendCommand(t, other, "GET", "name"))
+	require.Equal(t, ErrWrongPass, *sendCommand(t, other, "HELLO", "3", "AUTH", "default", "wrong"))
+	require.Equal(t, Array, sendCommand(t, other, "HELLO").typ)
+	res := sendCommand(t, other, "HELLO", "3", "AUTH", "default", "secret")
+	require.Equal(t, Map, res.typ)
+	require.Equal(t, "mrshabel", sendCommand(t, other, "GET", "name").bulkStr)
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key, returning their paths and the certificate
+func writeTestCert(t *testing.T) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert
+}
+
+// test that clients are served over TLS when the server has a certificate, and that it needs a key with it
+func TestTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCert(t)
+
+	_, err := listen("127.0.0.1:0", certFile, "")
+	require.Error(t, err)
+	_, err = listen("127.0.0.1:0", "", keyFile)
+	require.Error(t, err)
+
+	ln, err := listen("127.0.0.1:0", certFile, keyFile)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	srv := newTestServer(t)
+	go srv.serve(ln)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: pool})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, AckVal, *sendCommand(t, conn, "SET", "name", "mrshabel"))
+	require.Equal(t, "mrshabel", sendCommand(t, conn, "GET", "name").bulkStr)
+
+	// plain tcp clients can't talk to the server
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer plain.Close()
+	req := Value{typ: Array, array: bulkArgs("PING")}
+	_, err = plain.Write(req.Marshal())
+	require.NoError(t, err)
+	require.NoError(t, plain.SetReadDeadline(time.Now().Add(time.Second)))
+	res, err := NewResp(plain).Read()
+	if err == nil {
+		require.NotEqual(t, "PONG", res.str)
+	}
+}
+
+// test that pipelined commands are answered in order, including the ones that fail
+func TestPipelining(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var pipeline []byte
+	for _, args := range [][]string{
+		{"SET", "counter", "1"},
+		{"FOO"},
+		{"INCR", "counter"},
+		{"SET", "name", "beck"},
+		{"INCR", "name"},
+		{"GET", "counter"},
+	} {
+		req := Value{typ: Array, array: bulkArgs(args...)}
+		pipeline = append(pipeline, req.Marshal()...)
+	}
+	_, err = conn.Write(pipeline)
+	require.NoError(t, err)
+
+	resp := NewResp(conn)
+	var replies []Value
+	for range 6 {
+		res, err := resp.Read()
+		require.NoError(t, err)
+		replies = append(replies, *res)
+	}
+	require.Equal(t, AckVal.str, replies[0].str)
+	require.True(t, isUnknownCommand(replies[1]))
+	require.Equal(t, 2, replies[2].num)
+	require.Equal(t, AckVal.str, replies[3].str)
+	require.Equal(t, Error, replies[4].typ)
+	require.Equal(t, "2", replies[5].bulkStr)
+}
+
+// test that HELLO switches the connection to resp3 replies, and that connections speak resp2 until then
+func TestHello(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sendCommand(t, conn, "HSET", "user", "name", "shabel")
+
+	// resp2 replies by default
+	res := sendCommand(t, conn, "HGETALL", "user")
+	require.Equal(t, Value{typ: Array, array: bulkArgs("name", "shabel")}, *res)
+	require.Equal(t, Null, sendCommand(t, conn, "GET", "missing").typ)
+
+	res = sendCommand(t, conn, "HELLO", "4")
+	require.Equal(t, Error, res.typ)
+	require.True(t, strings.HasPrefix(res.str, "NOPROTO"))
+
+	// the HELLO reply is already sent in resp3
+	res = sendCommand(t, conn, "HELLO", "3")
+	require.Equal(t, Map, res.typ)
+	require.Equal(t, Value{typ: BulkString, bulkStr: "proto"}, res.array[2])
+	require.Equal(t, Value{typ: Integer, num: RESP3}, res.array[3])
+
+	res = sendCommand(t, conn, "HGETALL", "user")
+	require.Equal(t, Value{typ: Map, array: bulkArgs("name", "shabel")}, *res)
+	require.Equal(t, Null, sendCommand(t, conn, "GET", "missing").typ)
+	res = sendCommand(t, conn, "CLIENT", "LIST")
+	require.Equal(t, Verbatim, res.typ)
+	require.Contains(t, res.bulkStr, "addr="+conn.LocalAddr().String())
+
+	// switching back restores resp2 replies
+	res = sendCommand(t, conn, "HELLO", "2")
+	require.Equal(t, Array, res.typ)
+}
+
+// test that resp3 values are marshalled in resp3 and downgraded to their closest resp2 type otherwise
+func TestMarshalRESP3(t *testing.T) {
+	tests := []struct {
+		val   Value
+		resp2 string
+		resp3 string
+	}{
+		{Value{typ: Null}, "$-1\r\n", "_\r\n"},
+		{Value{typ: Boolean, boolean: true}, ":1\r\n", "#t\r\n"},
+		{Value{typ: Double, double: 1.5}, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{Value{typ: BigNumber, str: "12345678901234567890"}, "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{Value{typ: Verbatim, bulkStr: "hi"}, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{Value{typ: Map, array: bulkArgs("a", "b")}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "%1\r\n$1\r\na\r\n$1\r\nb\r\n"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.resp2, string(tt.val.marshal(RESP2)))
+		require.Equal(t, tt.resp3, string(tt.val.marshal(RESP3)))
+
+		// resp3 replies are read back as the value they were marshalled from
+		res, err := NewResp(bytes.NewBufferString(tt.resp3)).Read()
+		require.NoError(t, err)
+		require.Equal(t, tt.val, *res)
+	}
+}
+
+// test that inline commands are served like resp arrays, with bare LF line endings and blank lines tolerated
+func TestInlineCommand(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("SET name  shabel\r\n\r\nGET name\n"))
+	require.NoError(t, err)
+
+	resp := NewResp(conn)
+	res, err := resp.Read()
+	require.NoError(t, err)
+	require.Equal(t, AckVal.str, res.str)
+	res, err = resp.Read()
+	require.NoError(t, err)
+	require.Equal(t, "shabel", res.bulkStr)
+
+	// resp requests are still served after inline ones
+	require.Equal(t, "PONG", sendCommand(t, conn, "PING").str)
+}
+
+// test that inline commands longer than the line cap are rejected with a protocol error and the connection closed
+func TestInlineCommandTooBig(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the line never ends, so the server must give up on it rather than keep reading
+	go conn.Write([]byte("SET key " + strings.Repeat("a", 2*maxLineLen)))
+
+	resp := NewResp(conn)
+	res, err := resp.Read()
+	require.NoError(t, err)
+	require.Equal(t, Value{typ: Error, str: "Err Protocol error: too big inline request"}, *res)
+	_, err = resp.Read()
+	require.Error(t, err)
+}
+
+// test that a bulk string larger than the read buffer and split across writes is read intact
+func TestReadLargeBulkString(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	val := strings.Repeat("beckdb", 4096)
+	req := Value{typ: Array, array: bulkArgs("SET", "key", val)}
+	data := req.Marshal()
+	go func() {
+		for len(data) > 0 {
+			n := min(1000, len(data))
+			client.Write(data[:n])
+			data = data[n:]
+		}
+	}()
+
+	res, err := NewResp(server).Read()
+	require.NoError(t, err)
+	require.Equal(t, req, *res)
+}
+
+// test that lengths a client can't back with data are rejected before anything is allocated for them
+func TestReadInvalidLengths(t *testing.T) {
+	for _, tt := range []struct {
+		req string
+		err string
+	}{
+		{req: "*-2\r\n", err: "invalid multibulk length"},
+		{req: "%-1\r\n", err: "invalid multibulk length"},
+		{req: fmt.Sprintf("*%d\r\n", maxArrayLen+1), err: "invalid multibulk length"},
+		{req: fmt.Sprintf("%%%d\r\n", maxArrayLen/2+1), err: "invalid multibulk length"},
+		{req: "$-2\r\n", err: "invalid bulk length"},
+		{req: fmt.Sprintf("$%d\r\n", maxBulkLen+1), err: "invalid bulk length"},
+		{req: strings.Repeat("*1\r\n", maxArrayDepth+1), err: "too deeply nested arrays"},
+	} {
+		_, err := NewResp(bytes.NewBufferString(tt.req)).Read()
+		require.Equal(t, protocolError(tt.err), err, tt.req)
+	}
+
+	// lengths larger than the data sent fail once the data runs out
+	_, err := NewResp(bytes.NewBufferString(fmt.Sprintf("*%d\r\n$3\r\nSET\r\n", maxArrayLen))).Read()
+	require.ErrorIs(t, err, io.EOF)
+	_, err = NewResp(bytes.NewBufferString(fmt.Sprintf("$%d\r\nvalue\r\n", maxBulkLen))).Read()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// the null array and null bulk string are still read
+	for _, req := range []string{"*-1\r\n", "$-1\r\n"} {
+		res, err := NewResp(bytes.NewBufferString(req)).Read()
+		require.NoError(t, err)
+		require.Equal(t, Value{typ: Null}, *res)
+	}
+}
+
+// test that MULTI queues commands until EXEC runs them, and that EXEC aborts when a watched key changed
+func TestTransaction(t *testing.T) {
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	other, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer other.Close()
+
+	require.Equal(t, "Err EXEC without MULTI", sendCommand(t, conn, "EXEC").str)
+	require.Equal(t, "Err DISCARD without MULTI", sendCommand(t, conn, "DISCARD").str)
+
+	require.Equal(t, AckVal, *sendCommand(t, conn, "MULTI"))
+	require.Equal(t, Error, sendCommand(t, conn, "MULTI").typ)
+	require.Equal(t, QueuedVal, *sendCommand(t, conn, "SET", "counter", "1"))
+	require.Equal(t, QueuedVal, *sendCommand(t, conn, "INCR", "counter"))
+	require.Equal(t, QueuedVal, *sendCommand(t, conn, "GET", "counter"))
+	// queued commands are not run before EXEC
+	require.Equal(t, Null, sendCommand(t, other, "GET", "counter").typ)
+
+	res := sendCommand(t, conn, "EXEC")
+	require.Equal(t, Array, res.typ)
+	require.Equal(t, []Value{AckVal, {typ: Integer, num: 2}, {typ: BulkString, bulkStr: "2"}}, res.array)
+
+	// discarded commands are never run
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "SET", "counter", "10")
+	require.Equal(t, AckVal, *sendCommand(t, conn, "DISCARD"))
+	require.Equal(t, "2", sendCommand(t, conn, "GET", "counter").bulkStr)
+
+	// a command failing to queue discards the whole transaction
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "SET", "counter", "10")
+	require.True(t, isUnknownCommand(*sendCommand(t, conn, "BOGUS")))
+	require.Equal(t, Error, sendCommand(t, conn, "GET").typ)
+	require.Equal(t, ErrExecAbort, *sendCommand(t, conn, "EXEC"))
+	require.Equal(t, "2", sendCommand(t, conn, "GET", "counter").bulkStr)
+
+	// a watched key written by another client aborts EXEC with a null reply
+	require.Equal(t, AckVal, *sendCommand(t, conn, "WATCH", "counter"))
+	sendCommand(t, other, "INCR", "counter")
+	sendCommand(t, conn, "MULTI")
+	require.Equal(t, Error, sendCommand(t, conn, "WATCH", "counter").typ)
+	sendCommand(t, conn, "SET", "counter", "10")
+	require.Equal(t, Null, sendCommand(t, conn, "EXEC").typ)
+	require.Equal(t, "3", sendCommand(t, conn, "GET", "counter").bulkStr)
+
+	// EXEC unwatches keys, so the next transaction goes through
+	sendCommand(t, other, "INCR", "counter")
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "SET", "counter", "10")
+	require.Equal(t, Array, sendCommand(t, conn, "EXEC").typ)
+	require.Equal(t, "10", sendCommand(t, conn, "GET", "counter").bulkStr)
+
+	// unchanged and unwatched keys don't abort EXEC
+	sendCommand(t, conn, "WATCH", "counter", "missing")
+	sendCommand(t, conn, "GET", "counter")
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "DEL", "counter")
+	require.Equal(t, []Value{{typ: Integer, num: 1}}, sendCommand(t, conn, "EXEC").array)
+
+	// a watched key set and deleted again aborts EXEC even though it's missing both times
+	sendCommand(t, conn, "WATCH", "counter")
+	sendCommand(t, other, "SET", "counter", "1")
+	sendCommand(t, other, "DEL", "counter")
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "SET", "counter", "10")
+	require.Equal(t, Null, sendCommand(t, conn, "EXEC").typ)
+	require.Equal(t, Null, sendCommand(t, conn, "GET", "counter").typ)
+
+	// writes and removals of the fields of a watched hash abort EXEC
+	sendCommand(t, conn, "HSET", "user", "name", "shabel", "age", "20")
+	for _, change := range [][]string{{"HSET", "user", "age", "21"}, {"HDEL", "user", "name"}, {"HSET", "user", "city", "accra"}} {
+		sendCommand(t, conn, "WATCH", "user")
+		sendCommand(t, other, change...)
+		sendCommand(t, conn, "MULTI")
+		sendCommand(t, conn, "HSET", "user", "age", "30")
+		require.Equal(t, Null, sendCommand(t, conn, "EXEC").typ, change)
+	}
+	require.Equal(t, "21", sendCommand(t, conn, "HGET", "user", "age").bulkStr)
+
+	sendCommand(t, conn, "WATCH", "counter")
+	sendCommand(t, other, "SET", "counter", "1")
+	require.Equal(t, AckVal, *sendCommand(t, conn, "UNWATCH"))
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "INCR", "counter")
+	require.Equal(t, []Value{{typ: Integer, num: 2}}, sendCommand(t, conn, "EXEC").array)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+)
+
+// commandInfo describes a supported command the way redis does in its COMMAND reply. arity counts the command
+// name, and a negative arity is the minimum number of arguments of a variadic command
+type commandInfo struct {
+	name  HandlerCommand
+	arity int
+	flags []string
+	// positions of the first and last key argument and the step between keys. a negative last key counts from
+	// the end of the arguments and zero positions mean the command takes no keys
+	firstKey int
+	lastKey  int
+	step     int
+}
+
+// commandTable lists every command the server handles and must be updated along with handleCommand
+var commandTable = []commandInfo{
+	{Ping, -1, []string{"fast", "no-auth"}, 0, 0, 0},
+	{Echo, 2, []string{"fast"}, 0, 0, 0},
+	{Hello, -1, []string{"fast", "no-auth"}, 0, 0, 0},
+	{Auth, -2, []string{"fast", "no-auth"}, 0, 0, 0},
+	{Command, -1, []string{"loading"}, 0, 0, 0},
+	{Set, -3, []string{"write"}, 1, 1, 1},
+	{SetNX, 3, []string{"write", "fast"}, 1, 1, 1},
+	{SetEx, 4, []string{"write"}, 1, 1, 1},
+	{PSetEx, 4, []string{"write"}, 1, 1, 1},
+	{Get, 2, []string{"readonly", "fast"}, 1, 1, 1},
+	{GetSet, 3, []string{"write", "fast"}, 1, 1, 1},
+	{Rename, 3, []string{"write"}, 1, 2, 1},
+	{RenameNX, 3, []string{"write", "fast"}, 1, 2, 1},
+	{Copy, -3, []string{"write"}, 1, 2, 1},
+	{Append, 3, []string{"write", "fast"}, 1, 1, 1},
+	{GetRange, 4, []string{"readonly"}, 1, 1, 1},
+	{SetRange, 4, []string{"write"}, 1, 1, 1},
+	{MSet, -3, []string{"write"}, 1, -1, 2},
+	{MGet, -2, []string{"readonly", "fast"}, 1, -1, 1},
+	{Del, -2, []string{"write"}, 1, -1, 1},
+	{FlushDB, -1, []string{"write"}, 0, 0, 0},
+	{FlushAll, -1, []string{"write"}, 0, 0, 0},
+	{Save, 1, []string{"admin"}, 0, 0, 0},
+	{DelPrefix, 2, []string{"write", "admin"}, 0, 0, 0},
+	{Expire, 3, []string{"write", "fast"}, 1, 1, 1},
+	{TTL, 2, []string{"readonly", "fast"}, 1, 1, 1},
+	{Persist, 2, []string{"write", "fast"}, 1, 1, 1},
+	{Incr, 2, []string{"write", "fast"}, 1, 1, 1},
+	{Decr, 2, []string{"write", "fast"}, 1, 1, 1},
+	{HSet, -4, []string{"write", "fast"}, 1, 1, 1},
+	{HGet, 3, []string{"readonly", "fast"}, 1, 1, 1},
+	{HDel, -3, []string{"write", "fast"}, 1, 1, 1},
+	{HGetAll, 2, []string{"readonly"}, 1, 1, 1},
+	{HMGet, -3, []string{"readonly", "fast"}, 1, 1, 1},
+	{HLen, 2, []string{"readonly", "fast"}, 1, 1, 1},
+	{HKeys, 2, []string{"readonly"}, 1, 1, 1},
+	{HVals, 2, []string{"readonly"}, 1, 1, 1},
+	{StrLen, 2, []string{"readonly", "fast"}, 1, 1, 1},
+	{Memory, -2, []string{"readonly"}, 0, 0, 0},
+	{DBSize, 1, []string{"readonly", "fast"}, 0, 0, 0},
+	{Type, 2, []string{"readonly", "fast"}, 1, 1, 1},
+	{Keys, 2, []string{"readonly"}, 0, 0, 0},
+	{Object, -2, []string{"readonly"}, 0, 0, 0},
+	{Scan, -2, []string{"readonly"}, 0, 0, 0},
+	{Client, -2, []string{"admin"}, 0, 0, 0},
+	{SlowLog, -2, []string{"admin"}, 0, 0, 0},
+	{Config, -2, []string{"admin"}, 0, 0, 0},
+	{Multi, 1, []string{"fast"}, 0, 0, 0},
+	{Exec, 1, []string{"slow"}, 0, 0, 0},
+	{Discard, 1, []string{"fast"}, 0, 0, 0},
+	{Watch, -2, []string{"fast"}, 1, -1, 1},
+	{Unwatch, 1, []string{"fast"}, 0, 0, 0},
+	{ReplicaOf, 3, []string{"admin"}, 0, 0, 0},
+	{SlaveOf, 3, []string{"admin"}, 0, 0, 0},
+}
+
+// command implements the redis COMMAND, COMMAND COUNT, COMMAND INFO and COMMAND DOCS subcommands. clients query
+// them on connect to learn the commands of the server, so the replies are minimal but well formed
+func (s *Server) command(args []Value) Value {
+	if len(args) == 0 {
+		res := Value{typ: Array, array: make([]Value, 0, len(commandTable))}
+		for _, info := range commandTable {
+			res.array = append(res.array, info.value())
+		}
+		return res
+	}
+
+	switch strings.ToUpper(args[0].bulkStr) {
+	case "COUNT":
+		return Value{typ: Integer, num: len(commandTable)}
+	case "INFO":
+		// every command is described when none are named
+		if len(args) == 1 {
+			return s.command(nil)
+		}
+		res := Value{typ: Array, array: make([]Value, 0, len(args)-1)}
+		for _, arg := range args[1:] {
+			info, ok := lookupCommand(arg.bulkStr)
+			if !ok {
+				res.array = append(res.array, NullVal)
+				continue
+			}
+			res.array = append(res.array, info.value())
+		}
+		return res
+	case "DOCS":
+		// commands have no docs, so each requested command maps to an empty doc
+		res := Value{typ: Map, array: []Value{}}
+		names := args[1:]
+		if len(names) == 0 {
+			for _, info := range commandTable {
+				names = append(names, Value{typ: BulkString, bulkStr: string(info.name)})
+			}
+		}
+		for _, arg := range names {
+			info, ok := lookupCommand(arg.bulkStr)
+			if !ok {
+				continue
+			}
+			res.array = append(res.array,
+				Value{typ: BulkString, bulkStr: strings.ToLower(string(info.name))},
+				Value{typ: Map, array: []Value{}},
+			)
+		}
+		return res
+	default:
+		return Value{typ: Error, str: "Err unknown subcommand '" + args[0].bulkStr + "'"}
+	}
+}
+
+// lookupCommand finds the description of a command by its case-insensitive name
+func lookupCommand(name string) (commandInfo, bool) {
+	for _, info := range commandTable {
+		if strings.EqualFold(string(info.name), name) {
+			return info, true
+		}
+	}
+	return commandInfo{}, false
+}
+
+// value converts the description into the array redis replies with: name, arity, flags, first key, last key and
+// step, with the name in lowercase
+func (info commandInfo) value() Value {
+	flags := Value{typ: Array, array: make([]Value, 0, len(info.flags))}
+	for _, flag := range info.flags {
+		flags.array = append(flags.array, Value{typ: SimpleString, str: flag})
+	}
+	return Value{typ: Array, array: []Value{
+		{typ: BulkString, bulkStr: strings.ToLower(string(info.name))},
+		{typ: Integer, num: info.arity},
+		flags,
+		{typ: Integer, num: info.firstKey},
+		{typ: Integer, num: info.lastKey},
+		{typ: Integer, num: info.step},
+	}}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	beck "github.com/mrshabel/beckdb"
+)
+
+// configParam is a database setting exposed through CONFIG. settings without a setter are read-only.
+// durations are given in milliseconds
+type configParam struct {
+	name string
+	get  func(cfg beck.Config) string
+	set  func(db *beck.BeckDB, val string) error
+}
+
+// errConfigParse rejects a CONFIG SET value that is not an integer
+var errConfigParse = errors.New("argument couldn't be parsed into an integer")
+
+var configParams = []configParam{
+	{name: "dir", get: func(cfg beck.Config) string { return cfg.DataDir }},
+	{name: "maxfilesize", get: func(cfg beck.Config) string { return strconv.FormatInt(cfg.MaxFileSize, 10) }},
+	{name: "maxkeysize", get: func(cfg beck.Config) string { return strconv.Itoa(cfg.MaxKeySize) }},
+	{name: "maxvaluesize", get: func(cfg beck.Config) string { return strconv.FormatInt(cfg.MaxValueSize, 10) }},
+	{name: "readonly", get: func(cfg beck.Config) string { return yesNo(cfg.ReadOnly) }},
+	{name: "syncwrite", get: func(cfg beck.Config) string { return yesNo(cfg.SyncOnWrite) }},
+	{name: "mergeinterval", get: func(cfg beck.Config) string { return formatMillis(cfg.MergeInterval) }},
+	{
+		name: "syncinterval",
+		get:  func(cfg beck.Config) string { return formatMillis(cfg.SyncInterval) },
+		set: func(db *beck.BeckDB, val string) error {
+			interval, err := parseMillis(val)
+			if err != nil {
+				return err
+			}
+			return db.SetSyncInterval(interval)
+		},
+	},
+	{
+		name: "slowopthreshold",
+		get:  func(cfg beck.Config) string { return formatMillis(cfg.SlowOpThreshold) },
+		set: func(db *beck.BeckDB, val string) error {
+			threshold, err := parseMillis(val)
+			if err != nil {
+				return err
+			}
+			return db.SetSlowOpThreshold(threshold)
+		},
+	},
+}
+
+// configCmd implements the redis CONFIG GET and CONFIG SET subcommands
+func (s *Server) configCmd(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'CONFIG' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulkStr) {
+	case "GET":
+		if len(args) < 2 {
+			return Value{typ: Error, str: "Err wrong number of arguments for 'CONFIG|GET' command"}
+		}
+		return s.configGet(args[1:])
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return Value{typ: Error, str: "Err wrong number of arguments for 'CONFIG|SET' command"}
+		}
+		return s.configSet(args[1:])
+	default:
+		return Value{typ: Error, str: "Err unknown subcommand '" + args[0].bulkStr + "'"}
+	}
+}
+
+// configGet replies with the name and value of every setting matching any of the glob patterns. patterns matching
+// no setting are ignored, so unknown settings give an empty reply
+func (s *Server) configGet(patterns []Value) Value {
+	cfg := s.db.Config()
+	res := Value{typ: Map, array: []Value{}}
+	for _, param := range configParams {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern.bulkStr), param.name) {
+				res.array = append(res.array,
+					Value{typ: BulkString, bulkStr: param.name},
+					Value{typ: BulkString, bulkStr: param.get(cfg)},
+				)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// configSet applies each setting and value pair in turn. every setting is checked to exist and be mutable before
+// any is applied
+func (s *Server) configSet(pairs []Value) Value {
+	params := make([]configParam, 0, len(pairs)/2)
+	for idx := 0; idx < len(pairs); idx += 2 {
+		name := pairs[idx].bulkStr
+		param, ok := lookupConfigParam(name)
+		if !ok {
+			return Value{typ: Error, str: "Err Unknown option or number of arguments for CONFIG SET - '" + name + "'"}
+		}
+		if param.set == nil {
+			return Value{typ: Error, str: "Err CONFIG SET failed (possibly related to argument '" + name + "') - can't set immutable config"}
+		}
+		params = append(params, param)
+	}
+
+	for idx, param := range params {
+		if err := param.set(s.db, pairs[2*idx+1].bulkStr); err != nil {
+			return Value{typ: Error, str: "Err CONFIG SET failed (possibly related to argument '" + param.name + "') - " + err.Error()}
+		}
+	}
+	return AckVal
+}
+
+// lookupConfigParam finds a setting by its case-insensitive name
+func lookupConfigParam(name string) (configParam, bool) {
+	for _, param := range configParams {
+		if strings.EqualFold(param.name, name) {
+			return param, true
+		}
+	}
+	return configParam{}, false
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+func parseMillis(val string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, errConfigParse
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{pattern: "*", str: "", match: true},
+		{pattern: "*", str: "user/1:name", match: true},
+		{pattern: "user*", str: "user1", match: true},
+		{pattern: "user*", str: "admin", match: false},
+		{pattern: "h?llo", str: "hello", match: true},
+		{pattern: "h?llo", str: "hllo", match: false},
+		{pattern: "h[ae]llo", str: "hallo", match: true},
+		{pattern: "h[ae]llo", str: "hillo", match: false},
+		{pattern: "h[^e]llo", str: "hallo", match: true},
+		{pattern: "h[^e]llo", str: "hello", match: false},
+		{pattern: "key[0-9]", str: "key7", match: true},
+		{pattern: "key[0-9]", str: "keyx", match: false},
+		{pattern: `star\*`, str: "star*", match: true},
+		{pattern: `star\*`, str: "stars", match: false},
+		{pattern: "*:name", str: "user1:name", match: true},
+	} {
+		require.Equal(t, tt.match, globMatch(tt.pattern, tt.str), "pattern %q against %q", tt.pattern, tt.str)
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	beck "github.com/mrshabel/beckdb"
 )
@@ -11,13 +18,67 @@ import (
 type HandlerCommand string
 
 const (
-	Ping HandlerCommand = "PING"
-	Set  HandlerCommand = "SET"
-	Get  HandlerCommand = "GET"
-	Del  HandlerCommand = "DEL"
-	HSet HandlerCommand = "HSET"
-	HGet HandlerCommand = "HGET"
-	HDel HandlerCommand = "HDEL"
+	Ping    HandlerCommand = "PING"
+	Set     HandlerCommand = "SET"
+	Get     HandlerCommand = "GET"
+	Del     HandlerCommand = "DEL"
+	HSet    HandlerCommand = "HSET"
+	HGet    HandlerCommand = "HGET"
+	HDel    HandlerCommand = "HDEL"
+	HGetAll HandlerCommand = "HGETALL"
+	HMGet   HandlerCommand = "HMGET"
+	HLen    HandlerCommand = "HLEN"
+	HKeys   HandlerCommand = "HKEYS"
+	HVals   HandlerCommand = "HVALS"
+	StrLen  HandlerCommand = "STRLEN"
+	Memory  HandlerCommand = "MEMORY"
+	Client  HandlerCommand = "CLIENT"
+	Hello   HandlerCommand = "HELLO"
+	Auth    HandlerCommand = "AUTH"
+	Keys    HandlerCommand = "KEYS"
+	Scan    HandlerCommand = "SCAN"
+	DBSize  HandlerCommand = "DBSIZE"
+	Incr    HandlerCommand = "INCR"
+	Decr    HandlerCommand = "DECR"
+	Object  HandlerCommand = "OBJECT"
+	MGet    HandlerCommand = "MGET"
+	MSet    HandlerCommand = "MSET"
+	SetNX   HandlerCommand = "SETNX"
+	GetSet  HandlerCommand = "GETSET"
+	SetEx   HandlerCommand = "SETEX"
+	PSetEx  HandlerCommand = "PSETEX"
+	Expire  HandlerCommand = "EXPIRE"
+	TTL     HandlerCommand = "TTL"
+	Persist HandlerCommand = "PERSIST"
+	SlowLog HandlerCommand = "SLOWLOG"
+	Type    HandlerCommand = "TYPE"
+	Append  HandlerCommand = "APPEND"
+	Echo    HandlerCommand = "ECHO"
+	Command HandlerCommand = "COMMAND"
+	Config  HandlerCommand = "CONFIG"
+	// renaming keeps the expiry of the key
+	Rename   HandlerCommand = "RENAME"
+	RenameNX HandlerCommand = "RENAMENX"
+	Copy     HandlerCommand = "COPY"
+	// ranges treat values as byte buffers
+	GetRange HandlerCommand = "GETRANGE"
+	SetRange HandlerCommand = "SETRANGE"
+	// beckdb has a single database, so both flush it
+	FlushDB  HandlerCommand = "FLUSHDB"
+	FlushAll HandlerCommand = "FLUSHALL"
+	// writes are already on disk, so saving only syncs them
+	Save HandlerCommand = "SAVE"
+	// removes every string key under a prefix, such as the namespace of a tenant
+	DelPrefix HandlerCommand = "DELPREFIX"
+	// transaction commands, handled per connection
+	Multi   HandlerCommand = "MULTI"
+	Exec    HandlerCommand = "EXEC"
+	Discard HandlerCommand = "DISCARD"
+	Watch   HandlerCommand = "WATCH"
+	Unwatch HandlerCommand = "UNWATCH"
+	// replication commands accepted by standalone servers
+	ReplicaOf HandlerCommand = "REPLICAOF"
+	SlaveOf   HandlerCommand = "SLAVEOF"
 )
 
 // resp ack and response
@@ -27,15 +88,34 @@ var (
 	HSetCreated Value = Value{typ: Integer, num: 1}
 	HSetUpdated Value = Value{typ: Integer, num: 0}
 	HSetNoOp    Value = Value{typ: Integer, num: 0}
+
+	ErrNotInteger Value = Value{typ: Error, str: "Err value is not an integer or out of range"}
+	ErrReadOnly   Value = Value{typ: Error, str: "READONLY You can't write against a read only replica."}
+	ErrNoAuth     Value = Value{typ: Error, str: "NOAUTH Authentication required."}
+	ErrNoSuchKey  Value = Value{typ: Error, str: "Err no such key"}
+	ErrWrongType  Value = Value{typ: Error, str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	ErrWrongPass  Value = Value{typ: Error, str: "WRONGPASS invalid username-password pair or user is disabled."}
 )
 
 // HandlerFunc is the function to execute. only the args received will be passed to it.
 type HandlerFunc func([]Value) Value
 
 func (s *Server) ping(args []Value) Value {
+	// echo the message back when one is provided
+	if len(args) > 0 {
+		return Value{typ: BulkString, bulkStr: args[0].bulkStr}
+	}
 	return Value{typ: SimpleString, str: "PONG"}
 }
 
+// echo replies with the message as-is
+func (s *Server) echo(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'ECHO' command"}
+	}
+	return Value{typ: BulkString, bulkStr: args[0].bulkStr}
+}
+
 // set stores a key value pair. args should be of length 2, key followed by value
 func (s *Server) set(args []Value) Value {
 	if len(args) < 2 {
@@ -45,15 +125,302 @@ func (s *Server) set(args []Value) Value {
 	key := args[0].bulkStr
 	val := args[1].bulkStr
 
+	unlock := s.lockNames(key)
+	defer unlock()
+	if s.isHash(key) {
+		return ErrWrongType
+	}
+
 	// write to db
 	if err := s.db.Put(key, []byte(val)); err != nil {
-		return Value{typ: Error, str: err.Error()}
+		return writeError(err)
 	}
 
 	// ack operation
 	return AckVal
 }
 
+// setNX stores a key value pair only if the key does not exist. the reply is 1 if the key was set, 0 otherwise
+func (s *Server) setNX(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'SETNX' command"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr)
+	defer unlock()
+	if s.isHash(args[0].bulkStr) {
+		return ErrWrongType
+	}
+
+	written, err := s.db.PutIfAbsent(args[0].bulkStr, []byte(args[1].bulkStr))
+	if err != nil {
+		return writeError(err)
+	}
+	if !written {
+		return Value{typ: Integer, num: 0}
+	}
+	return Value{typ: Integer, num: 1}
+}
+
+// rename implements the redis RENAME command, which moves the value and expiry of a string key to a new key,
+// replacing any string stored there. hashes can't be renamed, and a new key holding a hash isn't replaced
+func (s *Server) rename(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'RENAME' command"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr, args[1].bulkStr)
+	defer unlock()
+	if s.isHash(args[1].bulkStr) {
+		return ErrWrongType
+	}
+
+	if err := s.db.Rename(args[0].bulkStr, args[1].bulkStr); err != nil {
+		return s.renameError(args[0].bulkStr, err)
+	}
+	return AckVal
+}
+
+// renameNX implements the redis RENAMENX command, which renames a string key only if the new key doesn't exist
+func (s *Server) renameNX(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'RENAMENX' command"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr, args[1].bulkStr)
+	defer unlock()
+	if s.isHash(args[1].bulkStr) {
+		return Value{typ: Integer, num: 0}
+	}
+
+	renamed, err := s.db.RenameIfAbsent(args[0].bulkStr, args[1].bulkStr)
+	if err != nil {
+		return s.renameError(args[0].bulkStr, err)
+	}
+	if !renamed {
+		return Value{typ: Integer, num: 0}
+	}
+	return Value{typ: Integer, num: 1}
+}
+
+// copyCmd implements the redis COPY command where the args are of the form: source destination [REPLACE]
+// the value and expiry of a string key are copied, and an existing destination is only overwritten with REPLACE.
+// hashes can't be copied, and a destination holding a hash isn't overwritten
+func (s *Server) copyCmd(args []Value) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'COPY' command"}
+	}
+	replace := len(args) == 3
+	if replace && strings.ToUpper(args[2].bulkStr) != "REPLACE" {
+		return Value{typ: Error, str: "Err syntax error"}
+	}
+	if args[0].bulkStr == args[1].bulkStr {
+		return Value{typ: Error, str: "Err source and destination objects are the same"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr, args[1].bulkStr)
+	defer unlock()
+	if s.isHash(args[1].bulkStr) {
+		if !replace {
+			return Value{typ: Integer, num: 0}
+		}
+		return ErrWrongType
+	}
+
+	copied, err := s.db.Copy(args[0].bulkStr, args[1].bulkStr, replace)
+	switch {
+	case errors.Is(err, beck.ErrKeyNotFound) && s.isHash(args[0].bulkStr):
+		return ErrWrongType
+	case err != nil && !errors.Is(err, beck.ErrKeyNotFound):
+		return writeError(err)
+	}
+	if !copied {
+		return Value{typ: Integer, num: 0}
+	}
+	return Value{typ: Integer, num: 1}
+}
+
+// renameError converts an error from renaming a key into a reply. a key missing as a string may name a hash
+func (s *Server) renameError(key string, err error) Value {
+	switch {
+	case errors.Is(err, beck.ErrKeyNotFound) && s.isHash(key):
+		return ErrWrongType
+	case errors.Is(err, beck.ErrKeyNotFound):
+		return ErrNoSuchKey
+	}
+	return writeError(err)
+}
+
+// setEx stores a key value pair that expires after the given ttl. unit is the duration of one ttl step,
+// seconds for SETEX and milliseconds for PSETEX
+func (s *Server) setEx(args []Value, unit time.Duration, name string) Value {
+	if len(args) < 3 {
+		return Value{typ: Error, str: "Err wrong number of arguments for '" + name + "' command"}
+	}
+
+	ttl, err := strconv.ParseInt(args[1].bulkStr, 10, 64)
+	if err != nil {
+		return Value{typ: Error, str: "Err value is not an integer or out of range"}
+	}
+	// bound the ttl so it can't overflow once converted to a duration
+	if ttl <= 0 || ttl > math.MaxInt64/int64(unit) {
+		return Value{typ: Error, str: "Err invalid expire time in '" + strings.ToLower(name) + "' command"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr)
+	defer unlock()
+	if s.isHash(args[0].bulkStr) {
+		return ErrWrongType
+	}
+
+	if err := s.db.PutWithTTL(args[0].bulkStr, []byte(args[2].bulkStr), time.Duration(ttl)*unit); err != nil {
+		return writeError(err)
+	}
+	return AckVal
+}
+
+// expire sets a key to expire after the given number of seconds. the reply is 1 if the expiry was set, 0 if the key
+// does not exist. hashes don't expire and reply WRONGTYPE
+func (s *Server) expire(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'EXPIRE' command"}
+	}
+
+	secs, err := strconv.ParseInt(args[1].bulkStr, 10, 64)
+	if err != nil {
+		return Value{typ: Error, str: "Err value is not an integer or out of range"}
+	}
+	// bound the seconds so they can't overflow once converted to a duration
+	if secs > math.MaxInt64/int64(time.Second) || secs < math.MinInt64/int64(time.Second) {
+		return Value{typ: Error, str: "Err invalid expire time in 'expire' command"}
+	}
+
+	err = s.db.SetExpiry(args[0].bulkStr, time.Now().Add(time.Duration(secs)*time.Second))
+	if errors.Is(err, beck.ErrKeyNotFound) {
+		if s.isHash(args[0].bulkStr) {
+			return ErrWrongType
+		}
+		return Value{typ: Integer, num: 0}
+	}
+	if err != nil {
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: 1}
+}
+
+// ttl replies with the remaining seconds before a key expires, -1 if the key has no expiry and -2 if it does not exist.
+// hashes never expire
+func (s *Server) ttl(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'TTL' command"}
+	}
+
+	at, err := s.db.GetExpiry(args[0].bulkStr)
+	if err != nil {
+		if s.isHash(args[0].bulkStr) {
+			return Value{typ: Integer, num: -1}
+		}
+		return Value{typ: Integer, num: -2}
+	}
+	if at.IsZero() {
+		return Value{typ: Integer, num: -1}
+	}
+
+	// round up so a key is not reported as 0 while it is still visible
+	remaining := time.Until(at)
+	return Value{typ: Integer, num: int((remaining + time.Second - 1) / time.Second)}
+}
+
+// persist removes the expiry of a key. the reply is 1 if an expiry was removed, 0 if the key does not exist or
+// has no expiry, as is always the case for hashes
+func (s *Server) persist(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'PERSIST' command"}
+	}
+
+	key := args[0].bulkStr
+	at, err := s.db.GetExpiry(key)
+	if err != nil || at.IsZero() {
+		return Value{typ: Integer, num: 0}
+	}
+
+	if err := s.db.SetExpiry(key, time.Time{}); err != nil {
+		if errors.Is(err, beck.ErrKeyNotFound) {
+			return Value{typ: Integer, num: 0}
+		}
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: 1}
+}
+
+// appendCmd appends a value to the string stored at key and replies with the new length of the string
+func (s *Server) appendCmd(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'APPEND' command"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr)
+	defer unlock()
+	if s.isHash(args[0].bulkStr) {
+		return ErrWrongType
+	}
+
+	n, err := s.db.Append(args[0].bulkStr, []byte(args[1].bulkStr))
+	if err != nil {
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: n}
+}
+
+// getRange implements the redis GETRANGE command and replies with the bytes of the string between the start and end
+// offsets, both inclusive. negative offsets count back from the end of the string, and missing keys are empty
+func (s *Server) getRange(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'GETRANGE' command"}
+	}
+	start, err := strconv.Atoi(args[1].bulkStr)
+	if err != nil {
+		return ErrNotInteger
+	}
+	end, err := strconv.Atoi(args[2].bulkStr)
+	if err != nil {
+		return ErrNotInteger
+	}
+
+	val, err := s.db.GetRange(args[0].bulkStr, start, end)
+	if err != nil && !errors.Is(err, beck.ErrKeyNotFound) {
+		return Value{typ: Error, str: "Err " + err.Error()}
+	}
+	return Value{typ: BulkString, bulkStr: string(val)}
+}
+
+// setRange implements the redis SETRANGE command, which overwrites the string stored at key from offset and
+// replies with the new length of the string. the string is padded with zero bytes up to offset
+func (s *Server) setRange(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'SETRANGE' command"}
+	}
+	offset, err := strconv.Atoi(args[1].bulkStr)
+	if err != nil {
+		return ErrNotInteger
+	}
+	if offset < 0 {
+		return Value{typ: Error, str: "Err offset is out of range"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr)
+	defer unlock()
+	if s.isHash(args[0].bulkStr) {
+		return ErrWrongType
+	}
+
+	n, err := s.db.SetRange(args[0].bulkStr, offset, []byte(args[2].bulkStr))
+	if err != nil {
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: n}
+}
+
 // get retrieves the value associated with a given key
 func (s *Server) get(args []Value) Value {
 	if len(args) < 1 {
@@ -65,49 +432,175 @@ func (s *Server) get(args []Value) Value {
 	// retrieve value
 	val, err := s.db.Get(key)
 	if err != nil {
-		return NullVal
+		return readError(err)
 	}
 
 	return Value{typ: BulkString, bulkStr: string(val)}
 }
 
-// del deletes an entry with a given key
-func (s *Server) del(args []Value) Value {
-	if len(args) < 1 {
-		return Value{typ: Error, str: "Err wrong number of arguments for 'GET' command"}
+// getSet atomically stores a new value and replies with the old one, or a null bulk string if the key was absent
+func (s *Server) getSet(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'GETSET' command"}
 	}
 
-	key := args[0].bulkStr
+	unlock := s.lockNames(args[0].bulkStr)
+	defer unlock()
+	if s.isHash(args[0].bulkStr) {
+		return ErrWrongType
+	}
 
-	// retrieve value
-	if err := s.db.Delete(key); err != nil {
+	old, err := s.db.GetSet(args[0].bulkStr, []byte(args[1].bulkStr))
+	if err != nil {
+		return writeError(err)
+	}
+	if old == nil {
 		return NullVal
 	}
+	return Value{typ: BulkString, bulkStr: string(old)}
+}
+
+// mGet retrieves the values of all the given keys. the reply holds a null bulk string for each missing key
+func (s *Server) mGet(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'MGET' command"}
+	}
+
+	res := Value{typ: Array, array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		val, err := s.db.Get(arg.bulkStr)
+		if err != nil {
+			if errors.Is(err, beck.ErrKeyNotFound) {
+				res.array = append(res.array, NullVal)
+				continue
+			}
+			return readError(err)
+		}
+		res.array = append(res.array, Value{typ: BulkString, bulkStr: string(val)})
+	}
+	return res
+}
+
+// mSet stores all key value pairs atomically. args should be of the form: key value [key value ...]
+func (s *Server) mSet(args []Value) Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'MSET' command"}
+	}
+
+	keys := make([]string, 0, len(args)/2)
+	for idx := 0; idx < len(args); idx += 2 {
+		keys = append(keys, args[idx].bulkStr)
+	}
+	unlock := s.lockNames(keys...)
+	defer unlock()
+	for _, key := range keys {
+		if s.isHash(key) {
+			return ErrWrongType
+		}
+	}
+
+	batch := beck.NewBatch()
+	for idx := 0; idx < len(args); idx += 2 {
+		batch.Put(args[idx].bulkStr, []byte(args[idx+1].bulkStr))
+	}
 
+	if err := s.db.Write(batch); err != nil {
+		return writeError(err)
+	}
 	return AckVal
 }
 
-// hSet implements the redis HSET command for storing a hashmap entry.
-// args will typically be: hash field value[field value ...] (user1 name shabel)
-// this implementation is limited to a single field and value for now
+// del implements the redis DEL command and replies with the number of keys removed. naming a hash removes all of
+// its fields. with a trailing WITHTYPES, the reply instead pairs each type with the number of entries of that type
+// removed, counting every field of a removed hash: string <count> hash <count>
+func (s *Server) del(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'DEL' command"}
+	}
+
+	withTypes := len(args) > 1 && strings.ToUpper(args[len(args)-1].bulkStr) == "WITHTYPES"
+	if withTypes {
+		args = args[:len(args)-1]
+	}
+
+	// all entries are removed with a single batch. repeated keys are only removed once
+	batch := beck.NewBatch()
+	seen := make(map[string]bool, len(args))
+	var removed, strs, fields int
+	for _, arg := range args {
+		key := arg.bulkStr
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if s.db.Has(key) {
+			batch.Delete(key)
+			removed++
+			strs++
+		}
+		if fieldKeys := s.db.ScanPrefix(getHashPrefix(key)); len(fieldKeys) > 0 {
+			for _, fieldKey := range fieldKeys {
+				batch.Delete(fieldKey)
+			}
+			removed++
+			fields += len(fieldKeys)
+		}
+	}
+
+	if batch.Len() > 0 {
+		if err := s.db.Write(batch); err != nil {
+			return writeError(err)
+		}
+	}
+
+	if withTypes {
+		return Value{typ: Array, array: []Value{
+			{typ: BulkString, bulkStr: "string"},
+			{typ: Integer, num: strs},
+			{typ: BulkString, bulkStr: "hash"},
+			{typ: Integer, num: fields},
+		}}
+	}
+	return Value{typ: Integer, num: removed}
+}
+
+// hSet implements the redis HSET command for storing hashmap entries.
+// args will typically be: hash field value [field value ...] (user1 name shabel age 20)
+// the reply is the number of fields that were newly created, updates are not counted
 func (s *Server) hSet(args []Value) Value {
-	if len(args) < 3 {
+	if len(args) < 3 || (len(args)-1)%2 != 0 {
 		return Value{typ: Error, str: "Err wrong number of arguments for 'HSET' command"}
 	}
 
 	hashStr := args[0].bulkStr
-	field := args[1].bulkStr
-	value := args[2].bulkStr
+	unlock := s.lockNames(hashStr)
+	defer unlock()
+	if s.db.Has(hashStr) {
+		return ErrWrongType
+	}
 
-	// compose key as hash:field
-	key := getHashKey(hashStr, field)
+	// all fields are written with a single batch. a repeated field is only created once and keeps its last value
+	batch := beck.NewBatch()
+	seen := make(map[string]bool, (len(args)-1)/2)
+	created := 0
+	for idx := 1; idx < len(args); idx += 2 {
+		field := args[idx].bulkStr
+		value := args[idx+1].bulkStr
 
-	// write to db
-	if err := s.db.Put(key, []byte(value)); err != nil {
-		return Value{typ: Error, str: err.Error()}
+		// compose the composite key of the hash and field
+		key := getHashKey(hashStr, field)
+		if !seen[key] && !s.db.Has(key) {
+			created++
+		}
+		seen[key] = true
+		batch.Put(key, []byte(value))
 	}
 
-	return HSetCreated
+	if err := s.db.Write(batch); err != nil {
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: created}
 }
 
 // hGet implements the redis HGET command where the args are of the form:
@@ -133,26 +626,392 @@ func (s *Server) hGet(args []Value) Value {
 	return Value{typ: BulkString, bulkStr: string(val)}
 }
 
+// hGetAll implements the redis HGETALL command. the reply is a map of each field to its value, sent to resp2
+// clients as an array alternating them, and is empty when the hash does not exist
+func (s *Server) hGetAll(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'HGETALL' command"}
+	}
+
+	prefix := getHashPrefix(args[0].bulkStr)
+	res := Value{typ: Map, array: []Value{}}
+	for _, key := range s.db.ScanPrefix(prefix) {
+		val, err := s.db.Get(key)
+		if err != nil {
+			// field removed since the scan
+			if errors.Is(err, beck.ErrKeyNotFound) {
+				continue
+			}
+			return Value{typ: Error, str: "Err " + err.Error()}
+		}
+
+		field := strings.TrimPrefix(key, prefix)
+		res.array = append(res.array,
+			Value{typ: BulkString, bulkStr: field},
+			Value{typ: BulkString, bulkStr: string(val)},
+		)
+	}
+
+	return res
+}
+
+// hLen implements the redis HLEN command. the reply is the number of fields of the hash, which is 0 when the hash
+// does not exist
+func (s *Server) hLen(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'HLEN' command"}
+	}
+
+	return Value{typ: Integer, num: len(s.db.ScanPrefix(getHashPrefix(args[0].bulkStr)))}
+}
+
+// hKeys implements the redis HKEYS command. the reply is an array of the field names of the hash
+func (s *Server) hKeys(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'HKEYS' command"}
+	}
+
+	prefix := getHashPrefix(args[0].bulkStr)
+	keys := s.db.ScanPrefix(prefix)
+	res := Value{typ: Array, array: make([]Value, 0, len(keys))}
+	for _, key := range keys {
+		res.array = append(res.array, Value{typ: BulkString, bulkStr: strings.TrimPrefix(key, prefix)})
+	}
+	return res
+}
+
+// hVals implements the redis HVALS command. the reply is an array of the values of the hash, in the order of their
+// fields
+func (s *Server) hVals(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'HVALS' command"}
+	}
+
+	keys := s.db.ScanPrefix(getHashPrefix(args[0].bulkStr))
+	res := Value{typ: Array, array: make([]Value, 0, len(keys))}
+	for _, key := range keys {
+		val, err := s.db.Get(key)
+		if err != nil {
+			// field removed since the scan
+			if errors.Is(err, beck.ErrKeyNotFound) {
+				continue
+			}
+			return Value{typ: Error, str: "Err " + err.Error()}
+		}
+		res.array = append(res.array, Value{typ: BulkString, bulkStr: string(val)})
+	}
+	return res
+}
+
+// hMGet implements the redis HMGET command where the args are of the form:
+// hash field [field ...]. the reply holds the value of each field in order, with nulls for missing fields
+func (s *Server) hMGet(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'HMGET' command"}
+	}
+
+	hashStr := args[0].bulkStr
+	res := Value{typ: Array, array: make([]Value, 0, len(args)-1)}
+	for _, field := range args[1:] {
+		val, err := s.db.Get(getHashKey(hashStr, field.bulkStr))
+		if err != nil {
+			if errors.Is(err, beck.ErrKeyNotFound) {
+				res.array = append(res.array, NullVal)
+				continue
+			}
+			return Value{typ: Error, str: "Err " + err.Error()}
+		}
+		res.array = append(res.array, Value{typ: BulkString, bulkStr: string(val)})
+	}
+
+	return res
+}
+
 // hDel implements the redis HDEL command where the args are of the form:
-// hash field. Only a single key deletion is supported now
+// hash field [field ...]. the fields are removed with a single batch and the reply is the number of fields removed,
+// so missing and repeated fields are not counted
 func (s *Server) hDel(args []Value) Value {
 	if len(args) < 2 {
-		return Value{typ: Error, str: "Err wrong number of arguments for 'HGET' command"}
+		return Value{typ: Error, str: "Err wrong number of arguments for 'HDEL' command"}
 	}
 
 	hashStr := args[0].bulkStr
-	field := args[1].bulkStr
-	key := getHashKey(hashStr, field)
+	batch := beck.NewBatch()
+	seen := make(map[string]bool, len(args)-1)
+	for _, field := range args[1:] {
+		key := getHashKey(hashStr, field.bulkStr)
+		if seen[key] || !s.db.Has(key) {
+			continue
+		}
+		seen[key] = true
+		batch.Delete(key)
+	}
+
+	if batch.Len() > 0 {
+		if err := s.db.Write(batch); err != nil {
+			return writeError(err)
+		}
+	}
+	return Value{typ: Integer, num: batch.Len()}
+}
+
+// strLen returns the length of the value stored at key, or 0 if the key is missing.
+// the length is read from the keydir so the value is never loaded from disk
+func (s *Server) strLen(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'STRLEN' command"}
+	}
 
-	if err := s.db.Delete(key); err != nil {
-		return HSetNoOp
+	n, err := s.db.ValueLen(args[0].bulkStr)
+	if err != nil {
+		if errors.Is(err, beck.ErrKeyNotFound) {
+			return Value{typ: Integer, num: 0}
+		}
+		return Value{typ: Error, str: "Err " + err.Error()}
 	}
 
-	return HSetCreated
+	return Value{typ: Integer, num: n}
+}
+
+// memory implements the MEMORY USAGE subcommand. the reported usage is the key and value length
+// as recorded in the keydir, so no disk read is performed
+func (s *Server) memory(args []Value) Value {
+	if len(args) < 2 || strings.ToUpper(args[0].bulkStr) != "USAGE" {
+		return Value{typ: Error, str: "Err unknown subcommand or wrong number of arguments for 'MEMORY' command"}
+	}
+
+	key := args[1].bulkStr
+	n, err := s.db.ValueLen(key)
+	if err != nil {
+		if errors.Is(err, beck.ErrKeyNotFound) {
+			return NullVal
+		}
+		return Value{typ: Error, str: "Err " + err.Error()}
+	}
+
+	return Value{typ: Integer, num: len(key) + n}
+}
+
+// keys replies with all keys matching a glob pattern. this walks the entire keydir so it is meant
+// for admin tooling rather than the hot path
+func (s *Server) keys(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'KEYS' command"}
+	}
+
+	pattern := args[0].bulkStr
+	keys := s.db.ListKeys()
+	slices.Sort(keys)
+	keys = logicalKeys(keys)
+	slices.Sort(keys)
+
+	res := Value{typ: Array, array: []Value{}}
+	for _, key := range keys {
+		if globMatch(pattern, key) {
+			res.array = append(res.array, Value{typ: BulkString, bulkStr: key})
+		}
+	}
+	return res
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT n]. the reply is a two element array of the next cursor
+// and the batch of keys. like redis, the pattern is applied after the batch is retrieved so a page may be empty.
+// COUNT bounds the keys visited, and each field of a hash counts as one
+func (s *Server) scan(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'SCAN' command"}
+	}
+
+	cursor, err := strconv.ParseUint(args[0].bulkStr, 10, 64)
+	if err != nil {
+		return Value{typ: Error, str: "Err invalid cursor"}
+	}
+
+	// parse options
+	pattern, count := "*", 0
+	for idx := 1; idx < len(args); idx += 2 {
+		if idx+1 >= len(args) {
+			return Value{typ: Error, str: "Err syntax error"}
+		}
+		switch strings.ToUpper(args[idx].bulkStr) {
+		case "MATCH":
+			pattern = args[idx+1].bulkStr
+		case "COUNT":
+			count, err = strconv.Atoi(args[idx+1].bulkStr)
+			if err != nil || count < 1 {
+				return Value{typ: Error, str: "Err value is not an integer or out of range"}
+			}
+		default:
+			return Value{typ: Error, str: "Err syntax error"}
+		}
+	}
+
+	keys, next, err := s.db.Scan(cursor, count)
+	if err != nil {
+		return Value{typ: Error, str: "Err " + err.Error()}
+	}
+
+	// a hash whose fields span pages is reported on the page holding its first field
+	names := logicalKeys(keys)
+	if len(keys) > 0 && cursor != 0 {
+		if name, ok := hashName(keys[0]); ok {
+			if fields := s.db.ScanPrefix(getHashPrefix(name)); len(fields) > 0 && fields[0] < keys[0] {
+				names = names[1:]
+			}
+		}
+	}
+
+	batch := Value{typ: Array, array: []Value{}}
+	for _, key := range names {
+		if globMatch(pattern, key) {
+			batch.array = append(batch.array, Value{typ: BulkString, bulkStr: key})
+		}
+	}
+
+	return Value{typ: Array, array: []Value{
+		{typ: BulkString, bulkStr: strconv.FormatUint(next, 10)},
+		batch,
+	}}
+}
+
+// dbSize counts the keys clients see. every hash counts once rather than once per field
+func (s *Server) dbSize() int {
+	fields := s.db.ScanPrefix(hashKeyMarker)
+	return s.db.KeyCount() - len(fields) + len(logicalKeys(fields))
+}
+
+// incrBy adds delta to the integer stored at key and replies with the new value. missing keys are treated as 0
+func (s *Server) incrBy(args []Value, delta int64, name string) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for '" + name + "' command"}
+	}
+
+	unlock := s.lockNames(args[0].bulkStr)
+	defer unlock()
+	if s.isHash(args[0].bulkStr) {
+		return ErrWrongType
+	}
+
+	next, err := s.db.Increment(args[0].bulkStr, delta)
+	if err != nil {
+		if errors.Is(err, beck.ErrValueNotInteger) {
+			return ErrNotInteger
+		}
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: int(next)}
+}
+
+// object implements the OBJECT REFCOUNT and OBJECT HELP subcommands. beckdb has no shared objects
+// so every existing key has a reference count of 1
+func (s *Server) object(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'OBJECT' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulkStr) {
+	case "REFCOUNT":
+		if len(args) != 2 {
+			return Value{typ: Error, str: "Err wrong number of arguments for 'OBJECT|REFCOUNT' command"}
+		}
+		if !s.db.Has(args[1].bulkStr) {
+			return NullVal
+		}
+		return Value{typ: Integer, num: 1}
+	case "HELP":
+		return Value{typ: Array, array: []Value{
+			{typ: SimpleString, str: "OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"},
+			{typ: SimpleString, str: "REFCOUNT <key>"},
+			{typ: SimpleString, str: "    Return the number of references of the value associated with the specified key."},
+			{typ: SimpleString, str: "HELP"},
+			{typ: SimpleString, str: "    Print this help."},
+		}}
+	default:
+		return Value{typ: Error, str: "Err unknown subcommand '" + args[0].bulkStr + "'. Try OBJECT HELP."}
+	}
+}
+
+// keyType implements the redis TYPE command. plain keys are strings and a key with at least one field stored
+// under its hash prefix is a hash. missing keys are reported as none. no type is stored: writers keep every name
+// to a single type (see lockNames) and isHash is exact, so the two probes can't both match
+func (s *Server) keyType(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'TYPE' command"}
+	}
+
+	key := args[0].bulkStr
+	switch {
+	case s.db.Has(key):
+		return Value{typ: SimpleString, str: "string"}
+	case s.isHash(key):
+		return Value{typ: SimpleString, str: "hash"}
+	default:
+		return Value{typ: SimpleString, str: "none"}
+	}
+}
+
+// slowLog implements the SLOWLOG GET [count], SLOWLOG LEN and SLOWLOG RESET subcommands. each entry holds its id,
+// start time as a unix timestamp, duration in microseconds and the operation with its key
+func (s *Server) slowLog(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'SLOWLOG' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulkStr) {
+	case "GET":
+		ops := s.db.SlowLog()
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1].bulkStr)
+			if err != nil {
+				return Value{typ: Error, str: "Err value is not an integer or out of range"}
+			}
+			if count >= 0 && count < len(ops) {
+				ops = ops[:count]
+			}
+		}
+
+		entries := Value{typ: Array, array: make([]Value, 0, len(ops))}
+		for _, op := range ops {
+			cmd := []Value{{typ: BulkString, bulkStr: op.Op}}
+			if op.Key != "" {
+				cmd = append(cmd, Value{typ: BulkString, bulkStr: op.Key})
+			}
+			entries.array = append(entries.array, Value{typ: Array, array: []Value{
+				{typ: Integer, num: int(op.ID)},
+				{typ: Integer, num: int(op.Start.Unix())},
+				{typ: Integer, num: int(op.Duration.Microseconds())},
+				{typ: Array, array: cmd},
+			}})
+		}
+		return entries
+	case "LEN":
+		return Value{typ: Integer, num: len(s.db.SlowLog())}
+	case "RESET":
+		s.db.ResetSlowLog()
+		return AckVal
+	default:
+		return Value{typ: Error, str: "Err unknown subcommand '" + args[0].bulkStr + "'"}
+	}
+}
+
+// replicaOf implements REPLICAOF NO ONE and its SLAVEOF alias. beckdb is a standalone server, so turning it into
+// a primary is a no-op and configuring it as a replica is rejected
+func (s *Server) replicaOf(args []Value, name string) Value {
+	if len(args) != 2 {
+		return Value{typ: Error, str: "Err wrong number of arguments for '" + name + "' command"}
+	}
+	if strings.EqualFold(args[0].bulkStr, "NO") && strings.EqualFold(args[1].bulkStr, "ONE") {
+		return AckVal
+	}
+	return Value{typ: Error, str: "Err replication is not supported. beckdb only runs as a standalone server"}
 }
 
 // handleCommand acts as the route handler for the request
 func (s *Server) handleCommand(command HandlerCommand, args []Value) Value {
+	if key, ok := reservedKey(command, args); ok {
+		return Value{typ: Error, str: fmt.Sprintf("Err key '%.128s' starts with the reserved hash key marker", key)}
+	}
+
 	switch command {
 	case Ping:
 		return s.ping(args)
@@ -168,12 +1027,281 @@ func (s *Server) handleCommand(command HandlerCommand, args []Value) Value {
 		return s.hGet(args)
 	case HDel:
 		return s.hDel(args)
+	case HGetAll:
+		return s.hGetAll(args)
+	case HMGet:
+		return s.hMGet(args)
+	case HLen:
+		return s.hLen(args)
+	case HKeys:
+		return s.hKeys(args)
+	case HVals:
+		return s.hVals(args)
+	case StrLen:
+		return s.strLen(args)
+	case Memory:
+		return s.memory(args)
+	case Client:
+		return s.clientCmd(args)
+	case Keys:
+		return s.keys(args)
+	case Scan:
+		return s.scan(args)
+	case DBSize:
+		return Value{typ: Integer, num: s.dbSize()}
+	case Incr:
+		return s.incrBy(args, 1, "INCR")
+	case Decr:
+		return s.incrBy(args, -1, "DECR")
+	case Object:
+		return s.object(args)
+	case MGet:
+		return s.mGet(args)
+	case MSet:
+		return s.mSet(args)
+	case SetNX:
+		return s.setNX(args)
+	case GetSet:
+		return s.getSet(args)
+	case Rename:
+		return s.rename(args)
+	case RenameNX:
+		return s.renameNX(args)
+	case Copy:
+		return s.copyCmd(args)
+	case SetEx:
+		return s.setEx(args, time.Second, "SETEX")
+	case PSetEx:
+		return s.setEx(args, time.Millisecond, "PSETEX")
+	case Expire:
+		return s.expire(args)
+	case TTL:
+		return s.ttl(args)
+	case Persist:
+		return s.persist(args)
+	case SlowLog:
+		return s.slowLog(args)
+	case Type:
+		return s.keyType(args)
+	case Append:
+		return s.appendCmd(args)
+	case GetRange:
+		return s.getRange(args)
+	case SetRange:
+		return s.setRange(args)
+	case Echo:
+		return s.echo(args)
+	case Command:
+		return s.command(args)
+	case Config:
+		return s.configCmd(args)
+	case FlushDB:
+		return s.flush(args, "FLUSHDB")
+	case FlushAll:
+		return s.flush(args, "FLUSHALL")
+	case Save:
+		return s.save(args)
+	case DelPrefix:
+		return s.delPrefix(args)
+	case ReplicaOf:
+		return s.replicaOf(args, "REPLICAOF")
+	case SlaveOf:
+		return s.replicaOf(args, "SLAVEOF")
 	default:
-		fmt.Println("command handler not found: ", command)
-		return Value{typ: Error, str: "Err invalid command type"}
+		return unknownCommand(command, args)
+	}
+}
+
+// flush implements the redis FLUSHDB and FLUSHALL commands, which remove every key. the ASYNC and SYNC modes are
+// accepted, and both clear the database before replying
+func (s *Server) flush(args []Value, name string) Value {
+	if len(args) > 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for '" + name + "' command"}
+	}
+	if len(args) == 1 {
+		if mode := strings.ToUpper(args[0].bulkStr); mode != "ASYNC" && mode != "SYNC" {
+			return Value{typ: Error, str: "Err syntax error"}
+		}
+	}
+
+	if err := s.db.Clear(); err != nil {
+		return writeError(err)
+	}
+	return AckVal
+}
+
+// save implements the redis SAVE command by syncing the buffered writes of the database to disk, replying once
+// they are durable. it lets clients force durability when writes aren't synced as they are made. read-only
+// databases have nothing to sync
+func (s *Server) save(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'SAVE' command"}
+	}
+
+	if err := s.db.Sync(); err != nil && !errors.Is(err, beck.ErrDatabaseReadOnly) {
+		return Value{typ: Error, str: "Err " + err.Error()}
+	}
+	return AckVal
+}
+
+// delPrefix implements the DELPREFIX command, which removes every string key starting with the prefix and replies
+// with the number of keys removed. hash fields are stored under the hash key marker, so prefixes that could match
+// them, including the empty prefix, are rejected
+func (s *Server) delPrefix(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: Error, str: "Err wrong number of arguments for 'DELPREFIX' command"}
+	}
+	prefix := args[0].bulkStr
+	if strings.HasPrefix(hashKeyMarker, prefix) || strings.HasPrefix(prefix, hashKeyMarker) {
+		return Value{typ: Error, str: "Err prefix matches reserved hash keys"}
+	}
+
+	removed, err := s.db.DeletePrefix(prefix)
+	if err != nil {
+		return writeError(err)
+	}
+	return Value{typ: Integer, num: removed}
+}
+
+// unknownCommandPrefix starts the error reply to commands without a handler
+const unknownCommandPrefix = "Err unknown command"
+
+// unknownCommand builds the redis error reply to a command without a handler. like redis, each arg is cut to its
+// first 128 bytes
+func unknownCommand(command HandlerCommand, args []Value) Value {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s '%s', with args beginning with: ", unknownCommandPrefix, command)
+	for _, arg := range args {
+		fmt.Fprintf(&b, "'%.128s' ", arg.bulkStr)
+	}
+	return Value{typ: Error, str: b.String()}
+}
+
+// isUnknownCommand reports whether the reply rejects a command without a handler
+func isUnknownCommand(res Value) bool {
+	return res.typ == Error && strings.HasPrefix(res.str, unknownCommandPrefix)
+}
+
+// writeError converts an error from a mutating command into an error reply. writes against a read-only
+// database get the redis READONLY error so clients can special-case it
+func writeError(err error) Value {
+	if errors.Is(err, beck.ErrDatabaseReadOnly) {
+		return ErrReadOnly
+	}
+	return Value{typ: Error, str: "Err " + err.Error()}
+}
+
+// readError converts an error from reading a key into a reply. missing keys get a null bulk string while failures
+// such as corrupt records get an error reply, so they aren't mistaken for a missing key
+func readError(err error) Value {
+	if errors.Is(err, beck.ErrKeyNotFound) {
+		return NullVal
+	}
+	return Value{typ: Error, str: "Err " + err.Error()}
+}
+
+// hashKeyMarker starts every composite hash key so hash fields never collide with plain string keys. keys given to
+// commands can't start with it, so a string key can't forge a hash field
+const hashKeyMarker = "\x00h"
+
+// reservedKey returns the first key argument of a command that starts with the hash key marker. the key arguments
+// are found from the positions in the command table
+func reservedKey(command HandlerCommand, args []Value) (string, bool) {
+	info, ok := lookupCommand(string(command))
+	if !ok || info.firstKey == 0 {
+		return "", false
+	}
+
+	// positions count the command name, and a negative last position counts back from the last argument
+	last := info.lastKey
+	if last < 0 {
+		last += len(args) + 1
 	}
+	for pos := info.firstKey; pos <= last && pos <= len(args); pos += info.step {
+		if key := args[pos-1].bulkStr; strings.HasPrefix(key, hashKeyMarker) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// isHash reports whether key names a hash with at least one field. the probe is exact rather than heuristic: string
+// keys can't start with the hash key marker, and the hash name is length-prefixed so no other hash shares its
+// prefix. like redis, a hash without fields doesn't exist
+func (s *Server) isHash(key string) bool {
+	return len(s.db.ScanPrefix(getHashPrefix(key))) > 0
+}
+
+// nameLockStripes is the number of locks the names written by commands are spread over
+const nameLockStripes = 64
+
+// lockNames locks the stripes of the given names and returns the function unlocking them. commands that write a
+// string or a hash hold the lock while checking that the name isn't held by the other type, so a name never holds
+// both. stripes are locked in order so commands writing several names can't deadlock
+func (s *Server) lockNames(names ...string) (unlock func()) {
+	stripes := make([]int, 0, len(names))
+	for _, name := range names {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		stripes = append(stripes, int(h.Sum32()%nameLockStripes))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, stripe := range stripes {
+		s.nameLocks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			s.nameLocks[stripe].Unlock()
+		}
+	}
+}
+
+// hashName returns the name of the hash a composite hash key belongs to
+func hashName(key string) (string, bool) {
+	if !strings.HasPrefix(key, hashKeyMarker) || len(key) < len(hashKeyMarker)+4 {
+		return "", false
+	}
+	key = key[len(hashKeyMarker):]
+	n := binary.BigEndian.Uint32([]byte(key[:4]))
+	if uint64(len(key)-4) < uint64(n) {
+		return "", false
+	}
+	return key[4 : 4+n], true
+}
+
+// logicalKeys maps sorted keys to the keys clients see, replacing the fields of each hash with its name once. the
+// hash prefix is length-prefixed, so the fields of a hash are adjacent in sorted order
+func logicalKeys(keys []string) []string {
+	res := make([]string, 0, len(keys))
+	last, seen := "", false
+	for _, key := range keys {
+		name, ok := hashName(key)
+		if !ok {
+			res = append(res, key)
+			continue
+		}
+		if !seen || name != last {
+			res = append(res, name)
+		}
+		last, seen = name, true
+	}
+	return res
+}
+
+// getHashPrefix composes the prefix shared by all fields of a hash. the hash name is length-prefixed so any byte
+// sequence, including separators and null bytes, can be used in both the hash name and its fields:
+// | marker | hashLen (4-byte big-endian) | hash |
+func getHashPrefix(hashStr string) string {
+	buf := make([]byte, 0, len(hashKeyMarker)+4+len(hashStr))
+	buf = append(buf, hashKeyMarker...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(hashStr)))
+	buf = append(buf, hashStr...)
+	return string(buf)
 }
 
+// getHashKey composes the key under which a hash field is stored. the field follows the hash prefix as-is
 func getHashKey(hashStr, field string) string {
-	return fmt.Sprintf("%s:%s", hashStr, field)
+	return getHashPrefix(hashStr) + field
 }
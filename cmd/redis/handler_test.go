@@ -0,0 +1,779 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	beck "github.com/mrshabel/beckdb"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer opens a fresh database in a temporary directory and attaches it to a server
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	dataDir, err := os.MkdirTemp("", "beck_redis")
+	require.NoError(t, err)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, SyncOnWrite: true})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dataDir)
+	})
+	return NewServer(db, ServerConfig{})
+}
+
+// bulkArgs converts plain strings into resp bulk string arguments
+func bulkArgs(args ...string) []Value {
+	vals := make([]Value, len(args))
+	for idx, arg := range args {
+		vals[idx] = Value{typ: BulkString, bulkStr: arg}
+	}
+	return vals
+}
+
+// test that metadata commands are answered from the keydir without reading the value from disk. compressed values
+// are shorter on disk, so their length must also survive a merge and a reopen through the hint file
+func TestStrLenWithoutRead(t *testing.T) {
+	val := strings.Repeat("compressible", 100)
+	for _, compression := range []beck.Compression{beck.CompressionNone, beck.CompressionFlate} {
+		cfg := &beck.Config{DataDir: t.TempDir(), MaxFileSize: 1, Compression: compression}
+		db, err := beck.Open(cfg)
+		require.NoError(t, err)
+		srv := NewServer(db, ServerConfig{})
+		for _, key := range []string{"a", "b"} {
+			require.Equal(t, AckVal, srv.handleCommand(Set, bulkArgs(key, val)))
+			db.RotateActiveDatafile()
+		}
+		require.NoError(t, db.Compact())
+		require.NoError(t, db.Close())
+
+		db, err = beck.Open(cfg)
+		require.NoError(t, err)
+		srv = NewServer(db, ServerConfig{})
+		for _, key := range []string{"a", "b"} {
+			require.Equal(t, Value{typ: Integer, num: len(val)}, srv.handleCommand(StrLen, bulkArgs(key)))
+		}
+		require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(StrLen, bulkArgs("missing")))
+		require.Equal(t, Value{typ: Integer, num: len("a") + len(val)}, srv.handleCommand(Memory, bulkArgs("usage", "a")))
+		require.Zero(t, db.Metrics().BytesRead, compression)
+		require.NoError(t, db.Close())
+	}
+}
+
+// test that HSET stores every field pair and counts only newly created fields
+func TestHSetMultipleFields(t *testing.T) {
+	srv := newTestServer(t)
+
+	res := srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age", "20"))
+	require.Equal(t, Value{typ: Integer, num: 2}, res)
+
+	// one update and one new field
+	res = srv.handleCommand(HSet, bulkArgs("user1", "age", "21", "city", "accra"))
+	require.Equal(t, Value{typ: Integer, num: 1}, res)
+
+	res = srv.handleCommand(HGet, bulkArgs("user1", "age"))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "21"}, res)
+
+	// odd number of field value arguments
+	res = srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age"))
+	require.Equal(t, Error, res.typ)
+
+	// a repeated field is created once and keeps its last value
+	res = srv.handleCommand(HSet, bulkArgs("user2", "name", "a", "name", "b"))
+	require.Equal(t, Value{typ: Integer, num: 1}, res)
+	require.Equal(t, Value{typ: BulkString, bulkStr: "b"}, srv.handleCommand(HGet, bulkArgs("user2", "name")))
+
+	// no field is written if any of them is rejected
+	res = srv.handleCommand(HSet, bulkArgs("user1", "age", "22", strings.Repeat("f", srv.db.Config().MaxKeySize), "value"))
+	require.Equal(t, Error, res.typ)
+	require.Equal(t, Value{typ: BulkString, bulkStr: "21"}, srv.handleCommand(HGet, bulkArgs("user1", "age")))
+}
+
+// test that HGETALL returns every field of a hash and nothing for a missing hash
+func TestHGetAll(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age", "20"))
+	srv.handleCommand(HSet, bulkArgs("user2", "name", "other"))
+
+	res := srv.handleCommand(HGetAll, bulkArgs("user1"))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("age", "20", "name", "shabel")}, res)
+
+	res = srv.handleCommand(HGetAll, bulkArgs("missing"))
+	require.Equal(t, Value{typ: Map, array: []Value{}}, res)
+}
+
+// test that HDEL removes every given field and replies with the number of fields removed
+func TestHDel(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age", "20", "city", "accra"))
+
+	res := srv.handleCommand(HDel, bulkArgs("user1", "name", "missing", "age", "name"))
+	require.Equal(t, Value{typ: Integer, num: 2}, res)
+	require.Equal(t, Value{typ: Map, array: bulkArgs("city", "accra")}, srv.handleCommand(HGetAll, bulkArgs("user1")))
+
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(HDel, bulkArgs("user1", "name")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(HDel, bulkArgs("missing", "name")))
+	require.Equal(t, Error, srv.handleCommand(HDel, bulkArgs("user1")).typ)
+}
+
+// test that HLEN, HKEYS and HVALS only see the fields of the named hash
+func TestHLenKeysVals(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(HSet, bulkArgs("user", "name", "shabel", "age", "20"))
+	// keys that look like fields of the hash are not part of it
+	srv.handleCommand(Set, bulkArgs("user:city", "accra"))
+	srv.handleCommand(HSet, bulkArgs("user:x", "y", "z"))
+	srv.handleCommand(HSet, bulkArgs("use", "rname", "other"))
+
+	require.Equal(t, Value{typ: Integer, num: 2}, srv.handleCommand(HLen, bulkArgs("user")))
+	require.Equal(t, Value{typ: Array, array: bulkArgs("age", "name")}, srv.handleCommand(HKeys, bulkArgs("user")))
+	require.Equal(t, Value{typ: Array, array: bulkArgs("20", "shabel")}, srv.handleCommand(HVals, bulkArgs("user")))
+
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(HLen, bulkArgs("missing")))
+	require.Equal(t, Value{typ: Array, array: []Value{}}, srv.handleCommand(HKeys, bulkArgs("missing")))
+	require.Equal(t, Value{typ: Array, array: []Value{}}, srv.handleCommand(HVals, bulkArgs("missing")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(HLen, bulkArgs("user:city")))
+	require.Equal(t, Error, srv.handleCommand(HLen, bulkArgs("user", "name")).typ)
+}
+
+// test that plain keys can't start with the hash key marker and so can't forge or read hash fields
+func TestReservedHashKeys(t *testing.T) {
+	srv := newTestServer(t)
+	srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel"))
+	field := getHashKey("user1", "name")
+
+	for _, tt := range []struct {
+		command HandlerCommand
+		args    []string
+	}{
+		{command: Set, args: []string{field, "forged"}},
+		{command: Get, args: []string{field}},
+		{command: MSet, args: []string{"name", "mrshabel", field, "forged"}},
+		{command: MGet, args: []string{"name", field}},
+		{command: Del, args: []string{"name", field}},
+		{command: Append, args: []string{field, "forged"}},
+	} {
+		res := srv.handleCommand(tt.command, bulkArgs(tt.args...))
+		require.Equal(t, Error, res.typ, "command %s", tt.command)
+		require.Contains(t, res.str, "reserved hash key marker")
+	}
+
+	// values of mset aren't keys
+	require.Equal(t, AckVal, srv.handleCommand(MSet, bulkArgs("name", field)))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("name", "shabel")}, srv.handleCommand(HGetAll, bulkArgs("user1")))
+}
+
+// test that SAVE writes buffered writes to disk before replying, and is a no-op on a read-only database
+func TestSave(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, SyncInterval: time.Hour})
+	require.NoError(t, err)
+	srv := NewServer(db, ServerConfig{})
+
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	path := filepath.Join(dataDir, "1.data")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	require.Equal(t, AckVal, srv.handleCommand(Save, nil))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+	require.Equal(t, Error, srv.handleCommand(Save, bulkArgs("now")).typ)
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(&beck.Config{DataDir: dataDir, ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+	srv = NewServer(db, ServerConfig{})
+	require.Equal(t, AckVal, srv.handleCommand(Save, nil))
+}
+
+// test that RENAME replaces the destination while RENAMENX leaves it in place
+func TestRename(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(MSet, bulkArgs("a", "1", "b", "2"))
+	require.Equal(t, ErrNoSuchKey, srv.handleCommand(Rename, bulkArgs("missing", "c")))
+	require.Equal(t, ErrNoSuchKey, srv.handleCommand(RenameNX, bulkArgs("missing", "c")))
+
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(RenameNX, bulkArgs("a", "b")))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(RenameNX, bulkArgs("a", "c")))
+	require.Equal(t, AckVal, srv.handleCommand(Rename, bulkArgs("c", "b")))
+	require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("c")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "1"}, srv.handleCommand(Get, bulkArgs("b")))
+	require.Equal(t, Error, srv.handleCommand(Rename, bulkArgs("b")).typ)
+
+	// hashes can't be renamed, and are left in place
+	srv.handleCommand(HSet, bulkArgs("hash", "field", "value"))
+	require.Equal(t, ErrWrongType, srv.handleCommand(Rename, bulkArgs("hash", "c")))
+	require.Equal(t, ErrWrongType, srv.handleCommand(RenameNX, bulkArgs("hash", "c")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "value"}, srv.handleCommand(HGet, bulkArgs("hash", "field")))
+}
+
+// test that COPY only overwrites the destination with REPLACE
+func TestCopy(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(MSet, bulkArgs("a", "1", "b", "2"))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Copy, bulkArgs("missing", "c")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Copy, bulkArgs("a", "b")))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Copy, bulkArgs("a", "c")))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Copy, bulkArgs("a", "b", "replace")))
+	for _, key := range []string{"a", "b", "c"} {
+		require.Equal(t, Value{typ: BulkString, bulkStr: "1"}, srv.handleCommand(Get, bulkArgs(key)))
+	}
+
+	require.Equal(t, Error, srv.handleCommand(Copy, bulkArgs("a", "a")).typ)
+	require.Equal(t, Error, srv.handleCommand(Copy, bulkArgs("a", "b", "NOW")).typ)
+	require.Equal(t, Error, srv.handleCommand(Copy, bulkArgs("a")).typ)
+
+	// hashes can't be copied
+	srv.handleCommand(HSet, bulkArgs("hash", "field", "value"))
+	require.Equal(t, ErrWrongType, srv.handleCommand(Copy, bulkArgs("hash", "d")))
+	require.Equal(t, Value{typ: SimpleString, str: "none"}, srv.handleCommand(Type, bulkArgs("d")))
+}
+
+// test that GETRANGE and SETRANGE follow the redis offset semantics
+func TestRanges(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(Set, bulkArgs("key", "Hello World"))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "World"}, srv.handleCommand(GetRange, bulkArgs("key", "-5", "-1")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: ""}, srv.handleCommand(GetRange, bulkArgs("missing", "0", "-1")))
+	require.Equal(t, ErrNotInteger, srv.handleCommand(GetRange, bulkArgs("key", "a", "1")))
+
+	require.Equal(t, Value{typ: Integer, num: 11}, srv.handleCommand(SetRange, bulkArgs("key", "6", "Redis")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "Hello Redis"}, srv.handleCommand(Get, bulkArgs("key")))
+	require.Equal(t, Value{typ: Integer, num: 7}, srv.handleCommand(SetRange, bulkArgs("padded", "6", "!")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "\x00\x00\x00\x00\x00\x00!"}, srv.handleCommand(Get, bulkArgs("padded")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(SetRange, bulkArgs("missing", "6", "")))
+	require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("missing")))
+
+	require.Equal(t, Error, srv.handleCommand(SetRange, bulkArgs("key", "-1", "x")).typ)
+	require.Equal(t, ErrNotInteger, srv.handleCommand(SetRange, bulkArgs("key", "a", "x")))
+	require.Equal(t, Error, srv.handleCommand(SetRange, bulkArgs("key", "1")).typ)
+}
+
+// test that DELPREFIX removes the string keys under a prefix and refuses prefixes matching hash fields
+func TestDelPrefix(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(MSet, bulkArgs("tenant1:a", "1", "tenant1:b", "2", "tenant2:a", "3"))
+	srv.handleCommand(HSet, bulkArgs("tenant1:hash", "field", "value"))
+
+	require.Equal(t, Value{typ: Integer, num: 2}, srv.handleCommand(DelPrefix, bulkArgs("tenant1:")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(DelPrefix, bulkArgs("tenant1:")))
+	require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("tenant1:a")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "3"}, srv.handleCommand(Get, bulkArgs("tenant2:a")))
+
+	for _, prefix := range []string{"", "\x00", hashKeyMarker, getHashPrefix("tenant1:hash")} {
+		require.Equal(t, Error, srv.handleCommand(DelPrefix, bulkArgs(prefix)).typ, "prefix %q", prefix)
+	}
+	require.Equal(t, Value{typ: BulkString, bulkStr: "value"}, srv.handleCommand(HGet, bulkArgs("tenant1:hash", "field")))
+	require.Equal(t, Error, srv.handleCommand(DelPrefix, nil).typ)
+}
+
+// test that a name holds either a string or a hash, and writers of the other type get WRONGTYPE
+func TestWriteWrongType(t *testing.T) {
+	srv := newTestServer(t)
+
+	require.Equal(t, AckVal, srv.handleCommand(Set, bulkArgs("str", "1")))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(HSet, bulkArgs("hash", "field", "value")))
+
+	require.Equal(t, ErrWrongType, srv.handleCommand(HSet, bulkArgs("str", "field", "value")))
+	for _, cmd := range []struct {
+		command HandlerCommand
+		args    []Value
+	}{
+		{Set, bulkArgs("hash", "value")},
+		{SetNX, bulkArgs("hash", "value")},
+		{GetSet, bulkArgs("hash", "value")},
+		{MSet, bulkArgs("str", "2", "hash", "value")},
+		{SetEx, bulkArgs("hash", "10", "value")},
+		{PSetEx, bulkArgs("hash", "10", "value")},
+		{Incr, bulkArgs("hash")},
+		{Decr, bulkArgs("hash")},
+		{Append, bulkArgs("hash", "value")},
+		{SetRange, bulkArgs("hash", "0", "value")},
+		{Rename, bulkArgs("str", "hash")},
+		{Copy, bulkArgs("str", "hash", "REPLACE")},
+	} {
+		require.Equal(t, ErrWrongType, srv.handleCommand(cmd.command, cmd.args), cmd.command)
+	}
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(RenameNX, bulkArgs("str", "hash")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Copy, bulkArgs("str", "hash")))
+
+	// nothing was written under the other type
+	require.Equal(t, Value{typ: BulkString, bulkStr: "1"}, srv.handleCommand(Get, bulkArgs("str")))
+	require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("hash")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(HLen, bulkArgs("str")))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(HLen, bulkArgs("hash")))
+}
+
+// test that KEYS replies with each hash name once instead of the composite keys of its fields
+func TestKeys(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(Set, bulkArgs("user:1", "value"))
+	srv.handleCommand(HSet, bulkArgs("user:2", "name", "alice", "age", "30"))
+	srv.handleCommand(HSet, bulkArgs("user", "name", "bob"))
+	srv.handleCommand(HSet, bulkArgs("session", "id", "1"))
+
+	require.Equal(t, Value{typ: Array, array: bulkArgs("session", "user", "user:1", "user:2")}, srv.handleCommand(Keys, bulkArgs("*")))
+	require.Equal(t, Value{typ: Array, array: bulkArgs("user:1", "user:2")}, srv.handleCommand(Keys, bulkArgs("user:*")))
+}
+
+// test that DBSIZE counts each hash once regardless of its number of fields
+func TestDBSize(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(Set, bulkArgs("key", "value"))
+	srv.handleCommand(HSet, bulkArgs("user", "name", "alice", "age", "30"))
+	srv.handleCommand(HSet, bulkArgs("session", "id", "1"))
+	require.Equal(t, Value{typ: Integer, num: 3}, srv.handleCommand(DBSize, nil))
+
+	srv.handleCommand(HDel, bulkArgs("session", "id"))
+	require.Equal(t, Value{typ: Integer, num: 2}, srv.handleCommand(DBSize, nil))
+}
+
+// test that SCAN pages through every key exactly once and ends with a zero cursor
+func TestScan(t *testing.T) {
+	srv := newTestServer(t)
+
+	for idx := range 25 {
+		srv.handleCommand(Set, bulkArgs(fmt.Sprintf("key%d", idx), "value"))
+	}
+
+	seen := map[string]int{}
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 10, "scan did not terminate")
+
+		res := srv.handleCommand(Scan, bulkArgs(cursor, "COUNT", "10"))
+		require.Equal(t, Array, res.typ)
+		require.Len(t, res.array, 2)
+		for _, key := range res.array[1].array {
+			seen[key.bulkStr]++
+		}
+
+		cursor = res.array[0].bulkStr
+		if cursor == "0" {
+			break
+		}
+	}
+
+	require.Len(t, seen, 25)
+	for _, count := range seen {
+		require.Equal(t, 1, count)
+	}
+
+	// match filters the returned keys
+	res := srv.handleCommand(Scan, bulkArgs("0", "MATCH", "key1*", "COUNT", "100"))
+	require.Equal(t, "0", res.array[0].bulkStr)
+	require.Len(t, res.array[1].array, 11)
+}
+
+// test that SCAN replies with each hash name once per pass, even when its fields span pages
+func TestScanHashes(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(Set, bulkArgs("key", "value"))
+	for _, hash := range []string{"a", "b", "hash"} {
+		for idx := range 7 {
+			srv.handleCommand(HSet, bulkArgs(hash, fmt.Sprintf("field%d", idx), "value"))
+		}
+	}
+
+	for _, count := range []string{"1", "3", "5", "100"} {
+		var seen []string
+		cursor := "0"
+		for {
+			res := srv.handleCommand(Scan, bulkArgs(cursor, "COUNT", count))
+			for _, key := range res.array[1].array {
+				seen = append(seen, key.bulkStr)
+			}
+			if cursor = res.array[0].bulkStr; cursor == "0" {
+				break
+			}
+		}
+		require.ElementsMatch(t, []string{"a", "b", "hash", "key"}, seen, count)
+	}
+
+	res := srv.handleCommand(Scan, bulkArgs("0", "MATCH", "h*", "COUNT", "100"))
+	require.Equal(t, bulkArgs("hash"), res.array[1].array)
+}
+
+// test that HMGET returns values for present fields and nulls for absent ones in request order
+func TestHMGet(t *testing.T) {
+	srv := newTestServer(t)
+
+	res := srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age", "20"))
+	require.Equal(t, Value{typ: Integer, num: 2}, res)
+
+	res = srv.handleCommand(HMGet, bulkArgs("user1", "age", "missing", "name"))
+	require.Equal(t, Value{typ: Array, array: []Value{
+		{typ: BulkString, bulkStr: "20"},
+		NullVal,
+		{typ: BulkString, bulkStr: "shabel"},
+	}}, res)
+
+	res = srv.handleCommand(HMGet, bulkArgs("missing", "name"))
+	require.Equal(t, Value{typ: Array, array: []Value{NullVal}}, res)
+}
+
+// test that GET and MGET reply with an error rather than a null for a corrupt value
+func TestGetCorruptValue(t *testing.T) {
+	srv := newTestServer(t)
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("missing")))
+
+	// flip the last byte of the value on disk
+	paths, err := filepath.Glob(filepath.Join(srv.db.Config().DataDir, "*.data"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(paths[0], data, 0644))
+
+	res := srv.handleCommand(Get, bulkArgs("name"))
+	require.Equal(t, Error, res.typ)
+	require.Contains(t, res.str, beck.ErrInvalidChecksum.Error())
+
+	res = srv.handleCommand(MGet, bulkArgs("missing", "name"))
+	require.Equal(t, Error, res.typ)
+	require.Equal(t, Value{typ: Array, array: []Value{NullVal}}, srv.handleCommand(MGet, bulkArgs("missing")))
+}
+
+// test that INCR and DECR treat missing keys as zero and reject non-integer values
+func TestIncrDecr(t *testing.T) {
+	srv := newTestServer(t)
+
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Incr, bulkArgs("counter")))
+	require.Equal(t, Value{typ: Integer, num: 2}, srv.handleCommand(Incr, bulkArgs("counter")))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Decr, bulkArgs("counter")))
+	require.Equal(t, Value{typ: Integer, num: -1}, srv.handleCommand(Decr, bulkArgs("other")))
+
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	require.Equal(t, ErrNotInteger, srv.handleCommand(Incr, bulkArgs("name")))
+}
+
+// test that OBJECT REFCOUNT reports a single reference for existing keys
+func TestObjectRefCount(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Object, bulkArgs("REFCOUNT", "name")))
+	require.Equal(t, NullVal, srv.handleCommand(Object, bulkArgs("REFCOUNT", "missing")))
+
+	res := srv.handleCommand(Object, bulkArgs("HELP"))
+	require.Equal(t, Array, res.typ)
+	require.NotEmpty(t, res.array)
+}
+
+// test that writes against a read-only database get the READONLY error reply
+func TestReadOnlyWrites(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_redis_ro")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, SyncOnWrite: true})
+	require.NoError(t, err)
+	require.NoError(t, db.Put("name", []byte("mrshabel")))
+	require.NoError(t, db.Put(getHashKey("user1", "name"), []byte("shabel")))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(&beck.Config{DataDir: dataDir, ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+	srv := NewServer(db, ServerConfig{})
+
+	for _, tt := range []struct {
+		command HandlerCommand
+		args    []string
+	}{
+		{command: Set, args: []string{"name", "other"}},
+		{command: SetNX, args: []string{"new", "value"}},
+		{command: MSet, args: []string{"name", "other"}},
+		{command: Del, args: []string{"name"}},
+		{command: Incr, args: []string{"counter"}},
+		{command: HSet, args: []string{"user1", "name", "shabel"}},
+		{command: HDel, args: []string{"user1", "name"}},
+		{command: FlushDB},
+	} {
+		require.Equal(t, ErrReadOnly, srv.handleCommand(tt.command, bulkArgs(tt.args...)), "command %s", tt.command)
+	}
+
+	// reads are still served
+	require.Equal(t, Value{typ: BulkString, bulkStr: "mrshabel"}, srv.handleCommand(Get, bulkArgs("name")))
+
+}
+
+// test that SETEX and PSETEX keys expire and non-positive ttls are rejected
+func TestSetEx(t *testing.T) {
+	srv := newTestServer(t)
+
+	require.Equal(t, AckVal, srv.handleCommand(SetEx, bulkArgs("long", "100", "value")))
+	require.Equal(t, AckVal, srv.handleCommand(PSetEx, bulkArgs("short", "50", "value")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "value"}, srv.handleCommand(Get, bulkArgs("short")))
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("short")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "value"}, srv.handleCommand(Get, bulkArgs("long")))
+
+	require.Equal(t, Error, srv.handleCommand(SetEx, bulkArgs("key", "0", "value")).typ)
+	require.Equal(t, Error, srv.handleCommand(PSetEx, bulkArgs("key", "abc", "value")).typ)
+	require.Equal(t, Value{typ: Error, str: "Err invalid expire time in 'setex' command"}, srv.handleCommand(SetEx, bulkArgs("key", "9223372036854775807", "value")))
+	require.Equal(t, Value{typ: Error, str: "Err invalid expire time in 'psetex' command"}, srv.handleCommand(PSetEx, bulkArgs("key", "9223372036854775807", "value")))
+}
+
+// test that EXPIRE, TTL and PERSIST manage the expiry of existing keys only
+func TestExpireTTLPersist(t *testing.T) {
+	srv := newTestServer(t)
+
+	require.Equal(t, Value{typ: Integer, num: -2}, srv.handleCommand(TTL, bulkArgs("name")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Expire, bulkArgs("name", "100")))
+
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	require.Equal(t, Value{typ: Integer, num: -1}, srv.handleCommand(TTL, bulkArgs("name")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Persist, bulkArgs("name")))
+
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Expire, bulkArgs("name", "100")))
+	require.Equal(t, Value{typ: Integer, num: 100}, srv.handleCommand(TTL, bulkArgs("name")))
+
+	require.Equal(t, Value{typ: Integer, num: 1}, srv.handleCommand(Persist, bulkArgs("name")))
+	require.Equal(t, Value{typ: Integer, num: -1}, srv.handleCommand(TTL, bulkArgs("name")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "mrshabel"}, srv.handleCommand(Get, bulkArgs("name")))
+
+	// expire times overflowing a duration are rejected rather than wrapping around
+	invalid := Value{typ: Error, str: "Err invalid expire time in 'expire' command"}
+	require.Equal(t, invalid, srv.handleCommand(Expire, bulkArgs("name", "9223372036854775807")))
+	require.Equal(t, invalid, srv.handleCommand(Expire, bulkArgs("name", "-9223372036854775808")))
+	require.Equal(t, Value{typ: Integer, num: -1}, srv.handleCommand(TTL, bulkArgs("name")))
+
+	// hashes never expire
+	srv.handleCommand(HSet, bulkArgs("hash", "field", "value"))
+	require.Equal(t, ErrWrongType, srv.handleCommand(Expire, bulkArgs("hash", "100")))
+	require.Equal(t, Value{typ: Integer, num: -1}, srv.handleCommand(TTL, bulkArgs("hash")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Persist, bulkArgs("hash")))
+}
+
+// test that SLOWLOG reports the slow operations recorded by the database
+func TestSlowLog(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_redis_slowlog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	// every operation is slower than a nanosecond
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, SlowOpThreshold: time.Nanosecond})
+	require.NoError(t, err)
+	defer db.Close()
+	srv := NewServer(db, ServerConfig{})
+
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	srv.handleCommand(Get, bulkArgs("name"))
+	require.Equal(t, Value{typ: Integer, num: 2}, srv.handleCommand(SlowLog, bulkArgs("LEN")))
+
+	res := srv.handleCommand(SlowLog, bulkArgs("GET", "1"))
+	require.Len(t, res.array, 1)
+	require.Equal(t, Value{typ: Array, array: bulkArgs("get", "name")}, res.array[0].array[3])
+
+	require.Equal(t, AckVal, srv.handleCommand(SlowLog, bulkArgs("RESET")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(SlowLog, bulkArgs("LEN")))
+}
+
+// test that DEL removes strings and whole hashes and replies with the number of keys removed
+func TestDel(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(MSet, bulkArgs("a", "1", "b", "2"))
+	srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age", "20"))
+
+	require.Equal(t, Value{typ: Integer, num: 3}, srv.handleCommand(Del, bulkArgs("a", "a", "user1", "missing", "b")))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(DBSize, nil))
+	require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(Del, bulkArgs("a")))
+}
+
+// test that DEL WITHTYPES counts the removed strings and hash fields separately
+func TestDelWithTypes(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(MSet, bulkArgs("a", "1", "b", "2"))
+	srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel", "age", "20"))
+	srv.handleCommand(HSet, bulkArgs("user2", "name", "beck"))
+	srv.handleCommand(Set, bulkArgs("kept", "value"))
+
+	want := Value{typ: Array, array: []Value{
+		{typ: BulkString, bulkStr: "string"},
+		{typ: Integer, num: 2},
+		{typ: BulkString, bulkStr: "hash"},
+		{typ: Integer, num: 3},
+	}}
+	require.Equal(t, want, srv.handleCommand(Del, bulkArgs("a", "user1", "b", "user2", "missing", "withtypes")))
+	require.Equal(t, []string{"kept"}, srv.db.ListKeys())
+}
+
+// test that TYPE tells strings, hashes and missing keys apart
+func TestType(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.handleCommand(Set, bulkArgs("name", "mrshabel"))
+	srv.handleCommand(HSet, bulkArgs("user1", "name", "shabel"))
+
+	require.Equal(t, Value{typ: SimpleString, str: "string"}, srv.handleCommand(Type, bulkArgs("name")))
+	require.Equal(t, Value{typ: SimpleString, str: "hash"}, srv.handleCommand(Type, bulkArgs("user1")))
+	require.Equal(t, Value{typ: SimpleString, str: "none"}, srv.handleCommand(Type, bulkArgs("missing")))
+	// names sharing a prefix with a hash, or with the composite key of one of its fields, aren't hashes
+	require.Equal(t, Value{typ: SimpleString, str: "none"}, srv.handleCommand(Type, bulkArgs("user")))
+	require.Equal(t, Value{typ: SimpleString, str: "none"}, srv.handleCommand(Type, bulkArgs("user1name")))
+
+	// a hash stops existing once its last field is removed
+	srv.handleCommand(HDel, bulkArgs("user1", "name"))
+	require.Equal(t, Value{typ: SimpleString, str: "none"}, srv.handleCommand(Type, bulkArgs("user1")))
+}
+
+// test that APPEND replies with the length of the value after the append
+func TestAppend(t *testing.T) {
+	srv := newTestServer(t)
+
+	require.Equal(t, Value{typ: Integer, num: 5}, srv.handleCommand(Append, bulkArgs("greeting", "hello")))
+	require.Equal(t, Value{typ: Integer, num: 11}, srv.handleCommand(Append, bulkArgs("greeting", " world")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "hello world"}, srv.handleCommand(Get, bulkArgs("greeting")))
+}
+
+// test that hash names and fields containing separators and null bytes never collide
+func TestHashBinaryKeys(t *testing.T) {
+	srv := newTestServer(t)
+
+	// with a separator scheme both would be stored under "a:b:c"
+	srv.handleCommand(HSet, bulkArgs("a:b", "c", "first"))
+	srv.handleCommand(HSet, bulkArgs("a", "b:c", "second"))
+	srv.handleCommand(HSet, bulkArgs("nul\x00hash", "nul\x00field", "third"))
+	srv.handleCommand(Set, bulkArgs("a:b:c", "plain"))
+
+	require.Equal(t, Value{typ: BulkString, bulkStr: "first"}, srv.handleCommand(HGet, bulkArgs("a:b", "c")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "second"}, srv.handleCommand(HGet, bulkArgs("a", "b:c")))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "plain"}, srv.handleCommand(Get, bulkArgs("a:b:c")))
+
+	require.Equal(t, Value{typ: Map, array: bulkArgs("b:c", "second")}, srv.handleCommand(HGetAll, bulkArgs("a")))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("c", "first")}, srv.handleCommand(HGetAll, bulkArgs("a:b")))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("nul\x00field", "third")}, srv.handleCommand(HGetAll, bulkArgs("nul\x00hash")))
+}
+
+// test that PING replies with PONG or echoes its message
+func TestPing(t *testing.T) {
+	srv := newTestServer(t)
+
+	require.Equal(t, Value{typ: SimpleString, str: "PONG"}, srv.handleCommand(Ping, nil))
+	require.Equal(t, Value{typ: BulkString, bulkStr: "hello"}, srv.handleCommand(Ping, bulkArgs("hello")))
+}
+
+// test that ECHO replies with the exact message
+func TestEcho(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, msg := range []string{"hello", "", "bin\x00ary\r\n\xff"} {
+		require.Equal(t, Value{typ: BulkString, bulkStr: msg}, srv.handleCommand(Echo, bulkArgs(msg)))
+	}
+	require.Equal(t, Error, srv.handleCommand(Echo, nil).typ)
+}
+
+// test that REPLICAOF NO ONE is accepted and configuring a primary to replicate from is rejected
+func TestReplicaOf(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, command := range []HandlerCommand{ReplicaOf, SlaveOf} {
+		require.Equal(t, AckVal, srv.handleCommand(command, bulkArgs("NO", "ONE")))
+		require.Equal(t, AckVal, srv.handleCommand(command, bulkArgs("no", "one")))
+		require.Equal(t, Error, srv.handleCommand(command, bulkArgs("127.0.0.1", "6379")).typ)
+		require.Equal(t, Error, srv.handleCommand(command, bulkArgs("NO")).typ)
+	}
+}
+
+// test that COMMAND describes every handled command, which clients rely on when connecting
+func TestCommand(t *testing.T) {
+	srv := newTestServer(t)
+
+	res := srv.handleCommand(Command, nil)
+	require.Len(t, res.array, len(commandTable))
+	require.Equal(t, Value{typ: Integer, num: len(commandTable)}, srv.handleCommand(Command, bulkArgs("COUNT")))
+
+	// every described command has a handler. HELLO, AUTH and the transaction commands are handled per connection
+	for _, info := range commandTable {
+		if slices.Contains([]HandlerCommand{Hello, Auth, Multi, Exec, Discard, Watch, Unwatch}, info.name) {
+			continue
+		}
+		require.False(t, isUnknownCommand(srv.handleCommand(info.name, nil)), info.name)
+	}
+
+	res = srv.handleCommand(Command, bulkArgs("INFO", "get", "missing"))
+	require.Len(t, res.array, 2)
+	require.Equal(t, Value{typ: BulkString, bulkStr: "get"}, res.array[0].array[0])
+	require.Equal(t, Value{typ: Integer, num: 2}, res.array[0].array[1])
+	require.Equal(t, NullVal, res.array[1])
+
+	res = srv.handleCommand(Command, bulkArgs("DOCS", "set"))
+	require.Equal(t, Value{typ: Map, array: []Value{{typ: BulkString, bulkStr: "set"}, {typ: Map, array: []Value{}}}}, res)
+	require.Equal(t, Error, srv.handleCommand(Command, bulkArgs("bogus")).typ)
+}
+
+// test that CONFIG GET reads settings by glob pattern and CONFIG SET only changes the mutable ones
+func TestConfig(t *testing.T) {
+	srv := newTestServer(t)
+
+	res := srv.handleCommand(Config, bulkArgs("GET", "maxfilesize"))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("maxfilesize", "67108864")}, res)
+	res = srv.handleCommand(Config, bulkArgs("GET", "sync*"))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("syncwrite", "yes", "syncinterval", "1000")}, res)
+	res = srv.handleCommand(Config, bulkArgs("GET", "maxmemory"))
+	require.Equal(t, Value{typ: Map, array: []Value{}}, res)
+
+	res = srv.handleCommand(Config, bulkArgs("SET", "syncinterval", "250", "SlowOpThreshold", "5"))
+	require.Equal(t, AckVal, res)
+	res = srv.handleCommand(Config, bulkArgs("GET", "syncinterval", "slowopthreshold"))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("syncinterval", "250", "slowopthreshold", "5")}, res)
+
+	for _, args := range [][]string{
+		{"SET", "maxmemory", "1"},
+		{"SET", "maxfilesize", "1"},
+		{"SET", "syncinterval", "soon"},
+		{"SET", "syncinterval", "-1"},
+		{"SET", "syncinterval"},
+		{"GET"},
+		{"REWRITE"},
+	} {
+		require.Equal(t, Error, srv.handleCommand(Config, bulkArgs(args...)).typ, args)
+	}
+	res = srv.handleCommand(Config, bulkArgs("GET", "syncinterval"))
+	require.Equal(t, Value{typ: Map, array: bulkArgs("syncinterval", "250")}, res)
+}
+
+// test that FLUSHDB and FLUSHALL remove every key, including hash fields
+func TestFlush(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, command := range []HandlerCommand{FlushDB, FlushAll} {
+		srv.handleCommand(Set, bulkArgs("name", "shabel"))
+		srv.handleCommand(HSet, bulkArgs("user", "name", "shabel"))
+
+		require.Equal(t, AckVal, srv.handleCommand(command, nil))
+		require.Equal(t, Value{typ: Integer, num: 0}, srv.handleCommand(DBSize, nil))
+		require.Equal(t, NullVal, srv.handleCommand(Get, bulkArgs("name")))
+	}
+
+	require.Equal(t, AckVal, srv.handleCommand(FlushDB, bulkArgs("async")))
+	require.Equal(t, Error, srv.handleCommand(FlushDB, bulkArgs("later")).typ)
+}
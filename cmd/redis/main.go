@@ -2,22 +2,90 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	beck "github.com/mrshabel/beckdb"
 )
 
+// ServerConfig holds the tunables of the server
+type ServerConfig struct {
+	// disable nagle's algorithm on client connections
+	TCPNoDelay bool
+	// keepalive period for client connections. keepalive is disabled when zero
+	TCPKeepAlive time.Duration
+	// close the connection of clients sending unknown commands rather than only replying with an error
+	StrictCommands bool
+	// close client connections that send no command for this long. idle connections are kept when zero
+	IdleTimeout time.Duration
+	// connections accepted beyond this many open ones are rejected. connections are unlimited when zero
+	MaxConns int
+	// how long shutdown waits for in-flight commands before closing the connections running them
+	ShutdownTimeout time.Duration
+	// password clients authenticate with before running commands. clients need no authentication when empty
+	RequirePass string
+}
+
 type Server struct {
-	db *beck.BeckDB
-	ln net.Listener
+	db        *beck.BeckDB
+	listeners []net.Listener
+	cfg       ServerConfig
+
+	// registry of connected clients keyed by their remote address
+	clients map[string]*client
+	// client ids are never reused for the lifetime of the server
+	lastClientID int64
+	mu           sync.Mutex
+	// number of connections being served, counted as soon as they are accepted
+	conns atomic.Int64
+	// connections being served, so shutdown can wait for them to close
+	handlers sync.WaitGroup
+	// set once shutdown begins. connections are closed after their in-flight command instead of reading another
+	draining atomic.Bool
+	// listeners being served, so shutdown can wait for them to stop accepting connections
+	serving sync.WaitGroup
+	// commands hold a read lock while they run, so EXEC can run a transaction without interleaving commands
+	txMu sync.RWMutex
+	// writers hold the stripes of the names they write, see lockNames
+	nameLocks [nameLockStripes]sync.Mutex
+}
+
+// client holds the metadata of a single client connection
+type client struct {
+	id        int64
+	conn      net.Conn
+	createdAt time.Time
+	// unix nano timestamp of the last command received
+	lastActive atomic.Int64
+	// protocol version negotiated with HELLO. it's only used by the goroutine serving the connection
+	proto int
+	// address the client is registered by
+	addr string
+	// queued commands and watched keys of the client
+	tx transaction
+	// whether the client sent the password of the server
+	authenticated bool
+}
+
+func NewServer(db *beck.BeckDB, cfg ServerConfig) *Server {
+	return &Server{
+		db:      db,
+		cfg:     cfg,
+		clients: make(map[string]*client),
+	}
 }
 
 func main() {
@@ -26,6 +94,20 @@ func main() {
 	syncOnWrite := flag.Bool("sync", false, "Persist each write to disk immediately?")
 	readOnly := flag.Bool("read-only", false, "Run db in read-only mode?")
 	address := flag.String("addr", "127.0.0.1:6379", "Server address")
+	tcpNoDelay := flag.Bool("tcp-nodelay", true, "Disable Nagle's algorithm on client connections?")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 300*time.Second, "TCP keepalive period for client connections. 0 disables keepalive")
+	slowLogThreshold := flag.Duration("slowlog-threshold", 0, "Log operations slower than this duration. 0 disables the slow log")
+	expirySweepInterval := flag.Duration("expiry-sweep-interval", 100*time.Millisecond, "Delete a sample of the expired keys this often. 0 disables the sweep")
+	strictCommands := flag.Bool("strict-commands", false, "Close the connection of clients sending unknown commands?")
+	maxConns := flag.Int("max-conns", 10000, "Reject client connections beyond this many open ones. 0 allows unlimited connections")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Wait this long for in-flight commands to finish on shutdown")
+	requirePass := flag.String("requirepass", "", "Password clients must authenticate with using AUTH. Clients need no authentication when empty")
+	unixSocket := flag.String("unixsocket", "", "Path of a unix socket to serve clients on along with the tcp address")
+	tlsCert := flag.String("tls-cert", "", "Certificate file to serve clients over TLS with. Requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file of the TLS certificate. Requires -tls-cert")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Lowest level of the logged events: debug, info, warn or error")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close client connections idle for this long. 0 keeps idle connections")
 
 	flag.Parse()
 	if *dataDir == "" {
@@ -33,29 +115,91 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Println("-tls-cert and -tls-key must be provided together")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// the server and the database log through the same leveled logger
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
 
 	// setup db
-	srv := &Server{}
-	db, err := beck.Open(&beck.Config{DataDir: *dataDir, SyncOnWrite: *syncOnWrite, ReadOnly: *readOnly})
+	db, err := beck.Open(&beck.Config{DataDir: *dataDir, SyncOnWrite: *syncOnWrite, ReadOnly: *readOnly, SlowOpThreshold: *slowLogThreshold, ExpirySweepInterval: *expirySweepInterval, Logger: logger})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
-	srv.db = db
-
-	// start server and handle connections
-	go shutdown(srv)
+	srv := NewServer(db, ServerConfig{TCPNoDelay: *tcpNoDelay, TCPKeepAlive: *tcpKeepAlive, StrictCommands: *strictCommands, IdleTimeout: *idleTimeout, MaxConns: *maxConns, ShutdownTimeout: *shutdownTimeout, RequirePass: *requirePass})
 
-	ln, err := net.Listen("tcp", *address)
+	// start server and handle connections until shutdown
+	ln, err := listen(*address, *tlsCert, *tlsKey)
 	if err != nil {
+		db.Close()
 		log.Fatal(err)
 	}
-	srv.ln = ln
 	log.Printf("server started successfully on %s\n", *address)
+	go srv.serve(ln)
+	if *unixSocket != "" {
+		unixLn, err := listenUnix(*unixSocket)
+		if err != nil {
+			srv.drain(0)
+			db.Close()
+			log.Fatal(err)
+		}
+		log.Printf("server started successfully on unix socket %s\n", *unixSocket)
+		go srv.serve(unixLn)
+	}
+	shutdown(srv)
+}
+
+// listen creates the listener of the server. clients are served over TLS when a certificate and key are given, and
+// over plain TCP otherwise
+func listen(address, certFile, keyFile string) (net.Listener, error) {
+	if certFile == "" && keyFile == "" {
+		return net.Listen("tcp", address)
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls certificate and key must be provided together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	return tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+}
+
+// listenUnix creates a listener on a unix socket, which removes the socket file once it's closed. a socket file left
+// behind by a server that didn't shut down cleanly is removed first, but other files are never replaced
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("unix socket path %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale unix socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// serve accepts client connections on the listener until it is closed. a server may serve several listeners
+func (srv *Server) serve(ln net.Listener) {
+	// listeners are only added before shutdown begins, so shutdown waits for every listener it closes
+	srv.mu.Lock()
+	if srv.draining.Load() {
+		srv.mu.Unlock()
+		ln.Close()
+		return
+	}
+	srv.listeners = append(srv.listeners, ln)
+	srv.serving.Add(1)
+	srv.mu.Unlock()
+	defer srv.serving.Done()
 
-	// accept client connections
 	for {
-		conn, err := srv.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				log.Println("server stopped accepting connections")
@@ -65,44 +209,163 @@ func main() {
 			continue
 		}
 
-		go handleConn(conn, srv)
+		// the count is taken before the connection is served, so a flood of connections can't overshoot the limit
+		if n := srv.conns.Add(1); srv.cfg.MaxConns > 0 && n > int64(srv.cfg.MaxConns) {
+			srv.conns.Add(-1)
+			go rejectConn(conn)
+			continue
+		}
+
+		if err := srv.configureConn(conn); err != nil {
+			log.Println("failed to configure client connection: ", err)
+		}
+		srv.handlers.Add(1)
+		go func() {
+			defer srv.handlers.Done()
+			defer srv.conns.Add(-1)
+			handleConn(conn, srv)
+		}()
+	}
+}
+
+// rejectConn replies to a connection over the connection limit with the redis error and closes it
+func rejectConn(conn net.Conn) {
+	defer conn.Close()
+
+	log.Printf("rejected connection from client %s: max number of clients reached\n", connAddr(conn))
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	res := Value{typ: Error, str: "Err max number of clients reached"}
+	conn.Write(res.Marshal())
+}
+
+// configureConn applies the tcp options of the server to an accepted connection
+func (srv *Server) configureConn(conn net.Conn) error {
+	// tls connections are configured through the tcp connection they wrap
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(srv.cfg.TCPNoDelay); err != nil {
+		return err
+	}
+	if srv.cfg.TCPKeepAlive <= 0 {
+		return tcpConn.SetKeepAlive(false)
 	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(srv.cfg.TCPKeepAlive)
 }
 
 func handleConn(conn net.Conn, srv *Server) {
-	log.Printf("connection received from client %s\n", conn.RemoteAddr().String())
+	c := srv.registerClient(conn)
+	log.Printf("connection received from client %s\n", c.addr)
 	defer func() {
-		log.Printf("connection closed from client %s\n", conn.RemoteAddr().String())
+		log.Printf("connection closed from client %s\n", c.addr)
+		srv.unregisterClient(c)
 		conn.Close()
 	}()
 
-	// read connection data with the resp parser
+	// read connection data with the resp parser. replies are buffered while pipelined commands are already
+	// read, and flushed together once the client waits for them
+	resp := NewResp(conn)
 	for {
-		resp := NewResp(conn)
+		// the deadline is moved on before each command, so only clients idle past the timeout are disconnected
+		var deadline time.Time
+		if srv.cfg.IdleTimeout > 0 {
+			deadline = time.Now().Add(srv.cfg.IdleTimeout)
+		}
+		conn.SetReadDeadline(deadline)
+		// a draining server closes connections between commands. it interrupts the reads of connections only after
+		// it's marked draining, so the deadline set above can't hold a connection open through the shutdown
+		if srv.draining.Load() {
+			resp.Flush()
+			return
+		}
+
 		data, err := resp.Read()
 		if err != nil {
-			fmt.Println("Error reading request: ", err)
+			// like redis, malformed requests are answered before the connection is closed
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				resp.WriteError(protoErr.Error())
+			}
+			resp.Flush()
+			if srv.draining.Load() {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("closing idle connection from client %s\n", c.addr)
+				return
+			}
+			log.Printf("error reading request from client %s: %v\n", c.addr, err)
 			return
 		}
 
-		// input data should be an array for all commands implemented
-		if data.typ != Array {
-			resp.WriteError("ERR invalid request payload. expected array")
-			continue
+		res := srv.handleRequest(c, data)
+		resp.SetProtocol(c.proto)
+		resp.Write(res)
+
+		// strict servers drop clients sending unknown commands so client bugs surface early
+		if srv.cfg.StrictCommands && isUnknownCommand(res) {
+			resp.Flush()
+			return
 		}
-		if len(data.array) == 0 {
-			resp.WriteError("Err invalid request payload. expected non-empty array")
-			continue
+		if resp.Buffered() == 0 {
+			if err := resp.Flush(); err != nil {
+				log.Printf("error writing reply to client %s: %v\n", c.addr, err)
+				return
+			}
 		}
+	}
+}
+
+// handleRequest runs the command of a request received from the client and returns its reply
+func (srv *Server) handleRequest(c *client, data *Value) Value {
+	// input data should be an array for all commands implemented
+	if data.typ != Array {
+		return Value{typ: Error, str: "Err invalid request payload. expected array"}
+	}
+	if len(data.array) == 0 {
+		return Value{typ: Error, str: "Err invalid request payload. expected non-empty array"}
+	}
 
-		// extract command and args. command is the first entry of the array
-		command := strings.ToUpper(data.array[0].bulkStr)
-		args := data.array[1:]
+	// extract command and args. command is the first entry of the array
+	command := strings.ToUpper(data.array[0].bulkStr)
+	args := data.array[1:]
 
-		// process request
-		res := srv.handleCommand(HandlerCommand(command), args)
-		resp.Write(res)
+	// process request
+	c.lastActive.Store(time.Now().UnixNano())
+	// clients of a server with a password can only greet and authenticate until they send it
+	if srv.cfg.RequirePass != "" && !c.authenticated {
+		switch HandlerCommand(command) {
+		case Ping, Hello, Auth:
+		default:
+			return ErrNoAuth
+		}
 	}
+	// HELLO changes the state of the connection, so it's handled here rather than with the other commands
+	switch HandlerCommand(command) {
+	case Hello:
+		return srv.hello(c, args)
+	case Auth:
+		return srv.auth(c, args)
+	// transactions are kept per connection too
+	case Multi, Exec, Discard, Watch, Unwatch:
+		return srv.transaction(c, HandlerCommand(command), args)
+	}
+	if c.tx.multi {
+		return srv.queue(c, HandlerCommand(command), args)
+	}
+
+	srv.txMu.RLock()
+	defer srv.txMu.RUnlock()
+	return srv.handleCommand(HandlerCommand(command), args)
 }
 
 func shutdown(srv *Server) {
@@ -113,11 +376,53 @@ func shutdown(srv *Server) {
 	<-ctx.Done()
 
 	log.Println("shutting down server")
+	if forced := srv.drain(srv.cfg.ShutdownTimeout); forced > 0 {
+		log.Printf("closed %d connections with commands still in flight after the shutdown timeout\n", forced)
+	}
+
 	if err := srv.db.Close(); err != nil {
 		log.Printf("error closing database: %v\n", err)
 	}
+}
+
+// drain stops accepting connections and closes every connection once its in-flight command has been answered.
+// connections still open after the timeout are closed forcibly, and their number is returned
+func (srv *Server) drain(timeout time.Duration) int {
+	srv.draining.Store(true)
+
+	srv.mu.Lock()
+	listeners := srv.listeners
+	srv.mu.Unlock()
+	for _, ln := range listeners {
+		if err := ln.Close(); err != nil {
+			log.Printf("error closing server listener: %v\n", err)
+		}
+	}
+	// no connection is added to the wait group once every serve returns
+	srv.serving.Wait()
+
+	// idle connections are blocked reading their next command, so their reads are interrupted
+	srv.mu.Lock()
+	for _, c := range srv.clients {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
 
-	if err := srv.ln.Close(); err != nil {
-		log.Printf("error closing server listener: %v\n", err)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.clients {
+		c.conn.Close()
 	}
+	return len(srv.clients)
 }
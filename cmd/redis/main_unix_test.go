@@ -0,0 +1,114 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// getsockopt reads an integer socket option from the connection
+func getsockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	require.NoError(t, err)
+
+	var val int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		val, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	require.NoError(t, err)
+	require.NoError(t, sockErr)
+	return val
+}
+
+// test that the tcp options of the server are applied to accepted connections
+func TestConfigureConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	for _, tt := range []struct {
+		name string
+		cfg  ServerConfig
+	}{
+		{name: "nodelay and keepalive", cfg: ServerConfig{TCPNoDelay: true, TCPKeepAlive: 30 * time.Second}},
+		{name: "defaults disabled", cfg: ServerConfig{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+
+			conn, err := ln.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			srv := NewServer(nil, tt.cfg)
+			require.NoError(t, srv.configureConn(conn))
+
+			tcpConn := conn.(*net.TCPConn)
+			require.Equal(t, tt.cfg.TCPNoDelay, getsockopt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0)
+			require.Equal(t, tt.cfg.TCPKeepAlive > 0, getsockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0)
+		})
+	}
+}
+
+// test that clients are served on a unix socket along with tcp, that a stale socket file is replaced and that the
+// socket file is removed on shutdown
+func TestUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "beck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "beck.sock")
+
+	// other files are never replaced
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	_, err = listenUnix(path)
+	require.Error(t, err)
+	require.NoError(t, os.Remove(path))
+
+	// leave a socket file behind like a crashed server
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+	require.FileExists(t, path)
+
+	srv := newTestServer(t)
+	addr := startTestServer(t, srv)
+	ln, err := listenUnix(path)
+	require.NoError(t, err)
+	go srv.serve(ln)
+
+	tcpConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	unixConns := make([]net.Conn, 2)
+	for idx := range unixConns {
+		unixConns[idx], err = net.Dial("unix", path)
+		require.NoError(t, err)
+		defer unixConns[idx].Close()
+	}
+
+	require.Equal(t, AckVal, *sendCommand(t, unixConns[0], "SET", "name", "mrshabel"))
+	require.Equal(t, "mrshabel", sendCommand(t, tcpConn, "GET", "name").bulkStr)
+	require.Equal(t, "PONG", sendCommand(t, unixConns[1], "PING").str)
+
+	// each unix socket client is listed on its own
+	res := sendCommand(t, tcpConn, "CLIENT", "LIST")
+	require.Equal(t, 3, strings.Count(res.bulkStr, "addr="))
+	require.Equal(t, 2, strings.Count(res.bulkStr, "addr="+path+":"))
+
+	require.Zero(t, srv.drain(time.Second))
+	require.NoFileExists(t, path)
+}
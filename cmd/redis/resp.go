@@ -4,9 +4,9 @@ package main
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 type DataType string
@@ -18,6 +18,18 @@ const (
 	BulkString   DataType = "bulkString"
 	Null         DataType = "null"
 	Error        DataType = "error"
+	// resp3 types. they are sent as their closest resp2 type to clients that did not negotiate resp3
+	Map       DataType = "map"
+	Double    DataType = "double"
+	Boolean   DataType = "boolean"
+	BigNumber DataType = "bigNumber"
+	Verbatim  DataType = "verbatim"
+)
+
+// protocol versions negotiated with HELLO. connections speak resp2 until they switch
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 // resp single byte prefix for data type
@@ -30,6 +42,11 @@ const (
 	PrefixBoolean      Prefix = '#'
 	PrefixArray        Prefix = '*'
 	PrefixBulkString   Prefix = '$'
+	PrefixMap          Prefix = '%'
+	PrefixNull         Prefix = '_'
+	PrefixDouble       Prefix = ','
+	PrefixBigNumber    Prefix = '('
+	PrefixVerbatim     Prefix = '='
 )
 
 type Token byte
@@ -43,18 +60,46 @@ var CRLF = []byte{byte(CR), byte(LF)}
 
 // errors
 var (
-	ErrExpectCRLF = errors.New("err: protocol error. expected CRLF token")
+	ErrExpectCRLF error = protocolError("expected CRLF token")
+)
+
+// maxLineLen caps the lines of a request, such as inline commands, so a client can't grow the line being read
+// without bound. like redis, it's 64KB
+const maxLineLen = 64 * 1024
+
+// limits on the lengths a client sends ahead of its data. memory is only allocated as the data arrives, so they
+// bound what a single request can hold rather than what a length alone reserves
+const (
+	// elements of an array, counting both keys and values of a map
+	maxArrayLen = 1024 * 1024
+	// arrays nested in one another
+	maxArrayDepth = 32
+	// bytes of a bulk string, the default proto-max-bulk-len of redis
+	maxBulkLen = 512 * 1024 * 1024
 )
 
+// protocolError rejects a malformed request. it's sent to the client before the connection is closed
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Err Protocol error: " + string(e)
+}
+
 type Resp struct {
 	reader *bufio.Reader
-	writer io.Writer
+	// replies are buffered until flushed
+	writer *bufio.Writer
+	// protocol version replies are written in
+	proto int
+	// arrays being read, counting the one holding the value being read
+	depth int
 }
 
 func NewResp(rw io.ReadWriter) *Resp {
 	return &Resp{
 		reader: bufio.NewReader(rw),
-		writer: rw,
+		writer: bufio.NewWriter(rw),
+		proto:  RESP2,
 	}
 }
 
@@ -69,31 +114,95 @@ func (r *Resp) Read() (*Value, error) {
 	// process data by sending data with data type stripped off
 	switch Prefix(t) {
 	case PrefixArray:
-		return r.readArray()
+		return r.readArray(Array)
+	case PrefixMap:
+		return r.readArray(Map)
+	case PrefixNull:
+		if _, _, err := r.readLine(); err != nil {
+			return nil, err
+		}
+		return &Value{typ: Null}, nil
+	case PrefixBoolean:
+		line, _, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return &Value{typ: Boolean, boolean: string(line) == "t"}, nil
+	case PrefixDouble:
+		line, _, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		double, err := strconv.ParseFloat(string(line), 64)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{typ: Double, double: double}, nil
+	case PrefixBigNumber:
+		return r.readSimple(BigNumber)
+	case PrefixVerbatim:
+		val, err := r.readBulkString()
+		if err != nil {
+			return nil, err
+		}
+		// strip the format of the text
+		_, text, _ := strings.Cut(val.bulkStr, ":")
+		return &Value{typ: Verbatim, bulkStr: text}, nil
 	case PrefixBulkString:
 		return r.readBulkString()
+	case PrefixSimpleString:
+		return r.readSimple(SimpleString)
+	case PrefixError:
+		return r.readSimple(Error)
+	case PrefixInteger:
+		num, _, err := r.readInteger()
+		if err != nil {
+			return nil, err
+		}
+		return &Value{typ: Integer, num: num}, nil
 	default:
-		return nil, fmt.Errorf("err: protocol error. unknown type %v", string(t))
+		// any other first byte starts an inline command, as typed by telnet or netcat users
+		if err := r.reader.UnreadByte(); err != nil {
+			return nil, err
+		}
+		return r.readInline()
 	}
 }
 
-// Write writes the resp value to the underlying writer. this may typically be a response
+// Write buffers the resp value for the underlying writer until the next flush. this may typically be a response.
+// the value is encoded in the protocol version of the connection
 func (r *Resp) Write(v Value) error {
-	data := v.Marshal()
+	data := v.marshal(r.proto)
 	_, err := r.writer.Write(data)
 	return err
 }
 
-// WriteError sends an error reply to the client
+// WriteError buffers an error reply to the client
 func (r *Resp) WriteError(msg string) error {
 	return r.Write(Value{typ: Error, str: msg})
 }
 
+// SetProtocol switches the protocol version replies are written in
+func (r *Resp) SetProtocol(proto int) {
+	r.proto = proto
+}
+
+// Flush sends the buffered replies to the client
+func (r *Resp) Flush() error {
+	return r.writer.Flush()
+}
+
+// Buffered returns the number of bytes received from the client that are not read yet, such as those of pipelined
+// commands
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
 // readLine reads the input stream until the first occurrence of a CRLF token
 func (r *Resp) readLine() (line []byte, length int, err error) {
 	// read full input stream up to the LF token (\n), from which we can
 	// then verify that the CRLF token is the last occurrence read
-	line, err = r.reader.ReadBytes(byte(LF))
+	line, err = r.readUntilLF("too big request line")
 	if err != nil {
 		return nil, 0, err
 	}
@@ -122,30 +231,98 @@ func (r *Resp) readInteger() (num, n int, err error) {
 }
 
 // readArray reads the full array data from array length to the CRLF token
-// each element in the array is read and processed recursively
-func (r *Resp) readArray() (*Value, error) {
-	val := &Value{typ: Array}
+// each element in the array is read and processed recursively. maps are read as arrays of their keys and values
+func (r *Resp) readArray(typ DataType) (*Value, error) {
+	val := &Value{typ: typ}
 
-	// get array length
+	// get array length. -1 is the null array of resp2
 	arrLen, _, err := r.readInteger()
 	if err != nil {
 		return nil, err
 	}
+	if arrLen == -1 && typ == Array {
+		return &Value{typ: Null}, nil
+	}
+	limit := maxArrayLen
+	if typ == Map {
+		limit /= 2
+	}
+	if arrLen < 0 || arrLen > limit {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if typ == Map {
+		arrLen *= 2
+	}
+	if r.depth == maxArrayDepth {
+		return nil, protocolError("too deeply nested arrays")
+	}
+	r.depth++
+	defer func() { r.depth-- }()
 
-	// process each array element recursively
-	val.array = make([]Value, arrLen)
-	for idx := range arrLen {
+	// process each array element recursively. the length is only trusted as far as the elements arrive
+	val.array = make([]Value, 0, min(arrLen, 1024))
+	for range arrLen {
 		cur, err := r.Read()
 		if err != nil {
 			return nil, err
 		}
 
 		// record parsed value in resp array
-		val.array[idx] = *cur
+		val.array = append(val.array, *cur)
 	}
 	return val, nil
 }
 
+// readInline reads a command sent as a line of space separated arguments into an array of bulk strings, as a
+// request in resp would be. the line may end with a bare LF and empty lines are skipped
+func (r *Resp) readInline() (*Value, error) {
+	for {
+		line, err := r.readUntilLF("too big inline request")
+		if err != nil {
+			return nil, err
+		}
+
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			continue
+		}
+		val := &Value{typ: Array, array: make([]Value, len(args))}
+		for idx, arg := range args {
+			val.array[idx] = Value{typ: BulkString, bulkStr: arg}
+		}
+		return val, nil
+	}
+}
+
+// readUntilLF reads the input stream up to and including the first LF token. lines longer than maxLineLen are
+// rejected with a protocol error carrying msg
+func (r *Resp) readUntilLF(msg string) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice(byte(LF))
+		if len(line)+len(chunk) > maxLineLen {
+			return nil, protocolError(msg)
+		}
+		line = append(line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+// readSimple reads a simple string or simple error up to the CRLF token
+func (r *Resp) readSimple(typ DataType) (*Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return &Value{typ: typ, str: string(line)}, nil
+}
+
 // readBulkString reads the full bulk string from the string length to the CRLF token
 func (r *Resp) readBulkString() (*Value, error) {
 	val := &Value{typ: BulkString}
@@ -155,12 +332,25 @@ func (r *Resp) readBulkString() (*Value, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the null bulk string of resp2
+	if strLen == -1 {
+		return &Value{typ: Null}, nil
+	}
+	if strLen < 0 || strLen > maxBulkLen {
+		return nil, protocolError("invalid bulk length")
+	}
 
-	// collect string from current reader
-	bulkString := make([]byte, strLen)
-	r.reader.Read(bulkString)
+	// collect string from current reader. large strings are grown as they arrive rather than allocated upfront
+	var bulkString strings.Builder
+	bulkString.Grow(min(strLen, maxLineLen))
+	if _, err := io.CopyN(&bulkString, r.reader, int64(strLen)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
 
-	val.bulkStr = string(bulkString)
+	val.bulkStr = bulkString.String()
 
 	// consume crlf token
 	if _, _, err = r.readLine(); err != nil {
@@ -181,13 +371,22 @@ type Value struct {
 	num int
 	// bulk string value
 	bulkStr string
-	// all values received from the array
+	// all values received from the array. maps hold their keys and values in turn
 	array []Value
+	// double and boolean values. big numbers are held in str and verbatim strings in bulkStr
+	double  float64
+	boolean bool
 }
 
-// convert value into resp bytes. all marshalled data is suffixed with CRLF token
+// convert value into resp2 bytes. all marshalled data is suffixed with CRLF token
 // <prefix sign - data - crlf>
 func (v *Value) Marshal() []byte {
+	return v.marshal(RESP2)
+}
+
+// marshal converts the value into the bytes of the given protocol version. resp3 types are sent as their closest
+// resp2 type to resp2 clients: maps as flat arrays, booleans as integers, and the rest as bulk strings
+func (v *Value) marshal(proto int) []byte {
 	switch v.typ {
 	case SimpleString:
 		return v.marshalSimpleString()
@@ -196,16 +395,73 @@ func (v *Value) Marshal() []byte {
 	case BulkString:
 		return v.marshalBulkString()
 	case Array:
-		return v.marshalArray()
+		return v.marshalArray(PrefixArray, len(v.array), proto)
 	case Null:
+		if proto >= RESP3 {
+			return []byte("_\r\n")
+		}
 		return v.marshalNullBulkString()
 	case Error:
 		return v.marshalError()
+	case Map:
+		if proto >= RESP3 {
+			return v.marshalArray(PrefixMap, len(v.array)/2, proto)
+		}
+		return v.marshalArray(PrefixArray, len(v.array), proto)
+	case Double:
+		double := strconv.FormatFloat(v.double, 'f', -1, 64)
+		if proto >= RESP3 {
+			return v.marshalLine(PrefixDouble, double)
+		}
+		return (&Value{typ: BulkString, bulkStr: double}).marshalBulkString()
+	case Boolean:
+		if proto >= RESP3 {
+			if v.boolean {
+				return v.marshalLine(PrefixBoolean, "t")
+			}
+			return v.marshalLine(PrefixBoolean, "f")
+		}
+		num := 0
+		if v.boolean {
+			num = 1
+		}
+		return (&Value{typ: Integer, num: num}).marshalInteger()
+	case BigNumber:
+		if proto >= RESP3 {
+			return v.marshalLine(PrefixBigNumber, v.str)
+		}
+		return (&Value{typ: BulkString, bulkStr: v.str}).marshalBulkString()
+	case Verbatim:
+		if proto >= RESP3 {
+			return v.marshalVerbatim()
+		}
+		return v.marshalBulkString()
 	default:
 		return []byte{}
 	}
 }
 
+// marshalLine marshals a value sent on a single line after its prefix
+func (v *Value) marshalLine(prefix Prefix, line string) []byte {
+	data := []byte{byte(prefix)}
+	data = append(data, line...)
+	data = append(data, CRLF...)
+	return data
+}
+
+// marshalVerbatim marshals a resp3 verbatim string of plain text
+func (v *Value) marshalVerbatim() []byte {
+	var data []byte
+	// sign, length, crlf, format followed by the text then crlf
+	data = append(data, byte(PrefixVerbatim))
+	data = append(data, strconv.Itoa(len("txt:")+len(v.bulkStr))...)
+	data = append(data, CRLF...)
+	data = append(data, "txt:"...)
+	data = append(data, v.bulkStr...)
+	data = append(data, CRLF...)
+	return data
+}
+
 func (v *Value) marshalSimpleString() []byte {
 	var data []byte
 	// sign, followed by string then crlf
@@ -237,18 +493,17 @@ func (v *Value) marshalBulkString() []byte {
 	return data
 }
 
-func (v *Value) marshalArray() []byte {
+func (v *Value) marshalArray(prefix Prefix, length int, proto int) []byte {
 	var data []byte
-	length := strconv.Itoa(len(v.array))
 	// sign, length of array, crlf, elements1...elementN
-	data = append(data, byte(PrefixArray))
-	data = append(data, []byte(length)...)
+	data = append(data, byte(prefix))
+	data = append(data, []byte(strconv.Itoa(length))...)
 	data = append(data, CRLF...)
 
 	// append elements one by one
 	for _, val := range v.array {
 		// since type is unknown, the parent marshal function is called
-		data = append(data, val.Marshal()...)
+		data = append(data, val.marshal(proto)...)
 	}
 
 	return data
@@ -269,7 +524,3 @@ func (v *Value) marshalError() []byte {
 	data = append(data, CRLF...)
 	return data
 }
-
-type Writer struct {
-	writer io.Writer
-}
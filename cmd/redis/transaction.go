@@ -0,0 +1,129 @@
+package main
+
+// transaction holds the MULTI state of a client connection. it's only used by the goroutine serving the connection
+type transaction struct {
+	// commands are queued rather than run between MULTI and EXEC
+	multi  bool
+	queued []queuedCommand
+	// a command failed to queue, so EXEC discards the transaction
+	dirty bool
+	// versions of the keys watched, as they were when WATCH was called
+	watched map[string]uint64
+}
+
+// queuedCommand is a command waiting for EXEC
+type queuedCommand struct {
+	command HandlerCommand
+	args    []Value
+}
+
+var (
+	QueuedVal Value = Value{typ: SimpleString, str: "QUEUED"}
+
+	ErrExecAbort Value = Value{typ: Error, str: "EXECABORT Transaction discarded because of previous errors."}
+)
+
+// transaction implements the redis MULTI, EXEC, DISCARD, WATCH and UNWATCH commands
+func (srv *Server) transaction(c *client, command HandlerCommand, args []Value) Value {
+	info, _ := lookupCommand(string(command))
+	if !validArity(info, args) {
+		return Value{typ: Error, str: "Err wrong number of arguments for '" + string(command) + "' command"}
+	}
+
+	tx := &c.tx
+	switch command {
+	case Multi:
+		if tx.multi {
+			return Value{typ: Error, str: "Err MULTI calls can not be nested"}
+		}
+		tx.multi = true
+		return AckVal
+	case Exec:
+		if !tx.multi {
+			return Value{typ: Error, str: "Err EXEC without MULTI"}
+		}
+		defer tx.reset()
+		if tx.dirty {
+			return ErrExecAbort
+		}
+		return srv.exec(tx)
+	case Discard:
+		if !tx.multi {
+			return Value{typ: Error, str: "Err DISCARD without MULTI"}
+		}
+		tx.reset()
+		return AckVal
+	case Watch:
+		if tx.multi {
+			return Value{typ: Error, str: "Err WATCH inside MULTI is not allowed"}
+		}
+		if tx.watched == nil {
+			tx.watched = make(map[string]uint64, len(args))
+		}
+		for _, arg := range args {
+			// a key watched again keeps the version it was first watched at
+			if _, ok := tx.watched[arg.bulkStr]; !ok {
+				tx.watched[arg.bulkStr] = srv.watchVersion(arg.bulkStr)
+			}
+		}
+		return AckVal
+	default:
+		tx.watched = nil
+		return AckVal
+	}
+}
+
+// queue adds a command to the open transaction of the client. commands that are unknown or have the wrong number of
+// arguments are rejected straight away and fail the transaction
+func (srv *Server) queue(c *client, command HandlerCommand, args []Value) Value {
+	info, ok := lookupCommand(string(command))
+	if !ok {
+		c.tx.dirty = true
+		return unknownCommand(command, args)
+	}
+	if !validArity(info, args) {
+		c.tx.dirty = true
+		return Value{typ: Error, str: "Err wrong number of arguments for '" + string(command) + "' command"}
+	}
+
+	c.tx.queued = append(c.tx.queued, queuedCommand{command: command, args: args})
+	return QueuedVal
+}
+
+// exec runs the queued commands of a transaction with every other command held off, replying with their replies
+// in order. nothing is run and a null reply is returned if a watched key changed since it was watched
+func (srv *Server) exec(tx *transaction) Value {
+	srv.txMu.Lock()
+	defer srv.txMu.Unlock()
+
+	for key, version := range tx.watched {
+		if srv.watchVersion(key) != version {
+			return NullVal
+		}
+	}
+
+	res := Value{typ: Array, array: make([]Value, 0, len(tx.queued))}
+	for _, cmd := range tx.queued {
+		res.array = append(res.array, srv.handleCommand(cmd.command, cmd.args))
+	}
+	return res
+}
+
+// watchVersion returns a number that changes each time a key is written or removed. a key names either a string or
+// a hash, whose fields are stored under the hash prefix, so the versions of both are covered
+func (srv *Server) watchVersion(key string) uint64 {
+	return max(srv.db.Version(key), srv.db.PrefixVersion(getHashPrefix(key)))
+}
+
+// reset ends the transaction and unwatches every key
+func (tx *transaction) reset() {
+	*tx = transaction{}
+}
+
+// validArity reports whether args, which exclude the command name, satisfy the arity of the command
+func validArity(info commandInfo, args []Value) bool {
+	if info.arity < 0 {
+		return len(args)+1 >= -info.arity
+	}
+	return len(args)+1 == info.arity
+}
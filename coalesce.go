@@ -0,0 +1,73 @@
+package beck
+
+// writeRequest is a put waiting to be coalesced with other puts into a single datafile write
+type writeRequest struct {
+	key  string
+	val  []byte
+	err  error
+	done chan struct{}
+}
+
+// putCoalesced queues the put and waits for it to be written. the first writer to find no flush in progress becomes
+// the leader: it takes the write lock and writes every queued put with a single append, repeating until the queue
+// drains. puts that arrive while a write is in flight therefore share the next write and its syscall.
+// keydir updates are applied by the leader in write order so the keydir always reflects the latest record on disk
+func (db *BeckDB) putCoalesced(key string, val []byte) error {
+	req := &writeRequest{key: key, val: val, done: make(chan struct{})}
+
+	db.queueMu.Lock()
+	db.writeQueue = append(db.writeQueue, req)
+	leader := !db.flushing
+	db.flushing = true
+	db.queueMu.Unlock()
+
+	if !leader {
+		<-req.done
+		return req.err
+	}
+
+	if db.cfg.ConcurrentWrites {
+		db.writeMu.Lock()
+		defer db.writeMu.Unlock()
+	} else {
+		db.lock()
+		defer db.unlock()
+	}
+
+	for {
+		db.queueMu.Lock()
+		queue := db.writeQueue
+		db.writeQueue = nil
+		if len(queue) == 0 {
+			db.flushing = false
+			db.queueMu.Unlock()
+			break
+		}
+		db.queueMu.Unlock()
+
+		db.flushQueue(queue)
+	}
+
+	return req.err
+}
+
+// flushQueue writes all queued puts with a single append then records them in the keydir in order.
+// the caller must hold the write lock
+func (db *BeckDB) flushQueue(queue []*writeRequest) {
+	records := make([]*record, len(queue))
+	for idx, req := range queue {
+		records[idx] = newRecord(req.key, req.val, 0)
+	}
+
+	sizes, offsets, err := db.activeDatafile.appendBatch(records)
+	for idx, req := range queue {
+		if err != nil {
+			req.err = err
+		} else {
+			db.keyDir.put(req.key, db.activeIndex, sizes[idx], len(req.val), offsets[idx], 0)
+			db.cache.remove(req.key)
+			db.metrics.puts.Add(1)
+		}
+		close(req.done)
+	}
+}
@@ -0,0 +1,68 @@
+package beck
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Compression is the algorithm values are compressed with before they are written to a datafile
+type Compression int
+
+const (
+	// CompressionNone stores values as-is. This is the default
+	CompressionNone Compression = iota
+	// CompressionFlate compresses values with DEFLATE at its fastest level. Values that do not shrink are stored as-is
+	CompressionFlate
+)
+
+// flate writers and readers allocate large internal buffers, so they are reused across records
+var (
+	flateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+// compressValue returns val compressed with c and whether it was compressed. values are only compressed when that
+// shrinks them, and empty values are never compressed so tombstones stay recognizable by their size
+func compressValue(c Compression, val []byte) ([]byte, bool, error) {
+	if c != CompressionFlate || len(val) == 0 {
+		return val, false, nil
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(val); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buf.Len() >= len(val) {
+		return val, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// decompressValue restores a value compressed by compressValue
+func decompressValue(data []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, err
+	}
+
+	val, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrInvalidRecord
+	}
+	return val, nil
+}
@@ -1,6 +1,12 @@
 package beck
 
-import "time"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
 
 const (
 	// 64 mb
@@ -13,18 +19,74 @@ const (
 	datafileExt   = ".data"
 	hintFileExt   = ".hint"
 	mergedFileExt = ".merge"
+	// suffix of files written under a temporary name before being moved into place
+	tempFileExt = ".tmp"
+	// suffix of the temporary files streamed values are spooled to before they are appended
+	streamFileExt = ".stream"
+
+	// highest file id of the merged datafiles, which are numbered down from it. active datafiles are numbered from
+	// the id after it, so a merge never writes over a datafile that is still appended to
+	mergedFileID = 0
+
+	// number of hint entries verified against the datafile when hint checks are sampled
+	hintSampleSize = 16
+
+	// number of background worker errors buffered in the error channel before new ones are dropped
+	errorChSize = 16
+
+	// interval to check the reclaimable bytes of old datafiles against the merge threshold
+	mergeCheckInterval = time.Second
+	// interval to check whether a running merge has completed
+	mergeIdleCheckInterval = 10 * time.Millisecond
 
-	// file id for merged files
-	defaultMergedFileID = 0
+	// number of times a read retries the keydir lookup when its datafile is purged by a concurrent merge
+	maxLookupAttempts = 3
 
-	// maximum length of key in bytes
-	maxKeySize = 32768
-	// maximum length of value in bytes
-	maxValueSize = 1 << 20
+	// number of in-progress scan snapshots kept before the oldest is discarded
+	maxScanSnapshots = 16
+	// number of keys returned per scan page when not specified
+	defaultScanCount = 10
+
+	// size in bytes of the write buffer of the active datafile when not specified
+	defaultWriteBufferSize = 64 << 10
+	// size in bytes of the write buffers used for the merged datafile and hint file when not specified
+	defaultMergeBufferSize = 4 << 20
+	// size in bytes of the chunks read ahead when scanning datafiles when not specified
+	defaultReadAheadSize = 1 << 20
+
+	// number of keys with an expiry checked per round of the expiry sweep, and the most keys visited to find them
+	expirySampleSize   = 20
+	expirySampleVisits = 20 * expirySampleSize
+	// the expiry sweep runs another round while more than this share of the sampled keys had expired, up to the
+	// maximum number of rounds per sweep
+	expirySweepRepeatRatio = 0.25
+	maxExpirySweepRounds   = 16
+
+	// number of slow operations kept in the slow log when not specified
+	defaultSlowLogSize = 128
+
+	// maximum length of key in bytes when not specified
+	defaultMaxKeySize = 32768
+	// maximum length of value in bytes when not specified
+	defaultMaxValueSize = 1 << 20
 )
 
 var (
 	tombstoneVal = []byte{}
+	// discardLogger drops every record, for databases configured without a logger
+	discardLogger = slog.New(slog.DiscardHandler)
+)
+
+// HintCheck controls how hint file entries are verified against their datafile when replaying the keydir on open
+type HintCheck int
+
+const (
+	// HintCheckSample verifies an evenly spaced sample of hint entries. This is the default
+	HintCheckSample HintCheck = iota
+	// HintCheckFull verifies every hint entry. This is slower but guarantees the keydir never points at garbage
+	HintCheckFull
+	// HintCheckNone trusts the hint file as-is
+	HintCheckNone
 )
 
 type Config struct {
@@ -35,11 +97,161 @@ type Config struct {
 	MergeInterval               time.Duration
 	TrackActiveDatafileInterval time.Duration
 	ReadOnly                    bool
+	// HintCheck sets how hint files are verified on open. A hint file failing verification is discarded
+	// and the keydir is rebuilt from its datafile instead
+	HintCheck HintCheck
+	// MergeReadRepair lets merges self-heal the keydir. Unreadable records stop the scan of their file instead of
+	// failing the merge, and keydir entries left pointing at merged files without a live record are dropped
+	MergeReadRepair bool
+	// ConcurrentWrites lets puts write to disk without holding the database lock, so reads are not blocked
+	// by slow writes or fsyncs. Writes remain serialized among themselves
+	ConcurrentWrites bool
+	// CoalesceWrites groups puts that arrive while another write is in flight into a single datafile write,
+	// reducing the number of write syscalls for workloads with many small concurrent puts
+	CoalesceWrites bool
+	// ReadVerifyEveryN makes every nth Get confirm that the record on disk holds the requested key, catching keydir
+	// drift that checksums alone cannot detect. Mismatches are logged and returned as ErrKeyMismatch. Disabled when 0
+	ReadVerifyEveryN int
+	// SlowOpThreshold is the duration after which a Get, Put, Delete or Compact is logged and recorded in the
+	// slow log. Disabled when 0
+	SlowOpThreshold time.Duration
+	// SlowLogSize is the number of most recent slow operations kept in the slow log
+	SlowLogSize int
+	// Logger receives background events such as merges and rotations, recovered corruption and the errors of
+	// background workers. Nothing is logged when it's nil
+	Logger *slog.Logger
+	// WriteBufferSize is the size in bytes of the in-memory buffer for writes to the active datafile. Writes are
+	// only buffered when SyncOnWrite is disabled, and are flushed on sync, rotation, close and before being read.
+	// Buffered records are lost if the process exits without a flush. A negative value writes each record directly
+	WriteBufferSize int
+	// MergeBufferSize is the size in bytes of the write buffers used for the merged datafile and hint file,
+	// which are flushed once at the end of a merge. A negative value writes each entry directly to the files
+	MergeBufferSize int
+	// ReadAheadSize is the size in bytes of the chunks read ahead when datafiles are scanned in order, on open and
+	// during merges, so a scan reads once per chunk rather than twice per record. A negative value reads each
+	// record separately
+	ReadAheadSize int
+	// UseMmap memory-maps old datafiles so reads from them do not need a syscall. Platforms without mmap
+	// support read through the file instead
+	UseMmap bool
+	// HintOnlyKeys stores a hash of each key in datafiles and keeps the full key only in hint files, which are then
+	// written for every datafile. This shrinks datafiles for large keys, but keys whose hint file is lost or
+	// corrupted cannot be recovered and opening the database fails with ErrHintFileRequired
+	HintOnlyKeys bool
+	// CacheSize is the number of recently read values kept in memory so repeated reads skip the disk.
+	// Disabled when 0
+	CacheSize int
+	// IdleFileTimeout closes old datafiles, and releases their memory mappings, once they have not been read for
+	// this long. They are reopened on the next read. Disabled when 0
+	IdleFileTimeout time.Duration
+	// ExpirySweepInterval deletes expired keys in the background every interval, so keys that are never read again
+	// do not outlive their expiry on disk. Like redis, each sweep checks a random sample of the keys with an expiry
+	// rather than all of them, and samples again while many of them had expired. Disabled when 0, leaving expired
+	// keys to merges
+	ExpirySweepInterval time.Duration
+	// MergeThreshold merges old datafiles as soon as the ratio of their reclaimable bytes to their total size exceeds
+	// it, rather than only every MergeInterval, which still bounds the time between merges. Disabled when 0
+	MergeThreshold float64
+	// DedupValues stores each distinct value once and lets every key holding it reference the shared copy, which
+	// merges reclaim once no key references it. Values no longer than their 32-byte content hash, and values written
+	// through batches or coalesced writes, are stored with their key
+	DedupValues bool
+	// CompactOnOpen compacts the old datafiles before Open returns when the ratio of their reclaimable bytes to their
+	// total size exceeds it, so a database reopened after a crash starts without its dead records. Ignored in
+	// read-only mode. Disabled when 0 for faster startups
+	CompactOnOpen float64
+	// ByteOrder is the byte order records and hints are encoded in. It's recorded in the data directory when the
+	// directory is first opened, and opening it later with another byte order fails with ErrByteOrderMismatch.
+	// When nil, the recorded byte order is used, and new directories are little-endian
+	ByteOrder binary.ByteOrder
+	// StrictRecovery fails Open on the first corrupt record found while replaying datafiles. Otherwise corrupt records
+	// are skipped and logged, so the rest of a partially corrupted database can still be recovered
+	StrictRecovery bool
+	// Compression compresses values before they are written to datafiles, which suits values such as JSON that
+	// compress well. Records keep whether their value is compressed, so it can be changed between opens
+	Compression Compression
+	// EncryptionKey encrypts values at rest with AES-GCM. It must be 16, 24 or 32 bytes long to select AES-128,
+	// AES-192 or AES-256. Keys and hint files are not encrypted. Reading a value encrypted with another key fails
+	// with ErrDecryptionFailed. Values are stored in plaintext when nil
+	EncryptionKey []byte
+	// SkipVerifyOnRead skips verifying the checksum of records read by Get, which saves CPU on read-heavy workloads
+	// over trusted storage. Corrupted values are then returned as-is rather than failing with ErrInvalidChecksum.
+	// Records are still verified when replayed on open, merged and streamed
+	SkipVerifyOnRead bool
+	// MaxKeySize is the maximum length of a key in bytes. It must fit in the key size of records alongside their
+	// flags, below 128MB. Defaults to 32KB
+	MaxKeySize int
+	// MaxValueSize is the maximum length of a value in bytes. Values up to this size are accepted by Put, while
+	// PutReader streams them to disk without holding them in memory. Defaults to 1MB
+	MaxValueSize int64
 }
 
-func (cfg *Config) validate() error {
+// Validate reports every problem with the config without modifying it. Zero values are valid and replaced with
+// their defaults on open
+func (cfg *Config) Validate() []error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...))
+	}
+
 	if cfg.DataDir == "" {
-		return ErrDatabaseDirectoryRequired
+		errs = append(errs, ErrDatabaseDirectoryRequired)
+	}
+	if cfg.MaxFileSize < 0 {
+		invalid("max file size must not be negative, got %d", cfg.MaxFileSize)
+	}
+	for _, interval := range []struct {
+		name string
+		val  time.Duration
+	}{
+		{name: "sync interval", val: cfg.SyncInterval},
+		{name: "merge interval", val: cfg.MergeInterval},
+		{name: "track active datafile interval", val: cfg.TrackActiveDatafileInterval},
+		{name: "slow op threshold", val: cfg.SlowOpThreshold},
+		{name: "idle file timeout", val: cfg.IdleFileTimeout},
+		{name: "expiry sweep interval", val: cfg.ExpirySweepInterval},
+	} {
+		if interval.val < 0 {
+			invalid("%s must not be negative, got %v", interval.name, interval.val)
+		}
+	}
+	if cfg.HintCheck < HintCheckSample || cfg.HintCheck > HintCheckNone {
+		invalid("unknown hint check %d", cfg.HintCheck)
+	}
+	if cfg.Compression < CompressionNone || cfg.Compression > CompressionFlate {
+		invalid("unknown compression %d", cfg.Compression)
+	}
+	if n := len(cfg.EncryptionKey); cfg.EncryptionKey != nil && n != 16 && n != 24 && n != 32 {
+		invalid("encryption key must be 16, 24 or 32 bytes long, got %d", n)
+	}
+	if cfg.ReadVerifyEveryN < 0 {
+		invalid("read verify every n must not be negative, got %d", cfg.ReadVerifyEveryN)
+	}
+	if cfg.SlowLogSize < 0 {
+		invalid("slow log size must not be negative, got %d", cfg.SlowLogSize)
+	}
+	if cfg.MaxKeySize < 0 || cfg.MaxKeySize > maxKeySectionLen {
+		invalid("max key size must be between 0 and %d, got %d", maxKeySectionLen, cfg.MaxKeySize)
+	}
+	if cfg.MaxValueSize < 0 {
+		invalid("max value size must not be negative, got %d", cfg.MaxValueSize)
+	}
+	if cfg.CacheSize < 0 {
+		invalid("cache size must not be negative, got %d", cfg.CacheSize)
+	}
+	if cfg.MergeThreshold < 0 || cfg.MergeThreshold > 1 {
+		invalid("merge threshold must be between 0 and 1, got %v", cfg.MergeThreshold)
+	}
+	if cfg.CompactOnOpen < 0 || cfg.CompactOnOpen > 1 {
+		invalid("compact on open must be between 0 and 1, got %v", cfg.CompactOnOpen)
+	}
+	return errs
+}
+
+// validate rejects an invalid config and applies the defaults of unset fields
+func (cfg *Config) validate() error {
+	if err := errors.Join(cfg.Validate()...); err != nil {
+		return err
 	}
 	if cfg.MaxFileSize <= 0 {
 		cfg.MaxFileSize = defaultMaxFileSize
@@ -53,6 +265,24 @@ func (cfg *Config) validate() error {
 	if cfg.TrackActiveDatafileInterval <= 0 {
 		cfg.TrackActiveDatafileInterval = defaultTrackActiveDatafileInterval
 	}
+	if cfg.WriteBufferSize == 0 {
+		cfg.WriteBufferSize = defaultWriteBufferSize
+	}
+	if cfg.MergeBufferSize == 0 {
+		cfg.MergeBufferSize = defaultMergeBufferSize
+	}
+	if cfg.ReadAheadSize == 0 {
+		cfg.ReadAheadSize = defaultReadAheadSize
+	}
+	if cfg.SlowLogSize <= 0 {
+		cfg.SlowLogSize = defaultSlowLogSize
+	}
+	if cfg.MaxKeySize == 0 {
+		cfg.MaxKeySize = defaultMaxKeySize
+	}
+	if cfg.MaxValueSize == 0 {
+		cfg.MaxValueSize = defaultMaxValueSize
+	}
 	return nil
 }
 
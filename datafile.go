@@ -1,46 +1,122 @@
 package beck
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // datafile is a smallest unit of beckdb. It holds sequence of records in an append-only format. The record format is shown below:
-// | crc (4-byte) | timestamp (8-byte) | keySize (4-byte) | valSize (8-byte) | key | val |
+// | crc (4-byte) | timestamp (8-byte) | expiry (8-byte) | keySize (4-byte) | valSize (8-byte) | key | val |
+// the crc covers everything in the record after itself. expiry is a unix timestamp in milliseconds, 0 if the record never expires.
+// when keys are kept only in hint files, the top bit of keySize is set and the key section holds the 8-byte fnv-1a hash of the key.
+// when values are deduplicated, the second bit of keySize marks a record whose value section holds the 32-byte sha-256 content
+// hash of a shared value, and the third bit marks the record of a shared value whose key section holds its content hash.
+// the fourth bit marks a value section compressed with DEFLATE, and valSize is then the length of the compressed value.
+// the fifth bit marks a value section encrypted with AES-GCM, which holds the nonce followed by the sealed value
 
 // section lengths in bytes
 const (
 	crcLen       = 4
 	timestampLen = 8
+	expiryLen    = 8
 	keySizeLen   = 4
 	valSizeLen   = 8
-	// header size without actual key and data (24 bytes)
-	headerLen = crcLen + timestampLen + keySizeLen + valSizeLen
+	// header size without actual key and data (32 bytes)
+	headerLen = crcLen + timestampLen + expiryLen + keySizeLen + valSizeLen
+	// length of a key hash stored in place of the key
+	keyHashLen = 8
+	// length of the content hash of a shared value
+	valueHashLen = sha256.Size
 )
 
-// encoding format
-var (
-	enc = binary.LittleEndian
+// flags stored in the top bits of the key size
+const (
+	// the key section holds the key hash rather than the key
+	keyHashedFlag = 1 << 31
+	// the value section holds the content hash of a shared value rather than the value
+	valueRefFlag = 1 << 30
+	// the record holds a shared value and its key section holds the content hash of the value
+	sharedValueFlag = 1 << 29
+	// the value section holds the value compressed with DEFLATE
+	compressedFlag = 1 << 28
+	// the value section holds the value encrypted with AES-GCM
+	encryptedFlag = 1 << 27
+
+	keyFlags = keyHashedFlag | valueRefFlag | sharedValueFlag | compressedFlag | encryptedFlag
+	// largest key size that leaves the bits of the lowest flag clear
+	maxKeySectionLen = encryptedFlag - 1
 )
 
+// fileHandle is the subset of file operations used by a datafile
+type fileHandle interface {
+	io.ReaderAt
+	io.Writer
+	Sync() error
+	Close() error
+	Name() string
+}
+
 type datafile struct {
-	f *os.File
+	// nil while an idle file is released. it's reopened on the next read
+	f    fileHandle
+	name string
 
 	// whether to perform fsync on write or not
-	syncOnWrite  bool
-	syncInterval time.Duration
+	syncOnWrite bool
+
+	// byte order of the encoded records
+	enc binary.ByteOrder
 
 	readOnly bool
 
-	// current file content size
+	// buffers appended records until the next flush. nil when writes go straight to the file
+	w *bufio.Writer
+	// memory-mapped file content of an immutable datafile. nil when reads go through the file
+	data []byte
+
+	// whether records store a hash of their key instead of the key. the hint file then holds the only copy of the
+	// keys, and every record appended to the datafile is also appended to hint when set
+	hashKeys bool
+	hint     *hintFile
+	// algorithm values appended to the datafile are compressed with
+	compression Compression
+	// cipher values are encrypted with. nil when values are stored in plaintext
+	aead cipher.AEAD
+	// logger of the database the datafile belongs to
+	logger *slog.Logger
+	// counter of the bytes appended, set on active datafiles only
+	written *atomic.Uint64
+
+	// current file content size, including buffered records
 	size int
 	mu   sync.RWMutex
+
+	// number of reads in progress and whether the file is removed once the last of them completes. the path of a
+	// file purged during reads is unlinked right away so it can be reused while the reads complete
+	pins     int
+	purging  bool
+	unlinked bool
+	pinMu    sync.Mutex
+
+	// unix nanoseconds of the last read, and whether the released file was memory-mapped
+	lastAccess atomic.Int64
+	mapped     bool
 }
 
-func NewDatafile(name string, readOnly bool, syncOnWrite bool, syncInterval time.Duration) (*datafile, error) {
+// NewDatafile opens a datafile. writes are buffered in memory when writeBufferSize is positive and the file is
+// opened for writing; records still in the buffer are flushed before they are read
+func NewDatafile(name string, readOnly bool, syncOnWrite bool, writeBufferSize int, enc binary.ByteOrder) (*datafile, error) {
 	// open file in append only mode if mode is rw
 	perm := os.O_RDONLY
 	if !readOnly {
@@ -59,64 +135,208 @@ func NewDatafile(name string, readOnly bool, syncOnWrite bool, syncInterval time
 	}
 
 	df := &datafile{
-		f:            f,
-		size:         int(fi.Size()),
-		readOnly:     readOnly,
-		syncOnWrite:  syncOnWrite,
-		syncInterval: syncInterval,
+		f:           f,
+		name:        name,
+		size:        int(fi.Size()),
+		readOnly:    readOnly,
+		syncOnWrite: syncOnWrite,
+		enc:         enc,
+		logger:      discardLogger,
 	}
+	if !readOnly && writeBufferSize > 0 {
+		df.w = bufio.NewWriterSize(f, writeBufferSize)
+	}
+	df.lastAccess.Store(time.Now().UnixNano())
 
 	return df, nil
 }
 
-// append the key-value pair to the file and return the value size, and position
-func (d *datafile) append(key string, val []byte) (size int, offset uint64, err error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// append the record to the file and return the record size, and position
+func (d *datafile) append(r *record) (size int, offset uint64, err error) {
+	sizes, offsets, err := d.appendBatch([]*record{r})
+	if err != nil {
+		return 0, 0, err
+	}
+	return sizes[0], offsets[0], nil
+}
 
+// appendBatch writes all records to the file with a single write and returns the size and position of each record
+func (d *datafile) appendBatch(records []*record) (sizes []int, offsets []uint64, err error) {
 	// skip if datafile is opened in read-only mode
+	if d.readOnly {
+		return nil, nil, ErrDatabaseReadOnly
+	}
+
+	// encode all records into a single buffer
+	var buf []byte
+	sizes = make([]int, len(records))
+	for idx, r := range records {
+		encoded, err := r.encode(d.hashKeys, d.compression, d.aead, d.enc)
+		if err != nil {
+			return nil, nil, err
+		}
+		buf = append(buf, encoded...)
+		sizes[idx] = len(encoded)
+	}
+
+	d.mu.Lock()
+	var n int
+	if d.w != nil {
+		n, err = d.w.Write(buf)
+	} else {
+		n, err = d.f.Write(buf)
+	}
+	if err != nil {
+		d.mu.Unlock()
+		return nil, nil, err
+	}
+	if n < len(buf) {
+		d.mu.Unlock()
+		return nil, nil, ErrIncompleteWrite
+	}
+
+	if d.written != nil {
+		d.written.Add(uint64(n))
+	}
+
+	// update file size. the previous size is the offset of the first record
+	offsets = make([]uint64, len(records))
+	for idx, size := range sizes {
+		offsets[idx] = uint64(d.size)
+		d.size += size
+	}
+	d.mu.Unlock()
+
+	// record the keys in the hint file. appends are serialized by the db so hints keep the order of the records
+	if d.hint != nil {
+		var hints []byte
+		for idx, r := range records {
+			hints = append(hints, encodeHint(r.hint(sizes[idx], offsets[idx]), d.enc)...)
+		}
+		if err := d.hint.write(hints); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// sync if durable. this happens outside the lock so concurrent reads are not blocked by the fsync
+	if d.syncOnWrite {
+		if err := d.f.Sync(); err != nil {
+			return nil, nil, err
+		}
+		if d.hint != nil {
+			if err := d.hint.sync(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return sizes, offsets, nil
+}
+
+// appendTo writes the record to w instead of the file and returns the size and position the record will have once
+// w is flushed to the file. this is only safe for datafiles that readers cannot see yet, such as a merged file
+// being built, since the record is not readable until the buffer is flushed
+func (d *datafile) appendTo(w io.Writer, r *record) (size int, offset uint64, err error) {
 	if d.readOnly {
 		return 0, 0, ErrDatabaseReadOnly
 	}
 
-	// create encoded record and write to file handler
-	r := newRecord(key, val)
-	encoded, err := r.encode()
+	encoded, err := r.encode(d.hashKeys, d.compression, d.aead, d.enc)
 	if err != nil {
 		return 0, 0, err
 	}
+	if _, err := w.Write(encoded); err != nil {
+		return 0, 0, err
+	}
 
-	n, err := d.f.Write(encoded)
-	if err != nil {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	offset = uint64(d.size)
+	d.size += len(encoded)
+	return len(encoded), offset, nil
+}
+
+// appendStream writes the record with the given encoded head, whose checksum must already cover val, followed by size
+// bytes of val. the value is copied to the file without being held in memory. the record size and position are
+// returned
+func (d *datafile) appendStream(r *record, head []byte, val io.Reader, size int64) (recordSize int, offset uint64, err error) {
+	if d.readOnly {
+		return 0, 0, ErrDatabaseReadOnly
+	}
+
+	d.mu.Lock()
+	var w io.Writer = d.f
+	if d.w != nil {
+		w = d.w
+	}
+	if _, err := w.Write(head); err != nil {
+		d.mu.Unlock()
 		return 0, 0, err
 	}
-	if n < len(encoded) {
-		return 0, 0, ErrIncompleteWrite
+	if n, err := io.CopyN(w, val, size); err != nil {
+		d.mu.Unlock()
+		if n < size && err == io.EOF {
+			return 0, 0, ErrIncompleteWrite
+		}
+		return 0, 0, err
+	}
+	recordSize = len(head) + int(size)
+	offset = uint64(d.size)
+	d.size += recordSize
+	d.mu.Unlock()
+	if d.written != nil {
+		d.written.Add(uint64(recordSize))
+	}
+
+	if d.hint != nil {
+		if err := d.hint.write(encodeHint(r.hint(recordSize, offset), d.enc)); err != nil {
+			return 0, 0, err
+		}
 	}
 
-	// sync if durable
 	if d.syncOnWrite {
 		if err := d.f.Sync(); err != nil {
 			return 0, 0, err
 		}
+		if d.hint != nil {
+			if err := d.hint.sync(); err != nil {
+				return 0, 0, err
+			}
+		}
 	}
+	return recordSize, offset, nil
+}
 
-	// update file size. the previous size is the offset for the current record
-	offset = uint64(d.size)
-	size = len(encoded)
-	d.size += size
-
-	return size, offset, nil
+// read retrieves the value of record at a given offset. the checksum of the record is only verified when verify is set
+func (d *datafile) read(offset uint64, size int, verify bool) ([]byte, error) {
+	r, err := d.readEntry(offset, size, verify)
+	if err != nil {
+		return nil, err
+	}
+	return r.val, nil
 }
 
-// read retrieves the value of record at a given offset
-func (d *datafile) read(offset uint64, size int) ([]byte, error) {
+// readEntry retrieves the full record of known size at a given offset. the checksum of the record is only verified
+// when verify is set
+func (d *datafile) readEntry(offset uint64, size int, verify bool) (*record, error) {
+	if err := d.flushTo(int(offset) + size); err != nil {
+		return nil, err
+	}
+	if err := d.reopen(); err != nil {
+		return nil, err
+	}
+
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	// read full record and extract header
-	record := make([]byte, size)
-	n, err := d.f.ReadAt(record, int64(offset))
+	if size < headerLen {
+		return nil, ErrInvalidRecord
+	}
+
+	// read full record
+	data := make([]byte, size)
+	n, err := d.readAt(data, int64(offset))
 	if err != nil {
 		return nil, err
 	}
@@ -124,33 +344,25 @@ func (d *datafile) read(offset uint64, size int) ([]byte, error) {
 		return nil, ErrInvalidRecord
 	}
 
-	// decode header
-	header := record[:headerLen]
-
-	checksum := enc.Uint32(header[:crcLen])
-	keySize := int(enc.Uint32(header[crcLen+timestampLen : crcLen+timestampLen+keySizeLen]))
-	valSize := int(enc.Uint64(header[crcLen+timestampLen+keySizeLen:]))
-
-	// extract value
-	key := record[headerLen : headerLen+keySize]
-	val := record[headerLen+keySize : headerLen+keySize+valSize]
-
-	// verify checksum and retrieve data
-	if getChecksum(string(key), val) != checksum {
-		return nil, ErrInvalidRecord
-	}
-	return val, nil
+	return decodeRecord(data, d.enc, d.aead, verify)
 }
 
 // readRecord reads the full record from a given offset without knowing the record size.
 // this is useful for background merging. the record and total size is returned
 func (d *datafile) readRecord(offset uint64) (*record, int, error) {
+	if err := d.flushTo(d.bufferedSize()); err != nil {
+		return nil, 0, err
+	}
+	if err := d.reopen(); err != nil {
+		return nil, 0, err
+	}
+
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
 	// retrieve key and value size from header
 	header := make([]byte, headerLen)
-	n, err := d.f.ReadAt(header, int64(offset))
+	n, err := d.readAt(header, int64(offset))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -158,15 +370,20 @@ func (d *datafile) readRecord(offset uint64) (*record, int, error) {
 		return nil, 0, ErrInvalidRecord
 	}
 
-	checksum := enc.Uint32(header[:crcLen])
-	timestamp := int64(enc.Uint64(header[crcLen : crcLen+timestampLen]))
-	keySize := int(enc.Uint32(header[crcLen+timestampLen : crcLen+timestampLen+keySizeLen]))
-	valSize := int(enc.Uint64(header[crcLen+timestampLen+keySizeLen:]))
+	_, _, _, keySize, _, valSize := decodeHeader(header, d.enc)
 
-	// read full record
+	// reject sizes that run past the end of the file. this guards against reading garbage offsets
 	recordSize := headerLen + keySize + valSize
+	if keySize < 0 || valSize < 0 {
+		return nil, 0, ErrInvalidRecord
+	}
+	if int(offset)+recordSize > d.size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	// read full record
 	data := make([]byte, recordSize)
-	n, err = d.f.ReadAt(data, int64(offset))
+	n, err = d.readAt(data, int64(offset))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -174,47 +391,377 @@ func (d *datafile) readRecord(offset uint64) (*record, int, error) {
 		return nil, 0, ErrInvalidRecord
 	}
 
-	// extract value
-	key := data[headerLen : headerLen+keySize]
-	val := data[headerLen+keySize : headerLen+keySize+valSize]
+	// the size of a record that fails to decode is still returned so it can be skipped
+	r, err := decodeRecord(data, d.enc, d.aead, true)
+	if err != nil {
+		return nil, recordSize, err
+	}
+	return r, recordSize, nil
+}
+
+// valueReader streams the value of a record from its datafile. the checksum of the record is verified once the whole
+// value is read, and ErrInvalidChecksum is returned in place of io.EOF on a mismatch
+type valueReader struct {
+	d *datafile
+	// position of the next byte of the value and the end of the record
+	offset int64
+	end    int64
+	// checksum of the record read so far and the checksum stored in it
+	crc      hash.Hash32
+	checksum uint32
+}
+
+// openValue returns a reader over the value of the record of known size at a given offset. compressed and encrypted
+// values can only be decoded whole, so they are read into memory
+func (d *datafile) openValue(offset uint64, size int) (io.Reader, error) {
+	if err := d.flushTo(int(offset) + size); err != nil {
+		return nil, err
+	}
+	if err := d.reopen(); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	header := make([]byte, headerLen)
+	n, err := d.readAt(header, int64(offset))
+	if err != nil || n < headerLen {
+		d.mu.RUnlock()
+		return nil, ErrInvalidRecord
+	}
+	checksum, _, _, keySize, flags, valSize := decodeHeader(header, d.enc)
+	if keySize < 0 || valSize < 0 || headerLen+keySize+valSize != size {
+		d.mu.RUnlock()
+		return nil, ErrInvalidRecord
+	}
+	keySection := make([]byte, keySize)
+	n, err = d.readAt(keySection, int64(offset)+headerLen)
+	d.mu.RUnlock()
+	if (err != nil && err != io.EOF) || n < keySize {
+		return nil, ErrInvalidRecord
+	}
+
+	if flags&(compressedFlag|encryptedFlag) != 0 {
+		r, err := d.readEntry(offset, size, true)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(r.val), nil
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[crcLen:])
+	crc.Write(keySection)
+	return &valueReader{
+		d:        d,
+		offset:   int64(offset) + int64(headerLen+keySize),
+		end:      int64(offset) + int64(size),
+		crc:      crc,
+		checksum: checksum,
+	}, nil
+}
+
+func (v *valueReader) Read(p []byte) (int, error) {
+	if v.offset >= v.end {
+		if v.crc.Sum32() != v.checksum {
+			return 0, ErrInvalidChecksum
+		}
+		return 0, io.EOF
+	}
+	if err := v.d.reopen(); err != nil {
+		return 0, err
+	}
+
+	p = p[:min(int64(len(p)), v.end-v.offset)]
+	v.d.mu.RLock()
+	n, err := v.d.readAt(p, v.offset)
+	v.d.mu.RUnlock()
+	v.crc.Write(p[:n])
+	v.offset += int64(n)
+
+	// the record was cut short if the file ends before the value does
+	if err == io.EOF {
+		err = nil
+		if n < len(p) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
 
-	// verify checksum and retrieve data
-	if getChecksum(string(key), val) != checksum {
+// recordScanner reads the records of a datafile in order. records are parsed from chunks read ahead of them, so a
+// scan reads once per chunk rather than twice per record
+type recordScanner struct {
+	d *datafile
+	// offset of the next record
+	offset uint64
+	// size of the chunks read ahead. records are read separately when not positive
+	readAhead int
+	// chunk read ahead and its offset in the file
+	buf      []byte
+	bufStart uint64
+}
+
+// scan returns a scanner over the records of the datafile from the given offset
+func (d *datafile) scan(offset uint64, readAhead int) *recordScanner {
+	return &recordScanner{d: d, offset: offset, readAhead: readAhead}
+}
+
+// next returns the next record and its size. io.EOF is returned once the scan reaches the end of the file. a record
+// that fails to decode is returned with its size, and the scan continues after it
+func (s *recordScanner) next() (*record, int, error) {
+	if s.readAhead <= 0 {
+		r, size, err := s.d.readRecord(s.offset)
+		s.offset += uint64(size)
+		return r, size, err
+	}
+
+	header, err := s.bytes(headerLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, _, _, keySize, _, valSize := decodeHeader(header, s.d.enc)
+
+	// reject sizes that run past the end of the file. this guards against reading garbage offsets
+	recordSize := headerLen + keySize + valSize
+	if keySize < 0 || valSize < 0 {
 		return nil, 0, ErrInvalidRecord
 	}
-	return &record{
-		checksum:  checksum,
-		timestamp: timestamp,
-		keySize:   keySize,
-		valSize:   valSize,
-		key:       string(key),
-		val:       val,
-	}, recordSize, nil
+	if int(s.offset)+recordSize > s.d.bufferedSize() {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	data, err := s.bytes(recordSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// records outlive the chunk they were read from
+	r, err := decodeRecord(bytes.Clone(data), s.d.enc, s.d.aead, true)
+	s.offset += uint64(recordSize)
+	if err != nil {
+		return nil, recordSize, err
+	}
+	return r, recordSize, nil
+}
+
+// bytes returns n bytes from the offset of the next record, reading the next chunk when the current one does not
+// hold them
+func (s *recordScanner) bytes(n int) ([]byte, error) {
+	start := s.offset - s.bufStart
+	if s.offset >= s.bufStart && start+uint64(n) <= uint64(len(s.buf)) {
+		return s.buf[start : start+uint64(n)], nil
+	}
+
+	d := s.d
+	if err := d.flushTo(d.bufferedSize()); err != nil {
+		return nil, err
+	}
+	if err := d.reopen(); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	// chunks never extend past the end of the file
+	remaining := max(d.size-int(s.offset), 0)
+	buf := make([]byte, max(n, min(s.readAhead, remaining)))
+	read, err := d.readAt(buf, int64(s.offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// like a record read, a header cut short by the end of the file ends the scan
+	if read < n {
+		return nil, io.EOF
+	}
+	s.buf, s.bufStart = buf[:read], s.offset
+	return s.buf[:n], nil
+}
+
+// tail returns the bytes of the datafile from offset to the end of the file
+func (d *datafile) tail(offset uint64) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	buf := make([]byte, max(d.size-int(offset), 0))
+	n, err := d.readAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readAt reads len(p) bytes from the given offset, from the memory-mapped content when the file is mapped.
+// the caller must hold the read lock
+func (d *datafile) readAt(p []byte, offset int64) (int, error) {
+	if d.data == nil {
+		return d.f.ReadAt(p, offset)
+	}
+
+	if offset >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
-// sync flushes all buffered writes to disk in the specified interval
-func (d *datafile) sync() error {
-	if d.syncInterval <= 0 {
+// mmap maps the content of the file into memory so reads do not need a syscall. this is only safe once the file
+// is no longer appended to. files that cannot be mapped keep reading through the file
+func (d *datafile) mmap() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.f.(*os.File)
+	if !ok || d.data != nil || d.size == 0 {
 		return nil
 	}
-	if d.readOnly {
-		return ErrDatabaseReadOnly
+	if d.w != nil && d.w.Buffered() > 0 {
+		return nil
+	}
+
+	data, err := mmapFile(f, d.size)
+	if err != nil {
+		return err
+	}
+	d.data = data
+	return nil
+}
+
+// munmap releases the memory mapping of the file if any. the caller must hold the write lock
+func (d *datafile) munmap() error {
+	if d.data == nil {
+		return nil
+	}
+
+	err := munmapFile(d.data)
+	d.data = nil
+	return err
+}
+
+// reopen records a read of the file and reopens it if it was released while idle
+func (d *datafile) reopen() error {
+	d.lastAccess.Store(time.Now().UnixNano())
+
+	d.mu.RLock()
+	open := d.f != nil
+	d.mu.RUnlock()
+	if open {
+		return nil
 	}
 
-	ticker := time.NewTicker(d.syncInterval)
-	defer ticker.Stop()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	for range ticker.C {
-		d.mu.Lock()
+	// another reader may have reopened the file in the meantime
+	if d.f != nil {
+		return nil
+	}
+	f, err := os.Open(d.name)
+	if err != nil {
+		return err
+	}
+	d.f = f
+
+	if d.mapped {
+		data, err := mmapFile(f, d.size)
+		if err != nil {
+			d.logger.Warn("failed to mmap datafile, falling back to file reads", "datafile", d.name, "error", err)
+			return nil
+		}
+		d.data = data
+	}
+	return nil
+}
 
+// release closes the file and its memory mapping if it was not read since idleSince and no read is in progress.
+// it's reopened read-only on the next read, so this is only safe once the file is no longer appended to.
+// true is returned if the file was released
+func (d *datafile) release(idleSince time.Time) (bool, error) {
+	// holding the pin lock keeps new reads from pinning the file while it's released
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+
+	if d.pins > 0 || d.purging || d.lastAccess.Load() > idleSince.UnixNano() {
+		return false, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.f == nil {
+		return false, nil
+	}
+	if d.w != nil && d.w.Buffered() > 0 {
+		return false, nil
+	}
+
+	// a rotated datafile was opened for writing, so its content must reach the disk before it's closed
+	if !d.readOnly {
 		if err := d.f.Sync(); err != nil {
-			d.mu.Unlock()
-			return err
+			return false, err
 		}
+	}
 
-		d.mu.Unlock()
+	d.mapped = d.data != nil
+	if err := d.munmap(); err != nil {
+		return false, err
 	}
-	return nil
+	if err := d.f.Close(); err != nil {
+		return false, err
+	}
+	d.f = nil
+	d.w = nil
+	d.readOnly = true
+	return true, nil
+}
+
+// isOpen reports whether the file handle is open
+func (d *datafile) isOpen() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.f != nil
+}
+
+// bufferedSize returns the current size of the file including buffered records
+func (d *datafile) bufferedSize() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.size
+}
+
+// flushTo writes buffered records to the file if any of them lie before end, so reads up to end can be served
+// from the file
+func (d *datafile) flushTo(end int) error {
+	if d.w == nil {
+		return nil
+	}
+
+	// the first buffered byte is at the flushed size of the file
+	d.mu.RLock()
+	pending := end > d.size-d.w.Buffered()
+	d.mu.RUnlock()
+	if !pending {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.w.Flush()
+}
+
+// flush writes all buffered records to the file
+func (d *datafile) flush() error {
+	if d.w == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.w.Flush()
 }
 
 // persist flushes all buffered writes to disk instantly
@@ -226,9 +773,17 @@ func (d *datafile) persist() error {
 		return ErrDatabaseReadOnly
 	}
 
+	if d.w != nil {
+		if err := d.w.Flush(); err != nil {
+			return err
+		}
+	}
 	if err := d.f.Sync(); err != nil {
 		return err
 	}
+	if d.hint != nil {
+		return d.hint.sync()
+	}
 	return nil
 }
 
@@ -237,8 +792,27 @@ func (d *datafile) close() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// sync only when file is opened for writing
+	if err := d.munmap(); err != nil {
+		return err
+	}
+	if d.hint != nil {
+		if err := d.hint.close(); err != nil {
+			return err
+		}
+	}
+
+	// a released file has nothing left to close
+	if d.f == nil {
+		return nil
+	}
+
+	// flush and sync only when file is opened for writing
 	if !d.readOnly {
+		if d.w != nil {
+			if err := d.w.Flush(); err != nil {
+				return err
+			}
+		}
 		if err := d.f.Sync(); err != nil {
 			return err
 		}
@@ -247,35 +821,120 @@ func (d *datafile) close() error {
 	return d.f.Close()
 }
 
+// pin marks a read in progress so the file is not removed until the read completes. false is returned if
+// the file is already being purged and must not be read
+func (d *datafile) pin() bool {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+
+	if d.purging {
+		return false
+	}
+	d.pins++
+	return true
+}
+
+// unpin completes a read started with pin, removing the file if it was purged during the read
+func (d *datafile) unpin() {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+
+	d.pins--
+	if d.pins == 0 && d.purging {
+		if err := d.remove(); err != nil {
+			d.logger.Error("failed to remove purged datafile", "datafile", d.name, "error", err)
+		}
+	}
+}
+
 // purge closes the current datafile and removes it from disk.
-// this should be called after all references to the current datafile are cleared
+// this should be called after all references to the current datafile are cleared. if reads are still in
+// progress the file is closed once the last of them completes
 func (d *datafile) purge() error {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+
+	d.purging = true
+	if d.pins == 0 {
+		return d.remove()
+	}
+
+	// the pending reads keep going through the open file once its path is gone. platforms that cannot remove
+	// an open file remove it once it's closed instead
+	if err := d.reopen(); err != nil {
+		return err
+	}
+	if err := os.Remove(d.name); err != nil {
+		d.logger.Warn("failed to unlink purged datafile, removing it after pending reads", "datafile", d.name, "error", err)
+		return nil
+	}
+	d.unlinked = true
+	return nil
+}
+
+// rename moves the datafile to the given path
+func (d *datafile) rename(name string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if err := d.f.Close(); err != nil {
+	if err := os.Rename(d.name, name); err != nil {
 		return err
 	}
+	d.name = name
+	return nil
+}
+
+// remove closes the datafile and deletes it from disk. the caller must hold the pin lock
+func (d *datafile) remove() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return os.Remove(d.f.Name())
+	if err := d.munmap(); err != nil {
+		return err
+	}
+	if d.hint != nil {
+		if err := d.hint.close(); err != nil {
+			return err
+		}
+	}
+	if d.f != nil {
+		if err := d.f.Close(); err != nil {
+			return err
+		}
+	}
+
+	if d.unlinked {
+		return nil
+	}
+	return os.Remove(d.name)
 }
 
 // record is a disk representation of the key-value record with its metadata
 type record struct {
 	checksum  uint32
 	timestamp int64
-	keySize   int
-	valSize   int
-	key       string
-	val       []byte
+	// unix timestamp in milliseconds after which the record is no longer visible. 0 if it never expires
+	expiry  int64
+	keySize int
+	valSize int
+	key     string
+	val     []byte
+	// whether the record stores the hash of its key instead of the key. key is empty when decoded from disk
+	keyHashed bool
+	keyHash   uint64
+	// whether val holds the content hash of a shared value, and whether the record holds a shared value keyed by its
+	// content hash
+	valueRef bool
+	shared   bool
+	// whether the value is stored compressed and encrypted. val always holds the value as written
+	compressed bool
+	encrypted  bool
 }
 
-func newRecord(key string, val []byte) *record {
-	checksum := getChecksum(key, val)
-
+func newRecord(key string, val []byte, expiry int64) *record {
 	return &record{
-		checksum:  checksum,
 		timestamp: time.Now().Unix(),
+		expiry:    expiry,
 		keySize:   len(key),
 		valSize:   len(val),
 		key:       key,
@@ -283,49 +942,194 @@ func newRecord(key string, val []byte) *record {
 	}
 }
 
-// encode returns a little-endian encoded format of the record as specified in the documentation.
-func (r *record) encode() ([]byte, error) {
-	// write header: checksum, timestamp, key size, val size to buffer
+// newValueRefRecord creates a record of key referencing the shared value with the given content hash
+func newValueRefRecord(key string, valueHash string, expiry int64) *record {
+	r := newRecord(key, []byte(valueHash), expiry)
+	r.valueRef = true
+	return r
+}
+
+// newSharedValueRecord creates the record of a shared value keyed by its content hash
+func newSharedValueRecord(valueHash string, val []byte) *record {
+	r := newRecord(valueHash, val, 0)
+	r.shared = true
+	return r
+}
+
+// hint returns the hint entry of the record once it's written with the given size at the given position
+func (r *record) hint(recordSize int, recordPosition uint64) *hintRecord {
+	h := &hintRecord{
+		key:            r.key,
+		recordSize:     recordSize,
+		recordPosition: recordPosition,
+		expiry:         r.expiry,
+		keyHashed:      r.keyHashed,
+		shared:         r.shared,
+		compressed:     r.compressed,
+		encrypted:      r.encrypted,
+		valSize:        len(r.val),
+	}
+	if r.valueRef {
+		h.valueHash = string(r.val)
+	}
+	return h
+}
+
+// encode returns the record encoded in the given byte order as specified in the documentation.
+// the checksum is computed over the encoded bytes following it and recorded on the record.
+// the key is replaced by its hash when hashKey is set, except for shared values which are keyed by their content hash.
+// the value is compressed with the given algorithm and then encrypted when aead is set, unless it holds the content hash
+// of a shared value
+func (r *record) encode(hashKey bool, compression Compression, aead cipher.AEAD, enc binary.ByteOrder) ([]byte, error) {
+	keySection, flags := r.keySection(hashKey, enc)
+	val, compressed := r.val, false
+	if !r.valueRef {
+		var err error
+		if val, compressed, err = compressValue(compression, r.val); err != nil {
+			return nil, err
+		}
+	}
+	r.compressed = compressed
+	if compressed {
+		flags |= compressedFlag
+	}
+	// empty values are left in plaintext so tombstones stay recognizable by their size
+	r.encrypted = aead != nil && !r.valueRef && len(val) > 0
+	if r.encrypted {
+		var err error
+		if val, err = encryptValue(aead, val, keySection); err != nil {
+			return nil, err
+		}
+		flags |= encryptedFlag
+	}
+
+	data := append(r.encodeHead(keySection, flags, len(val), enc), val...)
+	r.checksum = getChecksum(data[crcLen:])
+	enc.PutUint32(data[:crcLen], r.checksum)
+
+	return data, nil
+}
+
+// keySection returns the key section of the record encoded in the given byte order and its flags. the key is replaced
+// by its hash when hashKey is set, except for shared values which are keyed by their content hash
+func (r *record) keySection(hashKey bool, enc binary.ByteOrder) ([]byte, uint32) {
+	if !hashKey || r.shared {
+		return []byte(r.key), 0
+	}
+	r.keyHashed = true
+	r.keyHash = getKeyHash(r.key)
+	r.keySize = keyHashLen
+	keySection := make([]byte, keyHashLen)
+	enc.PutUint64(keySection, r.keyHash)
+	return keySection, keyHashedFlag
+}
+
+// encodeHead returns the header and key section of the record encoded in the given byte order, leaving the checksum
+// zeroed. flags holds the flags of the key and value sections, and valSize is the length of the value section
+func (r *record) encodeHead(keySection []byte, flags uint32, valSize int, enc binary.ByteOrder) []byte {
+	keySize := uint32(len(keySection)) | flags
+	if r.valueRef {
+		keySize |= valueRefFlag
+	}
+	if r.shared {
+		keySize |= sharedValueFlag
+	}
+
+	// write header: checksum placeholder, timestamp, expiry, key size, val size to buffer
 	var buf bytes.Buffer
 
-	binary.Write(&buf, enc, r.checksum)
+	binary.Write(&buf, enc, uint32(0))
 	binary.Write(&buf, enc, r.timestamp)
-	binary.Write(&buf, enc, uint32(r.keySize))
-	binary.Write(&buf, enc, uint64(r.valSize))
+	binary.Write(&buf, enc, r.expiry)
+	binary.Write(&buf, enc, keySize)
+	binary.Write(&buf, enc, uint64(valSize))
 
-	// write key and val
-	buf.WriteString(r.key)
-	buf.Write(r.val)
+	buf.Write(keySection)
+	return buf.Bytes()
+}
 
-	return buf.Bytes(), nil
+// decodeHeader extracts the fixed-size header fields of a record encoded in the given byte order. keySize is the length of the key section
+// and flags holds the flags stored alongside it
+func decodeHeader(header []byte, enc binary.ByteOrder) (checksum uint32, timestamp, expiry int64, keySize int, flags uint32, valSize int) {
+	pos := 0
+	checksum = enc.Uint32(header[pos : pos+crcLen])
+	pos += crcLen
+	timestamp = int64(enc.Uint64(header[pos : pos+timestampLen]))
+	pos += timestampLen
+	expiry = int64(enc.Uint64(header[pos : pos+expiryLen]))
+	pos += expiryLen
+	rawKeySize := enc.Uint32(header[pos : pos+keySizeLen])
+	keySize = int(rawKeySize &^ keyFlags)
+	flags = rawKeySize & keyFlags
+	pos += keySizeLen
+	valSize = int(enc.Uint64(header[pos : pos+valSizeLen]))
+	return checksum, timestamp, expiry, keySize, flags, valSize
 }
 
-// decodeRecord attempts to decode the binary data into the record
-func decodeRecord(data []byte) (*record, error) {
+// decodeRecord attempts to decode the binary data encoded in the given byte order into the record and verifies its
+// checksum when verify is set. encrypted values are decrypted with aead, and compressed values are decompressed
+func decodeRecord(data []byte, enc binary.ByteOrder, aead cipher.AEAD, verify bool) (*record, error) {
 	if len(data) < headerLen {
 		return nil, ErrInvalidRecord
 	}
 
-	// extract headers: checksum, timestamp, key size, val size
-	checksum := enc.Uint32(data[:crcLen])
-	timestamp := int64(enc.Uint64(data[crcLen : crcLen+timestampLen]))
-	keySize := int(enc.Uint32(data[crcLen+timestampLen : crcLen+timestampLen+keySizeLen]))
-	valSize := int(enc.Uint64(data[crcLen+timestampLen+keySizeLen : crcLen+timestampLen+keySizeLen+valSizeLen]))
-
-	if len(data) < headerLen+keySize+valSize {
+	checksum, timestamp, expiry, keySize, flags, valSize := decodeHeader(data, enc)
+	if keySize < 0 || valSize < 0 || len(data) < headerLen+keySize+valSize {
+		return nil, ErrInvalidRecord
+	}
+	keyHashed, valueRef, shared := flags&keyHashedFlag != 0, flags&valueRefFlag != 0, flags&sharedValueFlag != 0
+	if (keyHashed && keySize != keyHashLen) || (valueRef && valSize != valueHashLen) || (shared && keySize != valueHashLen) {
 		return nil, ErrInvalidRecord
 	}
 
-	// extract key and value
-	key := string(data[headerLen : headerLen+keySize])
-	val := data[headerLen+keySize : headerLen+keySize+valSize]
+	// verify checksum over everything following it
+	if verify && getChecksum(data[crcLen:headerLen+keySize+valSize]) != checksum {
+		return nil, ErrInvalidChecksum
+	}
 
-	return &record{
+	// extract key and value
+	r := &record{
 		checksum:  checksum,
 		timestamp: timestamp,
+		expiry:    expiry,
 		keySize:   keySize,
 		valSize:   valSize,
-		key:       key,
-		val:       val,
-	}, nil
+		val:       data[headerLen+keySize : headerLen+keySize+valSize],
+		keyHashed: keyHashed,
+		valueRef:  valueRef,
+		shared:    shared,
+	}
+	if flags&encryptedFlag != 0 {
+		val, err := decryptValue(aead, r.val, data[headerLen:headerLen+keySize])
+		if err != nil {
+			return nil, err
+		}
+		r.val, r.valSize, r.encrypted = val, len(val), true
+	}
+	if flags&compressedFlag != 0 {
+		val, err := decompressValue(r.val)
+		if err != nil {
+			return nil, err
+		}
+		r.val, r.valSize, r.compressed = val, len(val), true
+	}
+	if keyHashed {
+		r.keyHash = enc.Uint64(data[headerLen : headerLen+keySize])
+	} else {
+		r.key = string(data[headerLen : headerLen+keySize])
+	}
+	return r, nil
+}
+
+// hasKey reports whether the record belongs to key, comparing key hashes when the record stores only the hash
+func (r *record) hasKey(key string) bool {
+	if r.keyHashed {
+		return r.keyHash == getKeyHash(key)
+	}
+	return r.key == key
+}
+
+// expired reports whether a record with the given expiry is no longer visible at the given time in milliseconds
+func expired(expiry int64, now int64) bool {
+	return expiry > 0 && expiry <= now
 }
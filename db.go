@@ -1,8 +1,17 @@
 package beck
 
 import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,7 +26,49 @@ type BeckDB struct {
 
 	activeIndex int
 	cfg         *Config
-	mu          sync.RWMutex
+	// byte order of the datafiles, settled by the manifest
+	enc binary.ByteOrder
+	// cipher values are encrypted with. nil unless an encryption key is configured
+	aead cipher.AEAD
+	mu   sync.RWMutex
+	// writeMu serializes all mutations. puts on the concurrent write path hold only this lock
+	// so that reads are not blocked while the record is written to disk
+	writeMu sync.Mutex
+	// mergeMu serializes merges, which run without holding the db lock. merging is set while a merge runs
+	mergeMu sync.Mutex
+	merging atomic.Bool
+
+	// puts waiting to be coalesced into a single write and whether a leader is currently writing them
+	writeQueue []*writeRequest
+	flushing   bool
+	queueMu    sync.Mutex
+
+	// number of reads served and the number of reads whose record on disk belonged to another key
+	reads          atomic.Uint64
+	readMismatches atomic.Uint64
+
+	// most recent operations that exceeded the slow operation threshold, which is read on every operation and can
+	// be changed while the database is open
+	slowLog         *slowLog
+	slowOpThreshold atomic.Int64
+	// recently read values. nil when caching is disabled
+	cache *valueCache
+	// logger of background events and errors, discarding them unless one is configured
+	logger *slog.Logger
+	// counters of the operations served
+	metrics metrics
+
+	// time the database was opened and of the last completed merge. lastMerge is zero until the first merge
+	opened    time.Time
+	lastMerge time.Time
+
+	// signals the background sync that the sync interval was changed
+	syncIntervalSet chan struct{}
+
+	// errors of background workers, and a channel closed on Close to stop them
+	errCh     chan error
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // Open a new or existing beck datastore with additional options.
@@ -26,132 +77,746 @@ type BeckDB struct {
 // The directory must be readable and writable by this process, and
 // only one process may open a Bitcask with read write at a time.
 func Open(cfg *Config) (*BeckDB, error) {
-	db := &BeckDB{oldDataFiles: make(map[int]*datafile)}
+	db := &BeckDB{}
 	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
 	db.cfg = cfg
+	db.logger = cfg.Logger
+	if db.logger == nil {
+		db.logger = discardLogger
+	}
+	if cfg.EncryptionKey != nil {
+		aead, err := newAEAD(cfg.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		db.aead = aead
+	}
+	db.slowLog = newSlowLog(cfg.SlowLogSize)
+	db.slowOpThreshold.Store(int64(cfg.SlowOpThreshold))
+	db.syncIntervalSet = make(chan struct{}, 1)
+	db.cache = newValueCache(cfg.CacheSize)
+	db.errCh = make(chan error, errorChSize)
+	db.closed = make(chan struct{})
+	db.opened = time.Now()
+
+	// finish any dataset swap interrupted by a crash before loading the datafiles
+	if err := recoverSwap(cfg.DataDir); err != nil {
+		return nil, err
+	}
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	// release cold datafiles
+	if cfg.IdleFileTimeout > 0 {
+		go db.releaseIdleDatafiles()
+	}
+	if cfg.ReadOnly {
+		return db, nil
+	}
+
+	// TODO: setup a lockfile to allow only a single writer to update db if multiple processes open it in rw mode.
+	// this will prevent database corruption
+
+	// start without the dead records left behind before the last shutdown
+	db.mu.RLock()
+	ratio := db.reclaimableRatio()
+	db.mu.RUnlock()
+	if cfg.CompactOnOpen > 0 && ratio > cfg.CompactOnOpen {
+		if err := db.Compact(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to compact on open: %w", err)
+		}
+	}
+
+	// periodically flush buffer if user background sync. the sync interval can be set later, so the worker waits
+	// for one while it's zero
+	if !cfg.SyncOnWrite {
+		go db.syncPeriodically()
+	}
 
-	// setup keydir
+	// monitor active datafile and merge old datafiles
+	go db.Merge()
+	go db.trackActiveDatafile()
+	if cfg.ExpirySweepInterval > 0 {
+		go db.sweepExpiredKeys()
+	}
+
+	return db, nil
+}
+
+// load builds the keydir from the datafiles in the data directory and opens a fresh active datafile.
+// the caller must hold the db lock or have exclusive access to the db
+func (db *BeckDB) load() error {
+	cleared, err := db.loadManifest()
+	if err != nil {
+		return err
+	}
+	if len(cleared) > 0 && !db.cfg.ReadOnly {
+		if err := db.removeCleared(cleared); err != nil {
+			return err
+		}
+	}
+
+	// setup keydir and old datafiles. cached values may belong to a previous dataset
 	db.keyDir = NewKeyDir()
+	db.cache.purge()
+	db.oldDataFiles = make(map[int]*datafile)
+
+	// hint files left incomplete by an interrupted rotation and values left spooled by an interrupted PutReader
+	if !db.cfg.ReadOnly {
+		for _, pattern := range []string{"*" + hintFileExt + tempFileExt, "*" + streamFileExt + tempFileExt} {
+			leftovers, err := filepath.Glob(filepath.Join(db.cfg.DataDir, pattern))
+			if err != nil {
+				return err
+			}
+			for _, path := range leftovers {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("failed to remove incomplete file: %w", err)
+				}
+			}
+		}
+	}
 
 	// get all existing datafiles
 	recentFileID := 0
-	datafiles, err := getDatafiles(cfg.DataDir)
+	datafiles, err := getDatafiles(db.cfg.DataDir)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for idx, dfPath := range datafiles {
+	for _, dfPath := range datafiles {
 		fileID, err := getFileID(dfPath)
 		if err != nil {
 			continue
 		}
+		// the active datafile follows every datafile on disk, including cleared ones that could not be removed
+		recentFileID = max(recentFileID, fileID)
+		if slices.Contains(cleared, fileID) {
+			continue
+		}
 
-		// replay data from hint file/datafile into keydir. fallback is the datafile
-		err = db.replayFromHintFile(getHintFilePath(cfg.DataDir, fileID), fileID)
-		if err != nil {
-			// fallback on err
-			err = db.replayFromDataFile(dfPath, fileID)
+		// replay data from hint file into keydir, then any records appended to the datafile after the last hinted
+		// one. the datafile is replayed in full when the hint file is missing or corrupt
+		hintedEnd, err := db.replayFromHintFile(getHintFilePath(db.cfg.DataDir, fileID), dfPath, fileID)
+		unhinted := err != nil
+		if unhinted {
+			err = db.replayFromDataFile(dfPath, fileID, 0, false)
 		} else {
-			err = db.replayFromDataFile(dfPath, fileID)
+			err = db.replayFromDataFile(dfPath, fileID, hintedEnd, true)
 		}
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to replay data into keydir from datafile %v: %w", dfPath, err)
+			return fmt.Errorf("failed to replay data into keydir from datafile %v: %w", dfPath, err)
 		}
 
 		// now load datafile
-		df, err := NewDatafile(dfPath, true, false, 0)
+		df, err := NewDatafile(dfPath, true, false, 0, db.enc)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open datafile, path=(%s): %w", dfPath, err)
+			return fmt.Errorf("failed to open datafile, path=(%s): %w", dfPath, err)
+		}
+		df.aead = db.aead
+		df.logger = db.logger
+
+		// datafiles retired without a hint file, such as the active datafile of the previous run, get one for the
+		// next open
+		if unhinted && !db.cfg.ReadOnly {
+			if err := db.writeHintFile(df, fileID); err != nil {
+				db.logger.Warn("failed to write hint file", "datafile", dfPath, "error", err)
+			}
 		}
 
-		db.mu.Lock()
+		db.mapDatafile(df)
 		db.oldDataFiles[fileID] = df
-		db.mu.Unlock()
+	}
 
-		// update most recent datafile to last entry
-		if idx == len(datafiles)-1 {
-			recentFileID = fileID
-		}
+	// shared values of keys deleted before the replay are no longer referenced
+	db.keyDir.dropUnreferencedValues()
+
+	// a read-only database serves every record from the old datafiles and never creates an active datafile
+	db.activeIndex = nextActiveFileID(recentFileID)
+	if db.cfg.ReadOnly {
+		return nil
 	}
 
 	// setup active file
-	db.activeIndex = recentFileID + 1
-	activeDfPath := getDatafilePath(cfg.DataDir, db.activeIndex)
-	db.activeDatafile, err = NewDatafile(activeDfPath, false, cfg.SyncOnWrite, cfg.SyncInterval)
+	db.activeDatafile, err = db.openActiveDatafile(db.activeIndex)
 	if err != nil {
-		return nil, fmt.Errorf("failed to setup active datafile, path=(%s): %w", activeDfPath, err)
+		return fmt.Errorf("failed to setup active datafile, path=(%s): %w", getDatafilePath(db.cfg.DataDir, db.activeIndex), err)
 	}
+	return nil
+}
 
-	// TODO: setup a lockfile to allow only a single writer to update db if multiple processes open it in rw mode.
-	// this will prevent database corruption
+// openActiveDatafile opens a datafile for appending. when keys are kept only in hint files, its hint file is opened
+// alongside so every record is also recorded there
+func (db *BeckDB) openActiveDatafile(fileID int) (*datafile, error) {
+	df, err := NewDatafile(getDatafilePath(db.cfg.DataDir, fileID), false, db.cfg.SyncOnWrite, db.writeBufferSize(), db.enc)
+	if err != nil {
+		return nil, err
+	}
+	df.compression = db.cfg.Compression
+	df.aead = db.aead
+	df.logger = db.logger
+	df.written = &db.metrics.bytesWritten
+	if !db.cfg.HintOnlyKeys {
+		return df, nil
+	}
 
-	// periodically flush buffer if user background sync
-	if !cfg.ReadOnly && !cfg.SyncOnWrite {
-		go db.Sync()
+	df.hashKeys = true
+	df.hint, err = NewHintFile(getHintFilePath(db.cfg.DataDir, fileID), false, db.enc)
+	if err != nil {
+		df.purge()
+		return nil, err
 	}
+	return df, nil
+}
 
-	// monitor active datafile and merge old datafiles
-	go db.Merge()
-	go db.trackActiveDatafile()
+// mapDatafile memory-maps an old datafile when configured. files that cannot be mapped are read through the file
+func (db *BeckDB) mapDatafile(df *datafile) {
+	if !db.cfg.UseMmap {
+		return
+	}
+	if err := df.mmap(); err != nil {
+		db.logger.Warn("failed to mmap datafile, falling back to file reads", "datafile", df.f.Name(), "error", err)
+	}
+}
 
-	return db, nil
+// writeBufferSize returns the size of the write buffer of the active datafile. writes are only buffered when
+// they are not synced on every write
+func (db *BeckDB) writeBufferSize() int {
+	if db.cfg.SyncOnWrite || db.cfg.WriteBufferSize < 0 {
+		return 0
+	}
+	return db.cfg.WriteBufferSize
 }
 
 // Get retrieves a value by key from a the datastore. An error is returned if the key is not found
 func (db *BeckDB) Get(key string) ([]byte, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	defer db.trackSlow("get", key, time.Now())
+	db.metrics.gets.Add(1)
 
-	// retrieve header from keydir
-	header := db.keyDir.get(key)
-	if header == nil {
-		return nil, ErrKeyNotFound
-	}
+	// reads only share the lock, so concurrent readers proceed in parallel
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	// retrieve value from datadir
-	var df *datafile
+	return db.get(key)
+}
 
-	if header.fileID == db.activeIndex {
-		df = db.activeDatafile
-	} else {
-		df = db.oldDataFiles[header.fileID]
+// get retrieves a value by key. the caller must hold at least the read lock
+func (db *BeckDB) get(key string) ([]byte, error) {
+	header, df, err := db.lookup(key)
+	if err != nil {
+		return nil, err
 	}
+	defer df.unpin()
 
-	if df == nil {
-		return nil, ErrInvalidKey
+	val, ok := db.cache.get(key, header)
+	db.cacheLookup(ok)
+	if ok {
+		return val, nil
 	}
 
-	val, err := df.read(header.recordPosition, header.recordSize)
+	// every nth read additionally confirms that the record on disk belongs to the requested key
+	if n := db.cfg.ReadVerifyEveryN; n > 0 && db.reads.Add(1)%uint64(n) == 0 {
+		r, err := df.readEntry(header.recordPosition, header.recordSize, true)
+		if err != nil {
+			return nil, err
+		}
+		if !r.hasKey(key) && !(r.shared && r.key == header.valueHash) {
+			db.readMismatches.Add(1)
+			db.logger.Error("read verification: key points at the record of another key", "key", key, "recordKey", r.key,
+				"fileID", header.fileID, "offset", header.recordPosition)
+			return nil, ErrKeyMismatch
+		}
+		db.metrics.bytesRead.Add(uint64(header.recordSize))
+		db.cache.add(key, header, r.val)
+		return r.val, nil
+	}
+
+	val, err = df.read(header.recordPosition, header.recordSize, !db.cfg.SkipVerifyOnRead)
 	if err != nil {
 		return nil, err
 	}
+	db.metrics.bytesRead.Add(uint64(header.recordSize))
+	db.cache.add(key, header, val)
 	return val, nil
 }
 
+// lookup retrieves the keydir header of key and pins the datafile holding its record so the file is not removed
+// by a merge while it is read. a file already being purged had its records moved, so the lookup is retried against
+// the updated keydir. the header of the shared value is returned for keys referencing one. the caller must unpin
+// the returned datafile
+func (db *BeckDB) lookup(key string) (*header, *datafile, error) {
+	for range maxLookupAttempts {
+		// retrieve header from keydir
+		header := db.keyDir.get(key)
+		if header == nil {
+			return nil, nil, ErrKeyNotFound
+		}
+		if header.valueHash != "" {
+			if header = db.keyDir.value(header.valueHash); header == nil {
+				return nil, nil, ErrInvalidKey
+			}
+		}
+
+		// retrieve value from datadir
+		var df *datafile
+
+		if header.fileID == db.activeIndex {
+			df = db.activeDatafile
+		} else {
+			df = db.oldDataFiles[header.fileID]
+		}
+
+		if df == nil {
+			return nil, nil, ErrInvalidKey
+		}
+		if df.pin() {
+			return header, df, nil
+		}
+	}
+	return nil, nil, ErrInvalidKey
+}
+
 // Put stores a key and value to the datastore. It replaces the value if it already exists
 func (db *BeckDB) Put(key string, val []byte) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	defer db.trackSlow("put", key, time.Now())
 
-	if err := validateEntry(key, val); err != nil {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	if err := db.validateEntry(key, val); err != nil {
 		return err
 	}
-	// append to datastore then write to keydir
-	size, offset, err := db.activeDatafile.append(key, val)
+	if db.cfg.CoalesceWrites {
+		return db.putCoalesced(key, val)
+	}
+
+	// on the concurrent write path, the active datafile can only be swapped by writers so holding the write lock
+	// is enough. the keydir is only updated after the record is on disk so readers never see a partial record
+	if db.cfg.ConcurrentWrites {
+		db.writeMu.Lock()
+		defer db.writeMu.Unlock()
+	} else {
+		db.lock()
+		defer db.unlock()
+	}
+
+	return db.put(key, val, 0)
+}
+
+// PutWithTTL stores a key and value that expires after the given ttl. Expired keys are treated as missing
+// and are reclaimed by the next merge. It replaces the value and expiry if the key already exists
+func (db *BeckDB) PutWithTTL(key string, val []byte, ttl time.Duration) error {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	if err := db.validateEntry(key, val); err != nil {
+		return err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	return db.put(key, val, time.Now().Add(ttl).UnixMilli())
+}
+
+// put appends the key-value pair to the active datafile then records it in the keydir. expiry is a unix timestamp
+// in milliseconds, 0 if the key never expires. the entry must already be validated and the caller must hold the write lock
+func (db *BeckDB) put(key string, val []byte, expiry int64) error {
+	if db.cfg.DedupValues && len(val) > valueHashLen {
+		return db.putShared(key, val, expiry)
+	}
+
+	size, offset, err := db.activeDatafile.append(newRecord(key, val, expiry))
 	if err != nil {
 		return err
 	}
 
-	db.keyDir.put(key, db.activeIndex, size, offset)
+	db.keyDir.put(key, db.activeIndex, size, len(val), offset, expiry)
+	db.cache.remove(key)
+	db.metrics.puts.Add(1)
 	return nil
 }
 
+// GetSet stores a key and value and returns the value it replaced. A nil value is returned if the key did not exist.
+// The read and the write happen under a single lock acquisition
+func (db *BeckDB) GetSet(key string, val []byte) ([]byte, error) {
+	if db.cfg.ReadOnly {
+		return nil, ErrDatabaseReadOnly
+	}
+	if err := db.validateEntry(key, val); err != nil {
+		return nil, err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	old, err := db.get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, err
+	}
+	if err := db.put(key, val, 0); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// PutIfAbsent stores a key and value only if the key does not exist yet and reports whether it was written.
+// The existence check and the write happen under a single lock acquisition
+func (db *BeckDB) PutIfAbsent(key string, val []byte) (bool, error) {
+	if db.cfg.ReadOnly {
+		return false, ErrDatabaseReadOnly
+	}
+	if err := db.validateEntry(key, val); err != nil {
+		return false, err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	if db.keyDir.get(key) != nil {
+		return false, nil
+	}
+	if err := db.put(key, val, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Rename moves the value stored at oldKey to newKey, replacing any value stored at newKey. The expiry of oldKey is
+// kept. The new record and the tombstone of oldKey are appended with a single write under one lock acquisition, so
+// the key is never visible under both names. An error is returned if oldKey is not found
+func (db *BeckDB) Rename(oldKey, newKey string) error {
+	_, err := db.rename(oldKey, newKey, false)
+	return err
+}
+
+// RenameIfAbsent moves the value stored at oldKey to newKey only if newKey does not exist yet and reports whether it
+// was moved. An error is returned if oldKey is not found
+func (db *BeckDB) RenameIfAbsent(oldKey, newKey string) (bool, error) {
+	return db.rename(oldKey, newKey, true)
+}
+
+// rename implements Rename and RenameIfAbsent. with ifAbsent, nothing is written if newKey exists
+func (db *BeckDB) rename(oldKey, newKey string, ifAbsent bool) (bool, error) {
+	if db.cfg.ReadOnly {
+		return false, ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	header := db.keyDir.get(oldKey)
+	if header == nil {
+		return false, ErrKeyNotFound
+	}
+	expiry := header.expiry
+	val, err := db.get(oldKey)
+	if err != nil {
+		return false, err
+	}
+	if err := db.validateEntry(newKey, val); err != nil {
+		return false, err
+	}
+
+	if db.keyDir.get(newKey) != nil && (ifAbsent || oldKey == newKey) {
+		return false, nil
+	}
+
+	records := []*record{newRecord(newKey, val, expiry), newRecord(oldKey, tombstoneVal, 0)}
+	sizes, offsets, err := db.activeDatafile.appendBatch(records)
+	if err != nil {
+		return false, err
+	}
+
+	db.keyDir.put(newKey, db.activeIndex, sizes[0], len(val), offsets[0], expiry)
+	db.keyDir.delete(oldKey)
+	db.keyDir.markDead(db.activeIndex, sizes[1])
+	db.cache.remove(newKey)
+	db.cache.remove(oldKey)
+	db.metrics.puts.Add(1)
+	db.metrics.deletes.Add(1)
+	return true, nil
+}
+
+// Copy stores the value and expiry of src under dst and reports whether it was copied. An existing dst is only
+// overwritten if replace is set, and a key is never copied onto itself. An error is returned if src is not found
+func (db *BeckDB) Copy(src, dst string, replace bool) (bool, error) {
+	if db.cfg.ReadOnly {
+		return false, ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	header := db.keyDir.get(src)
+	if header == nil {
+		return false, ErrKeyNotFound
+	}
+	expiry := header.expiry
+	val, err := db.get(src)
+	if err != nil {
+		return false, err
+	}
+	if err := db.validateEntry(dst, val); err != nil {
+		return false, err
+	}
+
+	if src == dst || (!replace && db.keyDir.get(dst) != nil) {
+		return false, nil
+	}
+	if err := db.put(dst, val, expiry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Increment adds delta to the base-10 integer stored at key and returns the new value. A missing key is treated
+// as 0. The read-modify-write happens under the db lock so concurrent increments are never lost.
+// ErrValueNotInteger is returned if the stored value is not an integer or the result would overflow
+func (db *BeckDB) Increment(key string, delta int64) (int64, error) {
+	if db.cfg.ReadOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	// the expiry of an existing key is kept
+	var cur, expiry int64
+	if header := db.keyDir.get(key); header != nil {
+		expiry = header.expiry
+	}
+	val, err := db.get(key)
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+	case err != nil:
+		return 0, err
+	default:
+		cur, err = strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return 0, ErrValueNotInteger
+		}
+	}
+
+	// reject overflow in either direction
+	next := cur + delta
+	if (delta > 0 && next < cur) || (delta < 0 && next > cur) {
+		return 0, ErrValueNotInteger
+	}
+
+	newVal := []byte(strconv.FormatInt(next, 10))
+	if err := db.validateEntry(key, newVal); err != nil {
+		return 0, err
+	}
+	if err := db.put(key, newVal, expiry); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// Append adds suffix to the end of the value stored at key and returns the length of the new value. A missing key
+// is created with suffix as its value. The read-modify-write happens under the db lock and the expiry is kept
+func (db *BeckDB) Append(key string, suffix []byte) (int, error) {
+	if db.cfg.ReadOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	var expiry int64
+	if header := db.keyDir.get(key); header != nil {
+		expiry = header.expiry
+	}
+	val, err := db.get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return 0, err
+	}
+
+	newVal := make([]byte, 0, len(val)+len(suffix))
+	newVal = append(append(newVal, val...), suffix...)
+	if err := db.validateEntry(key, newVal); err != nil {
+		return 0, err
+	}
+	if err := db.put(key, newVal, expiry); err != nil {
+		return 0, err
+	}
+	return len(newVal), nil
+}
+
+// GetRange returns the bytes of the value stored at key between the start and end offsets, both inclusive. Negative
+// offsets count back from the end of the value, so -1 is the last byte. Offsets past either end are clamped to the
+// value, and an empty value is returned for ranges that select nothing. An error is returned if the key is not found
+func (db *BeckDB) GetRange(key string, start, end int) ([]byte, error) {
+	val, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(val)
+	if start < 0 && end < 0 && start > end {
+		return []byte{}, nil
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end {
+		return []byte{}, nil
+	}
+	return val[start : end+1], nil
+}
+
+// SetRange overwrites the value stored at key with val starting at offset and returns the length of the new value.
+// A value shorter than offset is padded with zero bytes, and a missing key is created unless val is empty. The
+// read-modify-write happens under the db lock and the expiry is kept
+func (db *BeckDB) SetRange(key string, offset int, val []byte) (int, error) {
+	if db.cfg.ReadOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	var expiry int64
+	if header := db.keyDir.get(key); header != nil {
+		expiry = header.expiry
+	}
+	cur, err := db.get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return 0, err
+	}
+	// an empty write changes nothing, so neither a missing key nor padding is created
+	if len(val) == 0 {
+		return len(cur), nil
+	}
+
+	// the size is checked before allocating, since a large offset would otherwise allocate the padding first
+	if int64(offset) > db.cfg.MaxValueSize {
+		return 0, ErrValTooLarge
+	}
+	size := max(int64(len(cur)), int64(offset)+int64(len(val)))
+	if err := db.validateEntrySize(key, size); err != nil {
+		return 0, err
+	}
+	newVal := make([]byte, size)
+	copy(newVal, cur)
+	copy(newVal[offset:], val)
+	if err := db.put(key, newVal, expiry); err != nil {
+		return 0, err
+	}
+	return len(newVal), nil
+}
+
+// SetExpiry sets the time after which a key is no longer visible. A zero time removes any expiry so the key lives
+// until deleted. The value is rewritten with the new expiry so the change survives restarts.
+// An error is returned if the key is not found
+func (db *BeckDB) SetExpiry(key string, at time.Time) error {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	val, err := db.get(key)
+	if err != nil {
+		return err
+	}
+
+	var expiry int64
+	if !at.IsZero() {
+		expiry = at.UnixMilli()
+	}
+	return db.put(key, val, expiry)
+}
+
+// GetExpiry returns the time after which a key is no longer visible. A zero time is returned if the key never expires.
+// An error is returned if the key is not found
+func (db *BeckDB) GetExpiry(key string) (time.Time, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	header := db.keyDir.get(key)
+	if header == nil {
+		return time.Time{}, ErrKeyNotFound
+	}
+	if header.expiry == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(header.expiry), nil
+}
+
+// Has reports whether a key exists in the datastore
+func (db *BeckDB) Has(key string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.keyDir.get(key) != nil
+}
+
+// Version returns a number that changes each time a key is written or removed, so a caller can detect that a key
+// changed between two reads of its version. Missing and expired keys have the version of the last removal of any key,
+// so a key set and removed again is detected at the cost of also reporting removals of other keys
+func (db *BeckDB) Version(key string) uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.keyDir.keyVersion(key)
+}
+
+// PrefixVersion returns a number that changes each time a key starting with prefix is written or removed. Like
+// Version, it also changes on the removal of any other key
+func (db *BeckDB) PrefixVersion(prefix string) uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.keyDir.prefixVersion(prefix)
+}
+
+// ValueLen returns the length of the value stored for a key. It is served entirely from the keydir without reading
+// the record from disk. An error is returned if the key is not found
+func (db *BeckDB) ValueLen(key string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	header := db.keyDir.get(key)
+	if header == nil {
+		return 0, ErrKeyNotFound
+	}
+	if header.valSize == unknownValSize {
+		val, err := db.get(key)
+		if err != nil {
+			return 0, err
+		}
+		return len(val), nil
+	}
+	return header.valSize, nil
+}
+
 // Delete removes a record by key from a the datastore. An error is returned if the key is not found
 func (db *BeckDB) Delete(key string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	defer db.trackSlow("delete", key, time.Now())
+
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
 
 	// check if val exists
 	if header := db.keyDir.get(key); header == nil {
@@ -159,14 +824,53 @@ func (db *BeckDB) Delete(key string) error {
 	}
 
 	// append tombstone entry to datastore then remove from keydir
-	if _, _, err := db.activeDatafile.append(key, tombstoneVal); err != nil {
+	size, _, err := db.activeDatafile.append(newRecord(key, tombstoneVal, 0))
+	if err != nil {
 		return err
 	}
 
 	db.keyDir.delete(key)
+	db.keyDir.markDead(db.activeIndex, size)
+	db.cache.remove(key)
+	db.metrics.deletes.Add(1)
 	return nil
 }
 
+// DeletePrefix removes all keys starting with the given prefix and returns the number of keys removed. The tombstones
+// are appended with a single write under one lock acquisition, so readers observe either none or all of the deletes
+func (db *BeckDB) DeletePrefix(prefix string) (int, error) {
+	defer db.trackSlow("deleteprefix", prefix, time.Now())
+
+	if db.cfg.ReadOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	keys := db.keyDir.prefixScan(prefix)
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	records := make([]*record, len(keys))
+	for idx, key := range keys {
+		records[idx] = newRecord(key, tombstoneVal, 0)
+	}
+	sizes, _, err := db.activeDatafile.appendBatch(records)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, key := range keys {
+		db.keyDir.delete(key)
+		db.keyDir.markDead(db.activeIndex, sizes[idx])
+		db.cache.remove(key)
+	}
+	db.metrics.deletes.Add(uint64(len(keys)))
+	return len(keys), nil
+}
+
 // ListKeys returns a list of all the keys in the datastore
 func (db *BeckDB) ListKeys() []string {
 	// rw lock since keydir remains same throughout
@@ -176,21 +880,126 @@ func (db *BeckDB) ListKeys() []string {
 	return db.keyDir.listKeys()
 }
 
+// KeyCount returns the number of live keys in the datastore. Deleted keys are not counted
+func (db *BeckDB) KeyCount() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.keyDir.len()
+}
+
+// ScanPrefix returns all keys in the datastore starting with the given prefix in sorted order
+func (db *BeckDB) ScanPrefix(prefix string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.keyDir.prefixScan(prefix)
+}
+
+// Scan iterates the keys of the datastore in pages of up to count keys. A zero cursor starts a new scan over a
+// point-in-time snapshot of the keys and the returned cursor resumes it. A zero cursor is returned once all keys have
+// been visited. Keys deleted during the scan are skipped while keys added during the scan are not returned
+func (db *BeckDB) Scan(cursor uint64, count int) ([]string, uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	return db.keyDir.scan(cursor, count)
+}
+
 // Sync flushes all buffered writes to disk. It performs an fsync on the active datafile
 func (db *BeckDB) Sync() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.activeDatafile.sync()
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.activeDatafile.persist()
+}
+
+// Config returns a copy of the config the database runs with, including the defaults of unset fields and the
+// settings changed since it was opened. The encryption key is left out
+func (db *BeckDB) Config() Config {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	cfg := *db.cfg
+	cfg.EncryptionKey = nil
+	return cfg
+}
+
+// SetSyncInterval changes the interval buffered writes are synced to disk in the background, taking effect
+// immediately. Background syncs stop when it's 0. It has no effect while SyncOnWrite is set
+func (db *BeckDB) SetSyncInterval(interval time.Duration) error {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	if interval < 0 {
+		return fmt.Errorf("%w: sync interval must not be negative, got %v", ErrInvalidConfig, interval)
+	}
+
+	db.lock()
+	db.cfg.SyncInterval = interval
+	db.unlock()
+
+	// wake the background sync to apply the interval. a pending signal already does
+	select {
+	case db.syncIntervalSet <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetSlowOpThreshold changes the duration after which operations are recorded in the slow log. The slow log is
+// disabled when it's 0
+func (db *BeckDB) SetSlowOpThreshold(threshold time.Duration) error {
+	if threshold < 0 {
+		return fmt.Errorf("%w: slow op threshold must not be negative, got %v", ErrInvalidConfig, threshold)
+	}
+
+	db.lock()
+	defer db.unlock()
+	db.cfg.SlowOpThreshold = threshold
+	db.slowOpThreshold.Store(int64(threshold))
+	return nil
+}
+
+// ErrorCh returns a channel receiving the errors of background syncs, merges and datafile rotations, which would
+// otherwise go unnoticed. The channel is buffered and errors are dropped while it is full
+func (db *BeckDB) ErrorCh() <-chan error {
+	return db.errCh
+}
+
+// reportError sends a background worker error to the error channel without blocking
+func (db *BeckDB) reportError(err error) {
+	db.logger.Error(err.Error())
+	select {
+	case db.errCh <- err:
+	default:
+	}
 }
 
 // Close shutdowns the application and mark the current active-file as old
 func (db *BeckDB) Close() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	// stop background workers
+	db.closeOnce.Do(func() { close(db.closed) })
 
+	db.lock()
+	defer db.unlock()
+
+	return db.closeFiles()
+}
+
+// closeFiles closes the active datafile and all old datafiles. the caller must hold the db lock
+func (db *BeckDB) closeFiles() error {
 	// close active datafile and all old file
-	if err := db.activeDatafile.close(); err != nil {
-		return fmt.Errorf("failed to close active datafile: %w", err)
+	if db.activeDatafile != nil {
+		if err := db.activeDatafile.close(); err != nil {
+			return fmt.Errorf("failed to close active datafile: %w", err)
+		}
 	}
 
 	for _, df := range db.oldDataFiles {
@@ -201,14 +1010,112 @@ func (db *BeckDB) Close() error {
 	return nil
 }
 
-// Merge runs a background worker that periodically merge old datafiles
+// lock acquires exclusive access to the database for a mutation. writers are always serialized on writeMu
+// before db.mu so they stay ordered with puts on the concurrent write path
+func (db *BeckDB) lock() {
+	db.writeMu.Lock()
+	db.mu.Lock()
+}
+
+// unlock releases the exclusive access acquired by lock
+func (db *BeckDB) unlock() {
+	db.mu.Unlock()
+	db.writeMu.Unlock()
+}
+
+// Merge runs a background worker that periodically merge old datafiles until the database is closed. With a merge
+// threshold, old datafiles are merged as soon as enough of them is reclaimable
 func (db *BeckDB) Merge() {
-	ticker := time.NewTicker(db.cfg.MergeInterval)
+	interval := db.cfg.MergeInterval
+	if db.cfg.MergeThreshold > 0 {
+		interval = min(interval, mergeCheckInterval)
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := db.Compact(); err != nil {
-			// silently swallow error
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			if !db.shouldMerge() {
+				continue
+			}
+			if err := db.Compact(); err != nil {
+				db.reportError(fmt.Errorf("background merge: %w", err))
+			}
+		}
+	}
+}
+
+// shouldMerge reports whether the merge interval elapsed since the last merge or the reclaimable ratio of old
+// datafiles exceeds the merge threshold
+func (db *BeckDB) shouldMerge() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	since := db.lastMerge
+	if since.IsZero() {
+		since = db.opened
+	}
+	if time.Since(since) >= db.cfg.MergeInterval {
+		return true
+	}
+	return db.cfg.MergeThreshold > 0 && db.reclaimableRatio() > db.cfg.MergeThreshold
+}
+
+// syncPeriodically flushes and fsyncs the active datafile every sync interval until the database is closed.
+// a changed interval applies from the time it's set, and no syncs run while it's zero
+func (db *BeckDB) syncPeriodically() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		db.mu.RLock()
+		interval := db.cfg.SyncInterval
+		db.mu.RUnlock()
+
+		var tick <-chan time.Time
+		timer.Stop()
+		if interval > 0 {
+			timer.Reset(interval)
+			tick = timer.C
+		}
+
+		select {
+		case <-db.closed:
+			return
+		case <-db.syncIntervalSet:
+		case <-tick:
+			if err := db.Sync(); err != nil {
+				db.reportError(fmt.Errorf("background sync: %w", err))
+				continue
+			}
+			db.logger.Debug("synced active datafile")
+		}
+	}
+}
+
+// releaseIdleDatafiles periodically closes old datafiles that were not read within the idle timeout until the
+// database is closed
+func (db *BeckDB) releaseIdleDatafiles() {
+	ticker := time.NewTicker(max(db.cfg.IdleFileTimeout/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			idleSince := time.Now().Add(-db.cfg.IdleFileTimeout)
+
+			db.mu.RLock()
+			for id, df := range db.oldDataFiles {
+				if _, err := df.release(idleSince); err != nil {
+					db.reportError(fmt.Errorf("failed to release idle datafile %d: %w", id, err))
+				}
+			}
+			db.mu.RUnlock()
 		}
 	}
 }
@@ -219,10 +1126,19 @@ func (db *BeckDB) trackActiveDatafile() {
 	defer ticker.Stop()
 	maxWaitInterval := 10 * time.Minute
 
-	for range ticker.C {
-		// increase wait time if file wasn't rotated
-		if !db.RotateActiveDatafile() {
-			ticker.Reset(min(2*db.cfg.TrackActiveDatafileInterval, maxWaitInterval))
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			// increase wait time if file wasn't rotated
+			rotated, err := db.rotateActiveDatafile()
+			if err != nil {
+				db.reportError(fmt.Errorf("background rotation: %w", err))
+			}
+			if !rotated {
+				ticker.Reset(min(2*db.cfg.TrackActiveDatafileInterval, maxWaitInterval))
+			}
 		}
 	}
 }
@@ -1,12 +1,25 @@
 package beck_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	beck "github.com/mrshabel/beckdb"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -52,101 +65,2947 @@ func testOpen(t *testing.T, cfg *beck.Config) {
 	err = db.Close()
 	require.NoError(t, err)
 
-	cfg.ReadOnly = true
+	// read-only mode works on a copy so later tests keep writing
+	roCfg := *cfg
+	roCfg.ReadOnly = true
+	db, err = beck.Open(&roCfg)
+	require.NoError(t, err)
+
+	err = db.Put("name", []byte("mrshabel"))
+	require.ErrorIs(t, err, beck.ErrDatabaseReadOnly)
+
+	err = db.Close()
+	require.NoError(t, err)
+}
+
+// test that data can be written to the db
+func testPut(t *testing.T, cfg *beck.Config) {
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := "name"
+	val := []byte("mrshabel")
+
+	err = db.Put(key, val)
+	require.NoError(t, err)
+}
+
+// test that data can be retrieved from the db
+func testGet(t *testing.T, cfg *beck.Config) {
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := "name_test_not_found"
+	val := []byte("mrshabel")
+
+	// attempt to retrieve missing key
+	dbVal, err := db.Get(key)
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	require.Equal(t, []byte(nil), dbVal)
+
+	// now we write val to db and attempt to retrieve it
+	err = db.Put(key, val)
+	require.NoError(t, err)
+
+	dbVal, err = db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, val, dbVal)
+}
+
+// test that old datafiles can be merged
+func testMerge(t *testing.T, cfg *beck.Config) {
+	// small max file size for testing here
+	cp := *cfg
+	cp.MaxFileSize = 50
+	cp.SyncOnWrite = true
+	// disabled background merging to allow for predictable testing
+	cp.MergeInterval = 1 * time.Hour
+	cp.TrackActiveDatafileInterval = 1 * time.Hour
+
+	db, err := beck.Open(&cp)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// seed 200 entries and rotate active datafile on each 10th entry
+	for idx := range 200 {
+		err = db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx)))
+		require.NoError(t, err)
+
+		if (idx+1)%10 == 0 {
+			db.RotateActiveDatafile()
+
+		}
+	}
+
+	// create tombstone records
+	err = db.Put("key1", []byte("updated_value1"))
+	require.NoError(t, err)
+
+	err = db.Delete("key2")
+	require.NoError(t, err)
+
+	// merge old datafiles
+	err = db.Compact()
+	require.NoError(t, err)
+
+	// verify data after merge for both live and removed records
+	val, err := db.Get("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated_value1"), val)
+
+	_, err = db.Get("key2")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+
+	// verify put/get still works after merge
+	err = db.Put("new_key", []byte("new_value"))
+	require.NoError(t, err)
+
+	val, err = db.Get("new_key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new_value"), val)
+}
+
+// test that a hint file whose offsets disagree with its datafile is discarded on open
+func TestHintFileMismatch(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_hint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{
+		DataDir:                     dataDir,
+		MaxFileSize:                 50,
+		SyncOnWrite:                 true,
+		MergeInterval:               1 * time.Hour,
+		TrackActiveDatafileInterval: 1 * time.Hour,
+	}
+
+	// produce a merged datafile with its hint file
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	for idx := range 20 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+		if (idx+1)%5 == 0 {
+			db.RotateActiveDatafile()
+		}
+	}
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	// replace the hint file with entries pointing at the wrong offsets, including a key absent from the datafile
+	hintPath := filepath.Join(dataDir, "0.hint")
+	require.FileExists(t, hintPath)
+	writeHintFile(t, hintPath, []hintEntry{
+		{key: "key1", recordSize: 40, offset: 7},
+		{key: "ghost", recordSize: 40, offset: 0},
+	})
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// keydir must have been rebuilt from the datafile
+	for idx := range 20 {
+		val, err := db.Get(fmt.Sprintf("key%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+	}
+	_, err = db.Get("ghost")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+}
+
+// test that a hint file whose entries fail their checksum is discarded on open, even when hints are trusted
+func TestHintFileChecksum(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 50, HintCheck: beck.HintCheckNone}
+
+	// produce a merged datafile with its hint file
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	for idx := range 20 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+		if (idx+1)%5 == 0 {
+			db.RotateActiveDatafile()
+		}
+	}
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	// rename the key of the first entry. magic header (8) + entry header (32)
+	hintPath := filepath.Join(dataDir, "0.hint")
+	data, err := os.ReadFile(hintPath)
+	require.NoError(t, err)
+	require.Equal(t, byte('k'), data[8+32])
+	data[8+32] = 'x'
+	require.NoError(t, os.WriteFile(hintPath, data, 0644))
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// keydir must have been rebuilt from the datafile without the renamed key
+	require.Equal(t, 20, db.Stats().Keys)
+	for idx := range 20 {
+		val, err := db.Get(fmt.Sprintf("key%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+	}
+}
+
+// test that hint files written before entries carried a checksum are still replayed
+func TestLegacyHintFile(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 1 << 10, HintOnlyKeys: true}
+
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	for idx := range 10 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+	}
+	require.NoError(t, db.Close())
+
+	// rewrite the hint files without the magic header and the entry checksums. the keys are only kept in them
+	hintFiles, err := filepath.Glob(filepath.Join(dataDir, "*.hint"))
+	require.NoError(t, err)
+	require.NotEmpty(t, hintFiles)
+	for _, path := range hintFiles {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "BECKHNT2", string(data[:8]))
+
+		var legacy bytes.Buffer
+		for data = data[8:]; len(data) > 0; {
+			keySize := int(binary.LittleEndian.Uint32(data[4:8]) &^ (7 << 29))
+			size := 4 + 28 + keySize
+			legacy.Write(data[4:size])
+			data = data[size:]
+		}
+		require.NoError(t, os.WriteFile(path, legacy.Bytes(), 0644))
+	}
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	for idx := range 10 {
+		val, err := db.Get(fmt.Sprintf("key%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+	}
+}
+
+// test that datafiles replayed from their hint files are only read past the last hinted record
+func TestHintReplaySkipsDatafile(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 200, HintCheck: beck.HintCheckNone}
+
+	// produce merged datafiles with their hint files
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	for idx := range 20 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%02d", idx), []byte(fmt.Sprintf("value-%02d", idx))))
+		if (idx+1)%5 == 0 {
+			require.True(t, db.RotateActiveDatafile())
+		}
+	}
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	// corrupt the value of the first merged record. only a datafile replay reads it
+	dataPath := filepath.Join(dataDir, "0.data")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[32+len("key-00")]++
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	// drop the last hint entry as if a crash cut the hint file short. entry header (32) + key
+	hintPath := filepath.Join(dataDir, "0.hint")
+	info, err := os.Stat(hintPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(hintPath, info.Size()-int64(32+len("key-00"))))
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the record missing from the hint file is replayed from the datafile
+	require.Equal(t, 20, db.Stats().Keys)
+	failed := 0
+	for idx := range 20 {
+		val, err := db.Get(fmt.Sprintf("key-%02d", idx))
+		if err != nil {
+			failed++
+			continue
+		}
+		require.Equal(t, fmt.Sprintf("value-%02d", idx), string(val))
+	}
+	require.Equal(t, 1, failed)
+}
+
+// test that rotated datafiles get a hint file that later opens replay instead of the datafile
+func TestRotationHintFiles(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 1, HintCheck: beck.HintCheckNone}
+
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	for idx := range 5 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%d", idx), []byte(fmt.Sprintf("value-%d", idx))))
+		require.True(t, db.RotateActiveDatafile())
+	}
+	require.NoError(t, db.Put("key-0", []byte("rewritten")))
+	require.NoError(t, db.Delete("key-1"))
+	for fileID := 1; fileID <= 5; fileID++ {
+		require.FileExists(t, filepath.Join(dataDir, fmt.Sprintf("%d.hint", fileID)))
+	}
+	// the active datafile gets its hint file once it's replayed on the next open
+	require.NoFileExists(t, filepath.Join(dataDir, "6.hint"))
+	require.NoError(t, db.Close())
+
+	// a rotation interrupted while writing the hint file leaves it under its temporary name
+	leftover := filepath.Join(dataDir, "6.hint.tmp")
+	require.NoError(t, os.WriteFile(leftover, []byte("partial"), 0644))
+
+	assertValues := func(db *beck.BeckDB) {
+		want := map[string]string{"key-0": "rewritten", "key-2": "value-2", "key-3": "value-3", "key-4": "value-4"}
+		for key, val := range want {
+			got, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, val, string(got))
+		}
+		_, err := db.Get("key-1")
+		require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	}
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	assertValues(db)
+	require.NoError(t, db.Close())
+	require.NoFileExists(t, leftover)
+	require.FileExists(t, filepath.Join(dataDir, "6.hint"))
+
+	// corrupt the value of a rotated record. only a datafile replay reads it
+	dataPath := filepath.Join(dataDir, "3.data")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)-1]++
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get("key-2")
+	require.Error(t, err)
+	val, err := db.Get("key-4")
+	require.NoError(t, err)
+	require.Equal(t, "value-4", string(val))
+}
+
+// test that datafiles scanned with chunks smaller than their records replay and merge like record reads
+func TestReadAhead(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, MaxFileSize: 1 << 10})
+	require.NoError(t, err)
+
+	want := make(map[string]string)
+	for idx := range 50 {
+		key, val := fmt.Sprintf("key-%d", idx), strings.Repeat("v", idx*7)
+		require.NoError(t, db.Put(key, []byte(val)))
+		want[key] = val
+		db.RotateActiveDatafile()
+	}
+	require.NoError(t, db.Delete("key-0"))
+	delete(want, "key-0")
+	require.NoError(t, db.Close())
+
+	for _, readAheadSize := range []int{-1, 1, 64, 1 << 20} {
+		// remove the hint files so the datafiles are scanned on open
+		hintFiles, err := filepath.Glob(filepath.Join(dataDir, "*.hint"))
+		require.NoError(t, err)
+		for _, path := range hintFiles {
+			require.NoError(t, os.Remove(path))
+		}
+
+		db, err := beck.Open(&beck.Config{DataDir: dataDir, MaxFileSize: 1 << 10, ReadAheadSize: readAheadSize})
+		require.NoError(t, err)
+		require.NoError(t, db.Compact())
+		require.Equal(t, len(want), db.Stats().Keys)
+		for key, val := range want {
+			got, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, val, string(got))
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+// test that a torn record at the end of a datafile is dropped on open instead of failing it
+func TestTornRecord(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		torn []byte
+	}{
+		{name: "partial header", torn: []byte("garbage")},
+		{name: "partial record", torn: append(bytes.Repeat([]byte{0}, 20), 0xff, 0xff, 0, 0, 0xff, 0xff, 0, 0, 1, 2)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			db, err := beck.Open(&beck.Config{DataDir: dataDir})
+			require.NoError(t, err)
+			for idx := range 10 {
+				require.NoError(t, db.Put(fmt.Sprintf("key-%d", idx), []byte(fmt.Sprintf("val-%d", idx))))
+			}
+			dfPath := filepath.Join(dataDir, fmt.Sprintf("%d.data", db.ActiveFileID()))
+			require.NoError(t, db.Close())
+
+			// append the torn record left by a crash mid-append
+			fi, err := os.Stat(dfPath)
+			require.NoError(t, err)
+			f, err := os.OpenFile(dfPath, os.O_WRONLY|os.O_APPEND, 0)
+			require.NoError(t, err)
+			_, err = f.Write(tt.torn)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			db, err = beck.Open(&beck.Config{DataDir: dataDir})
+			require.NoError(t, err)
+			require.Equal(t, 10, db.Stats().Keys)
+
+			// the torn record is truncated away
+			truncated, err := os.Stat(dfPath)
+			require.NoError(t, err)
+			require.Equal(t, fi.Size(), truncated.Size())
+
+			require.NoError(t, db.Put("key-10", []byte("val-10")))
+			require.NoError(t, db.Close())
+
+			db, err = beck.Open(&beck.Config{DataDir: dataDir})
+			require.NoError(t, err)
+			defer db.Close()
+			for idx := range 11 {
+				val, err := db.Get(fmt.Sprintf("key-%d", idx))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("val-%d", idx), string(val))
+			}
+		})
+	}
+}
+
+// test that a corrupted size field in the middle of a datafile is not mistaken for a torn record. the records after it
+// are recovered and the datafile is never truncated
+func TestCorruptRecordSize(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		valSize []byte
+	}{
+		{name: "past the size limits", valSize: bytes.Repeat([]byte{0x7f}, 8)},
+		{name: "within the size limits", valSize: []byte{0, 0x10, 0, 0, 0, 0, 0, 0}},
+		{name: "negative", valSize: bytes.Repeat([]byte{0xff}, 8)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			db, err := beck.Open(&beck.Config{DataDir: dataDir})
+			require.NoError(t, err)
+			for idx := range 5 {
+				require.NoError(t, db.Put(fmt.Sprintf("key-%d", idx), []byte(fmt.Sprintf("val-%d", idx))))
+			}
+			dfPath := filepath.Join(dataDir, fmt.Sprintf("%d.data", db.ActiveFileID()))
+			require.NoError(t, db.Close())
+
+			// overwrite the value size of the second record, which follows the crc, timestamp, expiry and key size
+			data, err := os.ReadFile(dfPath)
+			require.NoError(t, err)
+			recordSize := 32 + len("key-0") + len("val-0")
+			copy(data[recordSize+24:], tt.valSize)
+			require.NoError(t, os.WriteFile(dfPath, data, 0644))
+
+			_, err = beck.Open(&beck.Config{DataDir: dataDir, StrictRecovery: true})
+			require.ErrorIs(t, err, beck.ErrInvalidRecord)
+			fi, err := os.Stat(dfPath)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), fi.Size())
+
+			db, err = beck.Open(&beck.Config{DataDir: dataDir})
+			require.NoError(t, err)
+			defer db.Close()
+			require.Equal(t, 4, db.Stats().Keys)
+			_, err = db.Get("key-1")
+			require.ErrorIs(t, err, beck.ErrKeyNotFound)
+			for _, idx := range []int{0, 2, 3, 4} {
+				val, err := db.Get(fmt.Sprintf("key-%d", idx))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("val-%d", idx), string(val))
+			}
+			fi, err = os.Stat(dfPath)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), fi.Size())
+		})
+	}
+}
+
+// test that corrupt records are skipped on open unless recovery is strict
+func TestStrictRecovery(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dataDir})
+	require.NoError(t, err)
+	for idx := range 10 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%d", idx), []byte(fmt.Sprintf("val-%d", idx))))
+	}
+	dfPath := filepath.Join(dataDir, fmt.Sprintf("%d.data", db.ActiveFileID()))
+	require.NoError(t, db.Close())
+
+	// corrupt the value of the fifth record. header (32) + key + value
+	data, err := os.ReadFile(dfPath)
+	require.NoError(t, err)
+	recordSize := 32 + len("key-0") + len("val-0")
+	data[4*recordSize+32+len("key-0")]++
+	require.NoError(t, os.WriteFile(dfPath, data, 0644))
+
+	_, err = beck.Open(&beck.Config{DataDir: dataDir, StrictRecovery: true})
+	require.ErrorIs(t, err, beck.ErrInvalidChecksum)
+
+	db, err = beck.Open(&beck.Config{DataDir: dataDir})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 9, db.Stats().Keys)
+	_, err = db.Get("key-4")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	for _, idx := range []int{0, 3, 5, 9} {
+		val, err := db.Get(fmt.Sprintf("key-%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val-%d", idx), string(val))
+	}
+
+	// the records after the corrupt one are kept in the datafile
+	fi, err := os.Stat(dfPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), fi.Size())
+}
+
+// test that compressed values are read back transparently, even once the compression setting changes
+func TestCompression(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, Compression: beck.CompressionFlate})
+	require.NoError(t, err)
+
+	want := map[string]string{"short": "v"}
+	for idx := range 10 {
+		want[fmt.Sprintf("json-%d", idx)] = strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"beck"},`, idx), 100)
+	}
+	for key, val := range want {
+		require.NoError(t, db.Put(key, []byte(val)))
+	}
+	// compressed values take up less space than the values themselves
+	total := 0
+	for _, val := range want {
+		total += len(val)
+	}
+	require.Less(t, db.Stats().LiveBytes, int64(total)/2)
+
+	assertValues := func(db *beck.BeckDB) {
+		t.Helper()
+		for key, val := range want {
+			got, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, val, string(got))
+			size, err := db.ValueLen(key)
+			require.NoError(t, err)
+			require.Equal(t, len(val), size)
+		}
+	}
+	assertValues(db)
+	require.NoError(t, db.Close())
+
+	// reopen without compression, replaying the datafile and then its hint file
+	for range 2 {
+		db, err = beck.Open(&beck.Config{DataDir: dataDir})
+		require.NoError(t, err)
+		assertValues(db)
+		require.NoError(t, db.Close())
+	}
+
+	db, err = beck.Open(&beck.Config{DataDir: dataDir, Compression: beck.CompressionFlate})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put("short", []byte("w")))
+	want["short"] = "w"
+	require.NoError(t, db.Compact())
+	assertValues(db)
+}
+
+// test that encrypted values are unreadable on disk and fail to decrypt with another key
+func TestEncryption(t *testing.T) {
+	dataDir := t.TempDir()
+	key := bytes.Repeat([]byte("k"), 32)
+	cfg := &beck.Config{DataDir: dataDir, EncryptionKey: key, HintCheck: beck.HintCheckFull}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	want := map[string]string{"secret": "top secret value", "json": strings.Repeat(`{"name":"beck"},`, 50)}
+	for key, val := range want {
+		require.NoError(t, db.Put(key, []byte(val)))
+	}
+	dfPath := filepath.Join(dataDir, fmt.Sprintf("%d.data", db.ActiveFileID()))
+	require.NoError(t, db.Close())
+
+	data, err := os.ReadFile(dfPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "top secret value")
+
+	// reopen from the datafile and then from its hint file, with and without compression
+	for _, compression := range []beck.Compression{beck.CompressionNone, beck.CompressionFlate} {
+		cfg.Compression = compression
+		db, err = beck.Open(cfg)
+		require.NoError(t, err)
+		for key, val := range want {
+			got, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, val, string(got))
+			size, err := db.ValueLen(key)
+			require.NoError(t, err)
+			require.Equal(t, len(val), size)
+		}
+		require.NoError(t, db.Put("secret", []byte(want["secret"])))
+		require.NoError(t, db.Close())
+	}
+	// write the hint file of the last datafile
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// verified hint files fall back to the datafiles, which fail to decrypt
+	_, err = beck.Open(&beck.Config{DataDir: dataDir, EncryptionKey: bytes.Repeat([]byte("x"), 32)})
+	require.ErrorIs(t, err, beck.ErrDecryptionFailed)
+
+	// trusted hint files open, and the first read fails
+	for _, wrongKey := range [][]byte{bytes.Repeat([]byte("x"), 32), nil} {
+		db, err = beck.Open(&beck.Config{DataDir: dataDir, EncryptionKey: wrongKey, HintCheck: beck.HintCheckNone})
+		require.NoError(t, err)
+		_, err = db.Get("secret")
+		require.ErrorIs(t, err, beck.ErrDecryptionFailed)
+		require.NoError(t, db.Close())
+	}
+
+	_, err = beck.Open(&beck.Config{DataDir: dataDir, EncryptionKey: []byte("short")})
+	require.ErrorIs(t, err, beck.ErrInvalidConfig)
+}
+
+// test that values larger than the default cap are streamed to and from disk
+func TestStreamValues(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &beck.Config{DataDir: dataDir, MaxValueSize: 8 << 20}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	val := bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16)
+	require.NoError(t, db.PutReader("large", bytes.NewReader(val), int64(len(val))))
+	require.ErrorIs(t, db.PutReader("huge", bytes.NewReader(nil), 9<<20), beck.ErrValTooLarge)
+	require.ErrorIs(t, db.Put("huge", make([]byte, 9<<20)), beck.ErrValTooLarge)
+
+	// a reader ending early leaves the key untouched
+	require.ErrorIs(t, db.PutReader("large", bytes.NewReader(val[:10]), int64(len(val))), io.ErrUnexpectedEOF)
+	spooled, err := filepath.Glob(filepath.Join(dataDir, "*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, spooled)
+
+	assertValue := func(db *beck.BeckDB) {
+		t.Helper()
+		r, err := db.GetReader("large")
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, val, got)
+		size, err := db.ValueLen("large")
+		require.NoError(t, err)
+		require.Equal(t, len(val), size)
+	}
+	assertValue(db)
+	dfPath := filepath.Join(dataDir, fmt.Sprintf("%d.data", db.ActiveFileID()))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	assertValue(db)
+	require.NoError(t, db.Close())
+
+	// corruption is detected once the value is read to the end
+	data, err := os.ReadFile(dfPath)
+	require.NoError(t, err)
+	data[len(data)-1]++
+	require.NoError(t, os.WriteFile(dfPath, data, 0644))
+	db, err = beck.Open(&beck.Config{DataDir: dataDir, MaxValueSize: 8 << 20, HintCheck: beck.HintCheckNone})
+	require.NoError(t, err)
+	r, err := db.GetReader("large")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.ErrorIs(t, err, beck.ErrInvalidChecksum)
+	require.NoError(t, r.Close())
+	require.NoError(t, db.Close())
+
+	// values that are compressed are processed whole
+	db, err = beck.Open(&beck.Config{DataDir: t.TempDir(), MaxValueSize: 8 << 20, Compression: beck.CompressionFlate})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.PutReader("large", bytes.NewReader(val), int64(len(val))))
+	assertValue(db)
+}
+
+// test that merge with read repair drops keydir entries whose records are physically missing
+func TestMergeReadRepair(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_repair")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{
+		DataDir:                     dataDir,
+		MaxFileSize:                 50,
+		SyncOnWrite:                 true,
+		MergeInterval:               1 * time.Hour,
+		TrackActiveDatafileInterval: 1 * time.Hour,
+		MergeReadRepair:             true,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for idx := range 20 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+		if (idx+1)%5 == 0 {
+			db.RotateActiveDatafile()
+		}
+	}
+
+	// cut off the last record of the second datafile, leaving its keydir entry dangling
+	dfPath := filepath.Join(dataDir, "2.data")
+	fi, err := os.Stat(dfPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(dfPath, fi.Size()-3))
+
+	require.NoError(t, db.Compact())
+
+	_, err = db.Get("key9")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	for idx := range 20 {
+		if idx == 9 {
+			continue
+		}
+		val, err := db.Get(fmt.Sprintf("key%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+	}
+}
+
+// test that the key count reflects deletions, including after the keydir is replayed
+func TestKeyCount(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_count")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, SyncOnWrite: true}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	for idx := range 3 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte("value")))
+	}
+	require.NoError(t, db.Delete("key1"))
+	require.Equal(t, 2, db.KeyCount())
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, 2, db.KeyCount())
+	_, err = db.Get("key1")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+}
+
+// test that concurrent increments are never lost and non-integer values are rejected
+func TestIncrement(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_incr")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				_, err := db.Increment("counter", 1)
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Increment("counter", -500)
+	require.NoError(t, err)
+	require.Equal(t, int64(500), val)
+
+	require.NoError(t, db.Put("name", []byte("mrshabel")))
+	_, err = db.Increment("name", 1)
+	require.ErrorIs(t, err, beck.ErrValueNotInteger)
+}
+
+// test that keys written with a ttl disappear once expired, across reopen and merge
+func TestTTL(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_ttl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 64}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, db.PutWithTTL("key", []byte("value"), 0), beck.ErrInvalidTTL)
+
+	require.NoError(t, db.PutWithTTL("short", []byte("value"), 50*time.Millisecond))
+	require.NoError(t, db.PutWithTTL("long", []byte("value"), time.Hour))
+	db.RotateActiveDatafile()
+
+	val, err := db.Get("short")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get("short")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+
+	// expired records are dropped by the merge while live ones keep their expiry
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Get("short")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	val, err = db.Get("long")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+// test that expiry changes are persisted across restarts
+func TestSetExpiry(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_expiry")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, db.SetExpiry("missing", time.Now().Add(time.Hour)), beck.ErrKeyNotFound)
+
+	require.NoError(t, db.Put("expiring", []byte("value")))
+	require.NoError(t, db.PutWithTTL("persisted", []byte("value"), time.Hour))
+
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	require.NoError(t, db.SetExpiry("expiring", at))
+	require.NoError(t, db.SetExpiry("persisted", time.Time{}))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	got, err := db.GetExpiry("expiring")
+	require.NoError(t, err)
+	require.True(t, at.Equal(got))
+
+	got, err = db.GetExpiry("persisted")
+	require.NoError(t, err)
+	require.True(t, got.IsZero())
+
+	val, err := db.Get("expiring")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+// test that swapping in a staging directory replaces the live dataset
+func TestSwapDir(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_swap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	stagingDir, err := os.MkdirTemp("", "beck_swap_staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(stagingDir)
+
+	// build the staging dataset
+	staging, err := beck.Open(&beck.Config{DataDir: stagingDir})
+	require.NoError(t, err)
+	require.NoError(t, staging.Put("new", []byte("value")))
+	require.NoError(t, staging.Close())
+
+	cfg := &beck.Config{DataDir: dataDir}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Put("old", []byte("value")))
+
+	require.NoError(t, db.SwapDir(stagingDir))
+	require.NoDirExists(t, stagingDir)
+
+	_, err = db.Get("old")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	val, err := db.Get("new")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	// writes land in the swapped dataset
+	require.NoError(t, db.Put("other", []byte("value")))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	require.ElementsMatch(t, []string{"new", "other"}, db.ListKeys())
+}
+
+// test that a swap interrupted after the old dataset was moved aside is rolled back on open
+func TestSwapDirRecovery(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_swap_recovery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Put("old", []byte("value")))
+	require.NoError(t, db.Close())
+
+	// simulate a crash between the two renames
+	require.NoError(t, os.Rename(dataDir, dataDir+".swap"))
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val, err := db.Get("old")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+	require.NoDirExists(t, dataDir+".swap")
+}
+
+// test that operations slower than the threshold are recorded in the slow log
+func TestSlowLog(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_slowlog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, SlowOpThreshold: 20 * time.Millisecond, SlowLogSize: 2})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put("fast", []byte("value")))
+	require.Empty(t, db.SlowLog())
+
+	db.SlowDownActiveDatafile(30 * time.Millisecond)
+	for _, key := range []string{"slow1", "slow2", "slow3"} {
+		require.NoError(t, db.Put(key, []byte("value")))
+	}
+
+	// only the newest entries are kept, newest first
+	ops := db.SlowLog()
+	require.Len(t, ops, 2)
+	require.Equal(t, "slow3", ops[0].Key)
+	require.Equal(t, "slow2", ops[1].Key)
+	require.Equal(t, "put", ops[0].Op)
+	require.Greater(t, ops[0].ID, ops[1].ID)
+	require.GreaterOrEqual(t, ops[0].Duration, 20*time.Millisecond)
+
+	db.ResetSlowLog()
+	require.Empty(t, db.SlowLog())
+}
+
+// test that metrics count the operations served, and that they are safe to update concurrently
+func TestMetrics(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), CacheSize: 16, MaxFileSize: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.Equal(t, beck.Metrics{}, db.Metrics())
+
+	require.NoError(t, db.Put("a", []byte("value")))
+	require.NoError(t, db.Put("b", []byte("value")))
+	written := db.Metrics().BytesWritten
+	require.NotZero(t, written)
+
+	// the first read goes to disk and caches the value for the second
+	for range 2 {
+		_, err = db.Get("a")
+		require.NoError(t, err)
+	}
+	_, err = db.Get("missing")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	require.NoError(t, db.Delete("a"))
+
+	batch := beck.NewBatch()
+	batch.Put("c", []byte("value"))
+	batch.Delete("b")
+	require.NoError(t, db.Write(batch))
+
+	db.RotateActiveDatafile()
+	require.NoError(t, db.Put("d", []byte("value")))
+	db.RotateActiveDatafile()
+	require.NoError(t, db.Compact())
+
+	metrics := db.Metrics()
+	require.Equal(t, uint64(3), metrics.Gets)
+	require.Equal(t, uint64(4), metrics.Puts)
+	require.Equal(t, uint64(2), metrics.Deletes)
+	require.Equal(t, uint64(1), metrics.CacheHits)
+	require.Equal(t, uint64(1), metrics.CacheMisses)
+	require.Equal(t, uint64(1), metrics.Merges)
+	require.Greater(t, metrics.BytesWritten, written)
+	require.NotZero(t, metrics.BytesRead)
+	require.Equal(t, 2, metrics.Keys)
+
+	// counters are updated without the database lock
+	var wg sync.WaitGroup
+	for idx := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				db.Put(fmt.Sprintf("key-%d", idx), []byte("value"))
+				db.Get(fmt.Sprintf("key-%d", idx))
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, metrics.Puts+800, db.Metrics().Puts)
+	require.Equal(t, metrics.Gets+800, db.Metrics().Gets)
+}
+
+// lockedBuffer is a buffer that's safe to write from background workers
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// test that background events and recovered corruption are logged through the configured logger
+func TestLogger(t *testing.T) {
+	var out lockedBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	cfg := &beck.Config{DataDir: t.TempDir(), MaxFileSize: 1, SyncInterval: 10 * time.Millisecond, Logger: logger,
+		SlowOpThreshold: time.Nanosecond}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "a"} {
+		require.NoError(t, db.Put(key, []byte("value")))
+		require.True(t, db.RotateActiveDatafile())
+	}
+	require.NoError(t, db.Compact())
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), "synced active datafile") },
+		time.Second, 10*time.Millisecond)
+	require.NoError(t, db.Close())
+
+	logs := out.String()
+	require.Contains(t, logs, "level=INFO msg=\"rotated active datafile\" fileID=2")
+	require.Contains(t, logs, "level=INFO msg=\"merged datafiles\" files=3")
+	require.Contains(t, logs, "level=WARN msg=\"slow operation\" op=put key=a")
+
+	// torn records are discarded with a warning on open
+	f, err := os.OpenFile(filepath.Join(cfg.DataDir, "4.data"), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("torn"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Contains(t, out.String(), "level=WARN msg=\"discarded a torn record at the end of datafile\"")
+}
+
+// test that the sync interval and slow op threshold can be changed while the database is open
+func TestSetConfig(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_set_config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir})
+	require.NoError(t, err)
+	defer db.Close()
+
+	// buffered writes only reach the datafile once the background sync is enabled
+	require.NoError(t, db.Put("key", []byte("value")))
+	datafileSize := func() int64 {
+		paths, err := filepath.Glob(filepath.Join(dataDir, "*.data"))
+		require.NoError(t, err)
+		var size int64
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+	require.Zero(t, datafileSize())
+
+	require.NoError(t, db.SetSyncInterval(10*time.Millisecond))
+	require.Equal(t, 10*time.Millisecond, db.Config().SyncInterval)
+	require.Eventually(t, func() bool { return datafileSize() > 0 }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, db.SetSlowOpThreshold(time.Nanosecond))
+	db.SlowDownActiveDatafile(time.Millisecond)
+	require.NoError(t, db.Put("slow", []byte("value")))
+	require.Len(t, db.SlowLog(), 1)
+	require.Equal(t, time.Nanosecond, db.Config().SlowOpThreshold)
+
+	require.ErrorIs(t, db.SetSyncInterval(-time.Second), beck.ErrInvalidConfig)
+	require.ErrorIs(t, db.SetSlowOpThreshold(-time.Second), beck.ErrInvalidConfig)
+}
+
+// test that the expiry sweep deletes expired keys that are never read again, and leaves other keys alone
+func TestExpirySweep(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_expiry_sweep")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, ExpirySweepInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for idx := range 100 {
+		require.NoError(t, db.PutWithTTL(fmt.Sprintf("short%d", idx), []byte("value"), time.Millisecond))
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte("value")))
+	}
+	require.NoError(t, db.PutWithTTL("long", []byte("value"), time.Hour))
+
+	// expired keys are counted until they are deleted
+	require.Eventually(t, func() bool { return db.KeyCount() == 101 }, 2*time.Second, 10*time.Millisecond)
+	val, err := db.Get("long")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+	require.Positive(t, db.Stats().ReclaimableBytes)
+}
+
+// test that clear removes every key and datafile while reads in progress complete, and survives a reopen
+func TestClear(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_clear")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 64}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	for idx := range 10 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+		db.RotateActiveDatafile()
+	}
+
+	// a read started before the clear still sees its value
+	r, err := db.GetReader("key0")
+	require.NoError(t, err)
+	require.NoError(t, db.Clear())
+	val, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value0"), val)
+	require.NoError(t, r.Close())
+
+	require.Zero(t, db.KeyCount())
+	_, err = db.Get("key1")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	datafiles, err := filepath.Glob(filepath.Join(dataDir, "*.data"))
+	require.NoError(t, err)
+	require.Len(t, datafiles, 1)
+
+	require.NoError(t, db.Put("after", []byte("value")))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, []string{"after"}, db.ListKeys())
+}
+
+// test that a clear interrupted before removing its datafiles is finished on the next open
+func TestClearRecovery(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_clear_recovery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Put("cleared", []byte("value")))
+	require.NoError(t, db.Close())
+
+	// record the datafile as cleared without removing it, as a crash partway through a clear would
+	datafiles, err := filepath.Glob(filepath.Join(dataDir, "*.data"))
+	require.NoError(t, err)
+	fileID := strings.TrimSuffix(filepath.Base(datafiles[0]), ".data")
+	manifest := fmt.Sprintf(`{"byteOrder":%q,"cleared":[%s]}`, binary.LittleEndian.String(), fileID)
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "MANIFEST"), []byte(manifest), 0644))
+
+	// read-only opens skip the cleared datafiles without removing them
+	roDB, err := beck.Open(&beck.Config{DataDir: dataDir, ReadOnly: true})
+	require.NoError(t, err)
+	require.Zero(t, roDB.KeyCount())
+	require.NoError(t, roDB.Close())
+	require.FileExists(t, datafiles[0])
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	require.Zero(t, db.KeyCount())
+	require.NoError(t, db.Close())
+
+	// the manifest no longer records the cleared datafiles once they are removed
+	data, err := os.ReadFile(filepath.Join(dataDir, "MANIFEST"))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "cleared")
+}
+
+// test that appends create missing keys, extend existing values and keep the expiry
+func TestAppend(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_append")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir})
+	require.NoError(t, err)
+	defer db.Close()
+
+	n, err := db.Append("name", []byte("mrs"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	n, err = db.Append("name", []byte("habel"))
+	require.NoError(t, err)
+	require.Equal(t, 8, n)
+
+	val, err := db.Get("name")
+	require.NoError(t, err)
+	require.Equal(t, []byte("mrshabel"), val)
+
+	require.NoError(t, db.PutWithTTL("session", []byte("a"), time.Hour))
+	_, err = db.Append("session", []byte("b"))
+	require.NoError(t, err)
+	at, err := db.GetExpiry("session")
+	require.NoError(t, err)
+	require.False(t, at.IsZero())
+}
+
+// test that value lengths are kept in the keydir across merges and restarts
+func TestValueLen(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_valuelen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 64}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	for idx := range 10 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), bytes.Repeat([]byte("v"), idx+1)))
+		db.RotateActiveDatafile()
+	}
+	_, err = db.ValueLen("missing")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+
+	// the merged file is replayed from its hint file on open
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for idx := range 10 {
+		n, err := db.ValueLen(fmt.Sprintf("key%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, idx+1, n)
+	}
+}
+
+// test that value lengths are known from the keydir without reading records, whether the keys were written by puts,
+// batches or appends, replayed from a datafile or replayed from a hint file
+func TestValueLenWithoutRead(t *testing.T) {
+	cfg := &beck.Config{DataDir: t.TempDir()}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	want := map[string]int{"put": 3, "batch": 5, "append": 7}
+	require.NoError(t, db.Put("put", []byte("abc")))
+	batch := beck.NewBatch()
+	batch.Put("batch", []byte("abcde"))
+	require.NoError(t, db.Write(batch))
+	_, err = db.Append("append", []byte("abc"))
+	require.NoError(t, err)
+	_, err = db.Append("append", []byte("defg"))
+	require.NoError(t, err)
+
+	// appends read the value they extend, so only the reads made by the checks are counted
+	check := func(db *beck.BeckDB) {
+		t.Helper()
+		read := db.Metrics().BytesRead
+		for key, n := range want {
+			got, err := db.ValueLen(key)
+			require.NoError(t, err)
+			require.Equal(t, n, got, key)
+		}
+		require.Equal(t, read, db.Metrics().BytesRead)
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	// the first open replays the datafile and writes its hint file, which the second open replays
+	for range 2 {
+		db, err = beck.Open(cfg)
+		require.NoError(t, err)
+		check(db)
+		require.NoError(t, db.Close())
+	}
+}
+
+// test that cached values are served without disk reads and invalidated by writes
+func TestValueCache(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, CacheSize: 2})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		require.NoError(t, db.Put(key, []byte("value")))
+	}
+	reads := db.CountActiveDatafileReads()
+
+	// the second read is a cache hit
+	for range 2 {
+		val, err := db.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), val)
+	}
+	require.Equal(t, int64(1), reads.Load())
+
+	// writes invalidate the cached value
+	require.NoError(t, db.Put("key1", []byte("updated")))
+	val, err := db.Get("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), val)
+	require.Equal(t, int64(2), reads.Load())
+
+	require.NoError(t, db.Delete("key1"))
+	_, err = db.Get("key1")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+
+	// the least recently used value is evicted once the cache is full
+	require.NoError(t, db.Put("key4", []byte("value")))
+	for _, key := range []string{"key2", "key3", "key2", "key4", "key3"} {
+		_, err := db.Get(key)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(6), reads.Load())
+}
+
+// test that buffered writes are readable before they are flushed and persisted on close
+func TestWriteBuffer(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_write_buffer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, WriteBufferSize: 1 << 20}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	for idx := range 100 {
+		key := fmt.Sprintf("key%d", idx)
+		require.NoError(t, db.Put(key, []byte(fmt.Sprintf("value%d", idx))))
+
+		val, err := db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for idx := range 100 {
+		val, err := db.Get(fmt.Sprintf("key%d", idx))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+	}
+}
+
+// test that reads running alongside merges never fail on a datafile removed by the merge
+func TestGetDuringCompaction(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_get_compact")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, MaxFileSize: 256})
+	require.NoError(t, err)
+	defer db.Close()
+
+	const keys = 50
+	for idx := range keys {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+		db.RotateActiveDatafile()
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for reader := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := reader; ; idx++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", idx%keys)
+				val, err := db.Get(key)
+				if !assert.NoError(t, err, "get %s", key) {
+					return
+				}
+				assert.Equal(t, []byte(fmt.Sprintf("value%d", idx%keys)), val)
+			}
+		}()
+	}
+
+	// rewrite overlapping keys and merge repeatedly while the readers run
+	for round := range 20 {
+		for idx := round; idx < keys; idx += 5 {
+			require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+			db.RotateActiveDatafile()
+		}
+		require.NoError(t, db.Compact())
+	}
+	close(done)
+	wg.Wait()
+}
+
+// test that memory-mapped old datafiles serve reads across rotation, merge and reopen
+func TestMmapReads(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_mmap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 128, UseMmap: true}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	assertValues := func(db *beck.BeckDB) {
+		for idx := range 50 {
+			val, err := db.Get(fmt.Sprintf("key%d", idx))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+		}
+	}
+
+	for idx := range 50 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+		db.RotateActiveDatafile()
+	}
+	assertValues(db)
+
+	require.NoError(t, db.Compact())
+	assertValues(db)
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	assertValues(db)
+}
+
+// test that keys kept only in hint files survive restarts and merges, and are lost with their hint file
+func TestHintOnlyKeys(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_hint_only_keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 512, HintOnlyKeys: true}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	largeKey := func(idx int) string {
+		return fmt.Sprintf("%s-%d", bytes.Repeat([]byte("k"), 100), idx)
+	}
+	for idx := range 20 {
+		require.NoError(t, db.Put(largeKey(idx), []byte(fmt.Sprintf("value%d", idx))))
+		db.RotateActiveDatafile()
+	}
+	require.NoError(t, db.Delete(largeKey(0)))
+
+	assertValues := func(db *beck.BeckDB) {
+		_, err := db.Get(largeKey(0))
+		require.ErrorIs(t, err, beck.ErrKeyNotFound)
+		for idx := 1; idx < 20; idx++ {
+			val, err := db.Get(largeKey(idx))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value%d", idx)), val)
+		}
+	}
+	assertValues(db)
+
+	// keys are replayed from the hint files, before and after a merge
+	require.NoError(t, db.Close())
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	assertValues(db)
+
+	require.NoError(t, db.Compact())
+	assertValues(db)
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	assertValues(db)
+	require.NoError(t, db.Close())
+
+	// datafiles only hold the key hashes
+	datafiles, err := filepath.Glob(filepath.Join(dataDir, "*.data"))
+	require.NoError(t, err)
+	for _, path := range datafiles {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte(largeKey(1))), "key stored in %s", path)
+	}
+
+	// keys cannot be recovered without the hint files
+	hintFiles, err := filepath.Glob(filepath.Join(dataDir, "*.hint"))
+	require.NoError(t, err)
+	require.NotEmpty(t, hintFiles)
+	for _, path := range hintFiles {
+		require.NoError(t, os.Remove(path))
+	}
+	_, err = beck.Open(cfg)
+	require.ErrorIs(t, err, beck.ErrHintFileRequired)
+}
+
+// test that parallel gets sharing the read lock are race free alongside writes and rotations.
+// run with the race detector
+func TestParallelGets(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_parallel_gets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, MaxFileSize: 1024, CacheSize: 8, ReadVerifyEveryN: 3})
+	require.NoError(t, err)
+	defer db.Close()
+
+	const keys = 20
+	for idx := range keys {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx))))
+	}
+
+	var wg sync.WaitGroup
+	for reader := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range 500 {
+				key := (reader + idx) % keys
+				val, err := db.Get(fmt.Sprintf("key%d", key))
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("value%d", key)), val)
+			}
+		}()
+	}
+	for idx := range 200 {
+		require.NoError(t, db.Put(fmt.Sprintf("key%d", idx%keys), []byte(fmt.Sprintf("value%d", idx%keys))))
+		db.RotateActiveDatafile()
+	}
+	wg.Wait()
+}
+
+// test that failures of the background sync are reported on the error channel
+func TestErrorCh(t *testing.T) {
+	cfg := &beck.Config{DataDir: t.TempDir(), SyncInterval: 10 * time.Millisecond}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	errDisk := errors.New("disk failure")
+	db.FailActiveDatafileSyncs(errDisk)
+	require.NoError(t, db.Put("key", []byte("value")))
+
+	select {
+	case err := <-db.ErrorCh():
+		require.ErrorIs(t, err, errDisk)
+	case <-time.After(time.Second):
+		t.Fatal("background sync error was not reported")
+	}
+}
+
+// test that old datafiles are closed once idle and reopened transparently on the next read
+func TestIdleDatafiles(t *testing.T) {
+	dir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dir})
+	require.NoError(t, err)
+	for i := range 10 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.NoError(t, db.Close())
+
+	for _, useMmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", useMmap), func(t *testing.T) {
+			db, err := beck.Open(&beck.Config{DataDir: dir, UseMmap: useMmap, IdleFileTimeout: 20 * time.Millisecond})
+			require.NoError(t, err)
+			defer db.Close()
+
+			require.Eventually(t, func() bool { return db.OpenOldDatafiles() == 0 }, time.Second, 5*time.Millisecond)
+
+			for i := range 10 {
+				val, err := db.Get(fmt.Sprintf("key-%d", i))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+			}
+			require.Positive(t, db.OpenOldDatafiles())
+
+			// files are released again once reads stop
+			require.Eventually(t, func() bool { return db.OpenOldDatafiles() == 0 }, time.Second, 5*time.Millisecond)
+		})
+	}
+}
+
+// hookWriter runs hook before the first write reaches the underlying writer
+type hookWriter struct {
+	bytes.Buffer
+	hook func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	if w.hook != nil {
+		w.hook()
+		w.hook = nil
+	}
+	return w.Buffer.Write(p)
+}
+
+// test that an export reflects the keys as they were when it started while writes and merges proceed
+func TestExportConsistent(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 1024})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	want := make(map[string]string)
+	for i := range 200 {
+		key, val := fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)
+		require.NoError(t, db.Put(key, []byte(val)))
+		want[key] = val
+		if i%50 == 0 {
+			db.RotateActiveDatafile()
+		}
+	}
+
+	// once the export is underway, a concurrent writer overwrites and deletes every key and merges the datafiles
+	// the export reads from
+	out := &hookWriter{hook: func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := range 200 {
+				key := fmt.Sprintf("key-%03d", i)
+				if i%2 == 0 {
+					assert.NoError(t, db.Delete(key))
+				} else {
+					assert.NoError(t, db.Put(key, []byte("overwritten")))
+				}
+			}
+			db.RotateActiveDatafile()
+			assert.NoError(t, db.Compact())
+		}()
+		<-done
+	}}
+	require.NoError(t, db.ExportConsistent(out))
+
+	got := make(map[string]string)
+	var keys []string
+	data := out.Bytes()
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+		keySize := int(binary.LittleEndian.Uint32(data[:4]))
+		valSize := int(binary.LittleEndian.Uint64(data[4:12]))
+		data = data[12:]
+		key, val := string(data[:keySize]), string(data[keySize:keySize+valSize])
+		data = data[keySize+valSize:]
+
+		got[key] = val
+		keys = append(keys, key)
+	}
+	require.Equal(t, want, got)
+	require.IsIncreasing(t, keys)
+
+	// the live db reflects the writes made during the export
+	_, err = db.Get("key-000")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	val, err := db.Get("key-001")
+	require.NoError(t, err)
+	require.Equal(t, "overwritten", string(val))
+}
+
+// test that an NDJSON export holds one readable object per key and imports into another database intact
+func TestNDJSON(t *testing.T) {
+	src, err := beck.Open(&beck.Config{DataDir: t.TempDir()})
+	require.NoError(t, err)
+	t.Cleanup(func() { src.Close() })
+
+	want := map[string][]byte{
+		"name":          []byte("beck"),
+		"binary":        {0, 1, 0xff, '\n'},
+		"\x00h\xff\xfe": []byte("invalid utf-8 key"),
+	}
+	for key, val := range want {
+		require.NoError(t, src.Put(key, val))
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, src.ExportNDJSON(&out))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	require.Contains(t, lines, `{"key":"name","value":"YmVjaw=="}`)
+
+	dst, err := beck.Open(&beck.Config{DataDir: t.TempDir()})
+	require.NoError(t, err)
+	t.Cleanup(func() { dst.Close() })
+	require.NoError(t, dst.ImportNDJSON(&out))
+
+	require.Equal(t, len(want), dst.KeyCount())
+	for key, val := range want {
+		got, err := dst.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, val, got)
+	}
+
+	// entries before an invalid one are kept
+	err = dst.ImportNDJSON(strings.NewReader(`{"key":"kept","value":"MQ=="}` + "\n" + `{"key":`))
+	require.Error(t, err)
+	require.True(t, dst.Has("kept"))
+}
+
+// test that fold visits every live key in sorted order and stops at the first error
+func TestFold(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir()})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	require.NoError(t, db.Put("b", []byte("2")))
+	require.NoError(t, db.Put("a", []byte("1")))
+	require.NoError(t, db.Put("c", []byte("3")))
+	require.NoError(t, db.Delete("c"))
+
+	var visited []string
+	require.NoError(t, db.Fold(func(key string, val []byte) error {
+		visited = append(visited, key+"="+string(val))
+		return nil
+	}))
+	require.Equal(t, []string{"a=1", "b=2"}, visited)
+
+	errStop := errors.New("stop")
+	visited = nil
+	err = db.Fold(func(key string, val []byte) error {
+		visited = append(visited, key)
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, []string{"a"}, visited)
+}
+
+// test that a snapshot keeps its view of the keys through writes, merges and clears until it's closed
+func TestSnapshot(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 1024})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for i := range 100 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), []byte(fmt.Sprintf("value-%d", i))))
+		if i%25 == 0 {
+			db.RotateActiveDatafile()
+		}
+	}
+
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, 100, snap.Len())
+
+	// the datafiles the snapshot reads from are merged away then cleared
+	for i := range 100 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), []byte("overwritten")))
+	}
+	require.NoError(t, db.Delete("key-000"))
+	require.NoError(t, db.Put("new", []byte("value")))
+	db.RotateActiveDatafile()
+	require.NoError(t, db.Compact())
+
+	val, err := snap.Get("key-000")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-0"), val)
+	_, err = snap.Get("new")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+
+	require.NoError(t, db.Clear())
+	var keys []string
+	require.NoError(t, snap.Fold(func(key string, val []byte) error {
+		i, err := strconv.Atoi(strings.TrimPrefix(key, "key-"))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+		keys = append(keys, key)
+		return nil
+	}))
+	require.Len(t, keys, 100)
+	require.IsIncreasing(t, keys)
+
+	require.NoError(t, snap.Close())
+	_, err = snap.Get("key-001")
+	require.ErrorIs(t, err, beck.ErrSnapshotClosed)
+	require.ErrorIs(t, snap.Fold(func(string, []byte) error { return nil }), beck.ErrSnapshotClosed)
+}
+
+// test that a backup taken while writes proceed opens as a database holding the keys from when it started
+func TestBackup(t *testing.T) {
+	for _, hintOnlyKeys := range []bool{false, true} {
+		db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 1024, HintOnlyKeys: hintOnlyKeys})
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		for i := range 100 {
+			require.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), []byte(fmt.Sprintf("value-%d", i))))
+			if i%25 == 0 {
+				db.RotateActiveDatafile()
+			}
+		}
+
+		// writes continue while the backup is taken
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := range 100 {
+				assert.NoError(t, db.Put(fmt.Sprintf("later-%03d", i), []byte("value")))
+			}
+		}()
+		dstDir := filepath.Join(t.TempDir(), "backup")
+		require.NoError(t, db.Backup(dstDir))
+		<-done
+
+		backup, err := beck.Open(&beck.Config{DataDir: dstDir, HintOnlyKeys: hintOnlyKeys})
+		require.NoError(t, err)
+		for i := range 100 {
+			val, err := backup.Get(fmt.Sprintf("key-%03d", i))
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+		}
+		require.NoError(t, backup.Close())
+
+		// backups are only written to empty directories
+		require.ErrorIs(t, db.Backup(dstDir), beck.ErrDirectoryNotEmpty)
+	}
+}
+
+// test that a backup restores into an empty directory and that corrupted backups are refused
+func TestRestore(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 1024, EncryptionKey: key})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for i := range 100 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), []byte(fmt.Sprintf("value-%d", i))))
+		if i%25 == 0 {
+			db.RotateActiveDatafile()
+		}
+	}
+	require.NoError(t, db.Delete("key-000"))
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	require.NoError(t, db.Backup(backupDir))
+
+	// every record is restored, including the tombstone
+	cfg := &beck.Config{DataDir: filepath.Join(t.TempDir(), "restored"), EncryptionKey: key}
+	restored, err := beck.Restore(backupDir, cfg)
+	require.NoError(t, err)
+	require.Equal(t, 101, restored)
+
+	_, err = beck.Restore(backupDir, cfg)
+	require.ErrorIs(t, err, beck.ErrDirectoryNotEmpty)
+
+	restoredDB, err := beck.Open(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 99, restoredDB.KeyCount())
+	val, err := restoredDB.Get("key-099")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-99"), val)
+	require.NoError(t, restoredDB.Close())
+
+	// a flipped bit in the last record of a datafile fails its checksum
+	datafiles, err := filepath.Glob(filepath.Join(backupDir, "*.data"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(datafiles[0])
+	require.NoError(t, err)
+	data[len(data)-1] ^= 1
+	require.NoError(t, os.WriteFile(datafiles[0], data, 0644))
+
+	_, err = beck.Restore(backupDir, &beck.Config{DataDir: t.TempDir(), EncryptionKey: key})
+	require.ErrorIs(t, err, beck.ErrInvalidChecksum)
+}
+
+// test that stats track overwrites and deletes, survive a reopen and reflect a merge
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dir, MaxFileSize: 1})
+	require.NoError(t, err)
+
+	// every record is a 32 byte header followed by the key and value
+	recordSize := func(key, val string) int64 { return int64(32 + len(key) + len(val)) }
+
+	require.NoError(t, db.Put("a", []byte("one")))
+	require.NoError(t, db.Put("b", []byte("two")))
+	require.Equal(t, beck.Stats{
+		Keys:       2,
+		Datafiles:  1,
+		TotalBytes: recordSize("a", "one") + recordSize("b", "two"),
+		LiveBytes:  recordSize("a", "one") + recordSize("b", "two"),
+	}, db.Stats())
+
+	require.NoError(t, db.Put("a", []byte("three")))
+	require.NoError(t, db.Delete("b"))
+	want := beck.Stats{
+		Keys:             1,
+		Datafiles:        1,
+		TotalBytes:       recordSize("a", "one") + recordSize("b", "two") + recordSize("a", "three") + recordSize("b", ""),
+		ReclaimableBytes: recordSize("a", "one") + recordSize("b", "two") + recordSize("b", ""),
+		LiveBytes:        recordSize("a", "three"),
+	}
+	require.Equal(t, want, db.Stats())
+	require.NoError(t, db.Close())
+
+	// the reopened datafile is old and a new active datafile is created
+	db, err = beck.Open(&beck.Config{DataDir: dir, MaxFileSize: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	want.Datafiles = 2
+	require.Equal(t, want, db.Stats())
+
+	// merging leaves only the live records
+	require.NoError(t, db.Put("c", []byte("four")))
+	require.True(t, db.RotateActiveDatafile())
+	before := time.Now()
+	require.NoError(t, db.Compact())
+
+	stats := db.Stats()
+	require.WithinRange(t, stats.LastMerge, before, time.Now())
+	stats.LastMerge = time.Time{}
+	require.Equal(t, beck.Stats{
+		Keys: 2,
+		// each live record fills a merged datafile
+		Datafiles:  3,
+		TotalBytes: recordSize("a", "three") + recordSize("c", "four"),
+		LiveBytes:  recordSize("a", "three") + recordSize("c", "four"),
+	}, stats)
+}
+
+// test that old datafiles are merged once enough of them is reclaimable, well before the merge interval
+func TestMergeThreshold(t *testing.T) {
+	db, err := beck.Open(&beck.Config{
+		DataDir:        t.TempDir(),
+		MaxFileSize:    1,
+		MergeInterval:  time.Hour,
+		MergeThreshold: 0.4,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// one overwrite leaves a third of the old datafiles reclaimable, a second one half of them
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.True(t, db.RotateActiveDatafile())
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.True(t, db.RotateActiveDatafile())
+	require.NoError(t, db.Put("other", []byte("value")))
+	require.True(t, db.RotateActiveDatafile())
+	require.Positive(t, db.Stats().ReclaimableBytes)
+	time.Sleep(1500 * time.Millisecond)
+	require.Positive(t, db.Stats().ReclaimableBytes, "merged below the threshold")
+
+	require.NoError(t, db.Put("other", []byte("value")))
+	require.True(t, db.RotateActiveDatafile())
+	require.Eventually(t, func() bool { return db.Stats().ReclaimableBytes == 0 }, 3*time.Second, 50*time.Millisecond)
+
+	val, err := db.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "value", string(val))
+}
+
+// test that datafiles are listed in id order, merged datafiles first, and that other files are skipped
+func TestGetDatafiles(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, name := range []string{"10.data", "2.data", "0.data", "-1.data", "-12.data", "9223372036854775807.data",
+		"-9223372036854775808.data", "stray.data", "007.data", "+3.data", "2.hint", "5.data.tmp"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, name), nil, 0644))
+	}
+
+	paths, err := beck.GetDatafiles(dataDir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	require.Equal(t, []string{"-9223372036854775808.data", "-12.data", "-1.data", "0.data", "2.data", "10.data",
+		"9223372036854775807.data"}, names)
+}
+
+// test that the active datafile follows the highest datafile id when the ids have gaps
+func TestNonContiguousFileIDs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &beck.Config{DataDir: dir, MaxFileSize: 1}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Put(key, []byte(key)))
+		require.True(t, db.RotateActiveDatafile())
+	}
+	require.NoError(t, db.Close())
+
+	// leave ids 1, 2 and 5
+	for _, ext := range []string{".data", ".hint"} {
+		require.NoError(t, os.Rename(filepath.Join(dir, "3"+ext), filepath.Join(dir, "5"+ext)))
+	}
+	require.NoError(t, os.Remove(filepath.Join(dir, "4.data")))
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 6, db.ActiveFileID())
+	require.NoError(t, db.Put("d", []byte("d")))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	for _, key := range []string{"a", "b", "c", "d"} {
+		val, err := db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, string(val))
+	}
+}
+
+// test that active datafile ids never collide with the merged datafile id over many rotations and merges
+func TestMergedFileIDReserved(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &beck.Config{DataDir: dir, MaxFileSize: 1}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	// an empty directory starts right after the reserved id
+	require.Equal(t, 1, db.ActiveFileID())
+
+	want := make(map[string]string)
+	for cycle := range 20 {
+		for i := range 5 {
+			key, val := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", cycle, i)
+			require.NoError(t, db.Put(key, []byte(val)))
+			want[key] = val
+		}
+		prev := db.ActiveFileID()
+		require.True(t, db.RotateActiveDatafile())
+		require.Greater(t, db.ActiveFileID(), prev)
+		if cycle%2 == 1 {
+			require.NoError(t, db.Compact())
+		}
+		require.NotZero(t, db.ActiveFileID())
+	}
+	require.NoError(t, db.Close())
+
+	// the merged datafile survives a reopen alongside the active datafiles
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	merged, err := filepath.Glob(filepath.Join(dir, "-*.data"))
+	require.NoError(t, err)
+	require.NotEmpty(t, merged)
+	require.NotZero(t, db.ActiveFileID())
+	for key, val := range want {
+		got, err := db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, val, string(got))
+	}
+}
+
+// test that identical values share a single copy on disk that merges reclaim once no key references it
+func TestDedupValues(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &beck.Config{DataDir: dir, MaxFileSize: 1, DedupValues: true}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	values := make([][]byte, 3)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte(fmt.Sprintf("value-%d|", i)), 16)
+	}
+	for i := range 1000 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%d", i), values[i%3]))
+	}
+
+	// copiesOnDisk counts the occurrences of val in all datafiles
+	copiesOnDisk := func(val []byte) int {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.data"))
+		require.NoError(t, err)
+		copies := 0
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			copies += bytes.Count(data, val)
+		}
+		return copies
+	}
+	require.NoError(t, db.Sync())
+	for _, val := range values {
+		require.Equal(t, 1, copiesOnDisk(val))
+	}
+
+	// requireValues checks every key against the index of its expected value, -1 for deleted keys
+	requireValues := func(db *beck.BeckDB, want func(i int) int) {
+		for i := range 1000 {
+			key := fmt.Sprintf("key-%d", i)
+			val, err := db.Get(key)
+			if want(i) < 0 {
+				require.ErrorIs(t, err, beck.ErrKeyNotFound)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, values[want(i)], val)
+			size, err := db.ValueLen(key)
+			require.NoError(t, err)
+			require.Equal(t, len(values[want(i)]), size)
+		}
+	}
+	requireValues(db, func(i int) int { return i % 3 })
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	requireValues(db, func(i int) int { return i % 3 })
+
+	// once the keys of the first value are overwritten and those of the last value deleted, a merge drops both
+	for i := range 1000 {
+		switch i % 3 {
+		case 0:
+			require.NoError(t, db.Put(fmt.Sprintf("key-%d", i), values[1]))
+		case 2:
+			require.NoError(t, db.Delete(fmt.Sprintf("key-%d", i)))
+		}
+	}
+	want := func(i int) int {
+		if i%3 == 2 {
+			return -1
+		}
+		return 1
+	}
+	require.True(t, db.RotateActiveDatafile())
+	require.NoError(t, db.Compact())
+	require.Zero(t, db.Stats().ReclaimableBytes)
+	require.Equal(t, 0, copiesOnDisk(values[0]))
+	require.Equal(t, 1, copiesOnDisk(values[1]))
+	require.Equal(t, 0, copiesOnDisk(values[2]))
+	requireValues(db, want)
+	require.NoError(t, db.Close())
+
+	// the merged datafile is replayed from its hint file
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	requireValues(db, want)
+}
+
+// test that reads and writes proceed while a merge is reading the old datafiles, and the merge keeps them
+func TestCompactConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &beck.Config{DataDir: dir, MaxFileSize: 1}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	for cycle := range 2 {
+		for i := range 5 {
+			require.NoError(t, db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d-%d", cycle, i))))
+		}
+		require.True(t, db.RotateActiveDatafile())
+	}
+
+	entered, release := db.GateOldDatafileReads()
+	done := make(chan error, 1)
+	go func() { done <- db.Compact() }()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("merge never read the old datafiles")
+	}
+
+	// the merge is blocked reading the old datafiles
+	require.NoError(t, db.Put("key-0", []byte("rewritten")))
+	require.NoError(t, db.Put("new", []byte("value")))
+	require.NoError(t, db.Delete("key-1"))
+	val, err := db.Get("new")
+	require.NoError(t, err)
+	require.Equal(t, "value", string(val))
+	select {
+	case err := <-done:
+		t.Fatalf("merge completed before its reads were released: %v", err)
+	default:
+	}
+
+	release()
+	require.NoError(t, <-done)
+
+	want := map[string]string{"key-0": "rewritten", "key-2": "value-1-2", "key-3": "value-1-3", "key-4": "value-1-4", "new": "value"}
+	check := func(db *beck.BeckDB) {
+		for key, val := range want {
+			got, err := db.Get(key)
+			require.NoError(t, err, key)
+			require.Equal(t, val, string(got), key)
+		}
+		_, err := db.Get("key-1")
+		require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	check(db)
+}
+
+// test that keys rewritten while merges run keep their latest value rather than the merged one
+func TestCompactKeepsConcurrentWrites(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 64})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	const keys = 10
+	for i := range keys {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%d", i), []byte("initial")))
+	}
+
+	const rounds = 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := range rounds {
+			for i := range keys {
+				if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", round))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			db.RotateActiveDatafile()
+		}
+	}()
+
+	merges := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		require.NoError(t, db.Compact())
+		merges++
+	}
+	require.Greater(t, merges, 1)
+
+	for i := range keys {
+		val, err := db.Get(fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value-%d", rounds-1), string(val))
+	}
+}
+
+// test that opening a garbage-heavy directory compacts it only when its reclaimable ratio exceeds CompactOnOpen
+func TestCompactOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dir, MaxFileSize: 1})
+	require.NoError(t, err)
+	for i := range 20 {
+		require.NoError(t, db.Put("key", []byte(fmt.Sprintf("value-%d", i))))
+		require.True(t, db.RotateActiveDatafile())
+	}
+	require.NoError(t, db.Close())
+
+	diskUsage := func() int64 {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var size int64
+		for _, entry := range entries {
+			info, err := entry.Info()
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+	before := diskUsage()
+
+	// read-only and disabled opens leave the garbage in place
+	for _, cfg := range []*beck.Config{
+		{DataDir: dir, ReadOnly: true, CompactOnOpen: 0.5},
+		{DataDir: dir},
+	} {
+		db, err = beck.Open(cfg)
+		require.NoError(t, err)
+		require.Positive(t, db.Stats().ReclaimableBytes)
+		require.NoError(t, db.Close())
+	}
+
+	db, err = beck.Open(&beck.Config{DataDir: dir, CompactOnOpen: 0.5})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.Zero(t, db.Stats().ReclaimableBytes)
+	require.Less(t, diskUsage(), before)
+
+	val, err := db.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "value-19", string(val))
+}
+
+// test that merges split their output across datafiles of at most the max file size, below the active datafiles
+func TestMergeSplitsOutput(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &beck.Config{DataDir: dir, MaxFileSize: 256}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	mergedFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(dir, "*.data"))
+		require.NoError(t, err)
+		merged := []string{}
+		for _, file := range files {
+			id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".data"))
+			require.NoError(t, err)
+			if id <= 0 {
+				merged = append(merged, file)
+			}
+		}
+		return merged
+	}
+
+	want := make(map[string]string)
+	for cycle := range 3 {
+		for i := range 50 {
+			key, val := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", cycle, i)
+			require.NoError(t, db.Put(key, []byte(val)))
+			want[key] = val
+		}
+		require.True(t, db.RotateActiveDatafile())
+		// a single old datafile is left unmerged
+		if cycle == 0 {
+			continue
+		}
+		require.NoError(t, db.Compact())
+
+		merged := mergedFiles()
+		require.Greater(t, len(merged), 1)
+		for _, file := range merged {
+			info, err := os.Stat(file)
+			require.NoError(t, err)
+			// a merged datafile is rolled over once a record takes it past the max file size
+			require.Less(t, info.Size(), int64(2*cfg.MaxFileSize))
+		}
+		require.Zero(t, db.Stats().ReclaimableBytes)
+	}
+	require.NoError(t, db.Close())
+
 	db, err = beck.Open(cfg)
 	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	for key, val := range want {
+		got, err := db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, val, string(got))
+	}
+	require.Zero(t, db.Stats().ReclaimableBytes)
+}
+
+// test that IsMerging reports a running merge and WaitForMergeIdle waits for it to complete
+func TestIsMerging(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for i := range 3 {
+		require.NoError(t, db.Put(fmt.Sprintf("key-%d", i), []byte("value")))
+		require.True(t, db.RotateActiveDatafile())
+	}
+	require.False(t, db.IsMerging())
+	require.NoError(t, db.WaitForMergeIdle(context.Background()))
+
+	entered, release := db.GateOldDatafileReads()
+	done := make(chan error, 1)
+	go func() { done <- db.Compact() }()
+	<-entered
+	require.True(t, db.IsMerging())
+
+	// waits give up with their context while the merge runs
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, db.WaitForMergeIdle(ctx), context.DeadlineExceeded)
+
+	release()
+	require.NoError(t, db.WaitForMergeIdle(context.Background()))
+	require.False(t, db.IsMerging())
+	require.NoError(t, <-done)
+}
+
+// test that a big-endian database round-trips its records and rejects opens with another byte order
+func TestByteOrder(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &beck.Config{DataDir: dir, MaxFileSize: 1, ByteOrder: binary.BigEndian}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	want := make(map[string]string)
+	for i := range 10 {
+		key, val := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		require.NoError(t, db.Put(key, []byte(val)))
+		require.True(t, db.RotateActiveDatafile())
+		want[key] = val
+	}
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Put("active", []byte("value")))
+	want["active"] = "value"
+	require.NoError(t, db.Close())
+
+	// the key size of the first record of a datafile follows its crc, timestamp and expiry. merged keys are all 5
+	// bytes long
+	data, err := os.ReadFile(filepath.Join(dir, "0.data"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), binary.BigEndian.Uint32(data[20:24]))
+
+	_, err = beck.Open(&beck.Config{DataDir: dir, ByteOrder: binary.LittleEndian})
+	require.ErrorIs(t, err, beck.ErrByteOrderMismatch)
+
+	// the recorded byte order is used when none is configured
+	for _, cfg := range []*beck.Config{cfg, {DataDir: dir}} {
+		db, err = beck.Open(cfg)
+		require.NoError(t, err)
+		for key, val := range want {
+			got, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, val, string(got))
+		}
+		require.NoError(t, db.Close())
+	}
+
+	// directories created before the byte order was recorded are little-endian
+	legacy := t.TempDir()
+	db, err = beck.Open(&beck.Config{DataDir: legacy})
+	require.NoError(t, err)
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.NoError(t, db.Close())
+	require.NoError(t, os.Remove(filepath.Join(legacy, "MANIFEST")))
+	_, err = beck.Open(&beck.Config{DataDir: legacy, ByteOrder: binary.BigEndian})
+	require.ErrorIs(t, err, beck.ErrByteOrderMismatch)
+}
+
+// test that datafiles written before records carried an expiry are refused instead of read as empty
+func TestLegacyRecordFormat(t *testing.T) {
+	// a record in the first format: crc of the key and value, timestamp, key size, value size, key and value
+	key, val := "key", []byte("value")
+	record := binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(append([]byte(key), val...)))
+	record = binary.LittleEndian.AppendUint64(record, uint64(time.Now().Unix()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(key)))
+	record = binary.LittleEndian.AppendUint64(record, uint64(len(val)))
+	record = append(append(record, key...), val...)
+
+	dataDir := t.TempDir()
+	datafile := filepath.Join(dataDir, "1.data")
+	require.NoError(t, os.WriteFile(datafile, record, 0644))
+
+	// with no manifest, and with a manifest written before the record format was recorded
+	for _, manifest := range []string{"", fmt.Sprintf(`{"byteOrder":%q}`, binary.LittleEndian.String())} {
+		if manifest != "" {
+			require.NoError(t, os.WriteFile(filepath.Join(dataDir, "MANIFEST"), []byte(manifest), 0644))
+		}
+		for _, readOnly := range []bool{false, true} {
+			_, err := beck.Open(&beck.Config{DataDir: dataDir, ReadOnly: readOnly})
+			require.ErrorIs(t, err, beck.ErrRecordFormat)
+		}
+		_, err := beck.Restore(dataDir, &beck.Config{DataDir: filepath.Join(t.TempDir(), "restored")})
+		require.ErrorIs(t, err, beck.ErrRecordFormat)
+	}
+
+	// the datafile is left untouched and no manifest is stamped over it
+	data, err := os.ReadFile(datafile)
+	require.NoError(t, err)
+	require.Equal(t, record, data)
+	manifest, err := os.ReadFile(filepath.Join(dataDir, "MANIFEST"))
+	require.NoError(t, err)
+	require.NotContains(t, string(manifest), "version")
+
+	// datafiles in the current format with an unversioned manifest are stamped with the format
+	current := t.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: current})
+	require.NoError(t, err)
+	require.NoError(t, db.Put(key, val))
+	require.NoError(t, db.Close())
+	manifestPath := filepath.Join(current, "MANIFEST")
+	require.NoError(t, os.WriteFile(manifestPath, []byte(fmt.Sprintf(`{"byteOrder":%q}`, binary.LittleEndian.String())), 0644))
+	db, err = beck.Open(&beck.Config{DataDir: current})
+	require.NoError(t, err)
+	got, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, val, got)
+	require.NoError(t, db.Close())
+	manifest, err = os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), `"version":2`)
+}
+
+// test that every problem with a config is reported at once without modifying it
+func TestConfigValidate(t *testing.T) {
+	require.Empty(t, (&beck.Config{DataDir: t.TempDir()}).Validate())
+
+	cfg := &beck.Config{
+		MaxFileSize:    -1,
+		MergeInterval:  -time.Second,
+		HintCheck:      beck.HintCheck(42),
+		CacheSize:      -1,
+		MergeThreshold: 1.5,
+	}
+	errs := cfg.Validate()
+	require.Len(t, errs, 6)
+	require.ErrorIs(t, errs[0], beck.ErrDatabaseDirectoryRequired)
+	for _, err := range errs[1:] {
+		require.ErrorIs(t, err, beck.ErrInvalidConfig)
+	}
+	require.Equal(t, int64(-1), cfg.MaxFileSize)
+	require.Equal(t, -time.Second, cfg.MergeInterval)
+
+	// open reports the same problems
+	cfg.DataDir = t.TempDir()
+	_, err := beck.Open(cfg)
+	require.ErrorIs(t, err, beck.ErrInvalidConfig)
+	require.ErrorContains(t, err, "cache size")
+}
+
+// test that reads skip checksum verification only when configured to, while replays still verify
+func TestSkipVerifyOnRead(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &beck.Config{DataDir: dataDir, MaxFileSize: 1}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.Put("key", []byte("value")))
+	dfPath := filepath.Join(dataDir, fmt.Sprintf("%d.data", db.ActiveFileID()))
+	require.True(t, db.RotateActiveDatafile())
+	require.NoError(t, db.Close())
+
+	// corrupt the value. the hint file of the rotated datafile is trusted so the record is only read by Get
+	data, err := os.ReadFile(dfPath)
+	require.NoError(t, err)
+	data[len(data)-1] = 'X'
+	require.NoError(t, os.WriteFile(dfPath, data, 0644))
+
+	for _, skipVerify := range []bool{false, true} {
+		db, err = beck.Open(&beck.Config{DataDir: dataDir, HintCheck: beck.HintCheckNone, SkipVerifyOnRead: skipVerify})
+		require.NoError(t, err)
+		val, err := db.Get("key")
+		if skipVerify {
+			require.NoError(t, err)
+			require.Equal(t, "valuX", string(val))
+		} else {
+			require.ErrorIs(t, err, beck.ErrInvalidChecksum)
+		}
+		require.NoError(t, db.Close())
+	}
+
+	// replays verify the record regardless
+	require.NoError(t, os.Remove(filepath.Join(dataDir, strings.TrimSuffix(filepath.Base(dfPath), ".data")+".hint")))
+	_, err = beck.Open(&beck.Config{DataDir: dataDir, StrictRecovery: true, SkipVerifyOnRead: true})
+	require.ErrorIs(t, err, beck.ErrInvalidChecksum)
+}
+
+// test that keys and values are checked against the configured size limits
+func TestEntryLimits(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxKeySize: 4, MaxValueSize: 8})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put("abcd", []byte("12345678")))
+	require.ErrorIs(t, db.Put("abcde", []byte("1")), beck.ErrKeyTooLarge)
+	require.ErrorIs(t, db.Put("abcd", []byte("123456789")), beck.ErrValTooLarge)
+
+	batch := &beck.Batch{}
+	batch.Put("abcde", []byte("1"))
+	require.ErrorIs(t, db.Write(batch), beck.ErrKeyTooLarge)
+
+	// keys must leave room for the record flags
+	_, err = beck.Open(&beck.Config{DataDir: t.TempDir(), MaxKeySize: 1 << 30})
+	require.ErrorIs(t, err, beck.ErrInvalidConfig)
+	_, err = beck.Open(&beck.Config{DataDir: t.TempDir(), MaxValueSize: -1})
+	require.ErrorIs(t, err, beck.ErrInvalidConfig)
+}
+
+// test that the version of a key changes with each write but not when a merge moves its record
+func TestVersion(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxFileSize: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
 
-	err = db.Close()
+	require.Zero(t, db.Version("key"))
+	require.NoError(t, db.Put("key", []byte("value")))
+	version := db.Version("key")
+	require.NotZero(t, version)
+
+	_, err = db.Get("key")
 	require.NoError(t, err)
+	require.Equal(t, version, db.Version("key"))
+
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.NotEqual(t, version, db.Version("key"))
+	version = db.Version("key")
+
+	// merged records keep their version
+	require.NoError(t, db.Put("other", []byte("value")))
+	require.NoError(t, db.Delete("other"))
+	db.RotateActiveDatafile()
+	require.NoError(t, db.Put("next", []byte("value")))
+	db.RotateActiveDatafile()
+	require.NoError(t, db.Compact())
+	require.False(t, db.Stats().LastMerge.IsZero())
+	require.Equal(t, version, db.Version("key"))
+
+	require.NoError(t, db.Delete("key"))
+	require.NotEqual(t, version, db.Version("key"))
+	require.NotZero(t, db.Version("key"))
+
+	// a missing key set and deleted again doesn't return to its version
+	version = db.Version("key")
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.NoError(t, db.Delete("key"))
+	require.NotEqual(t, version, db.Version("key"))
+
+	// prefix versions change when any key under the prefix is written or deleted
+	require.NoError(t, db.Put("user:1", []byte("value")))
+	require.NoError(t, db.Put("user:2", []byte("value")))
+	version = db.PrefixVersion("user:")
+	require.Equal(t, db.Version("user:2"), version)
+	require.NoError(t, db.Put("user:1", []byte("updated")))
+	require.NotEqual(t, version, db.PrefixVersion("user:"))
+	version = db.PrefixVersion("user:")
+	require.NoError(t, db.Delete("user:2"))
+	require.NotEqual(t, version, db.PrefixVersion("user:"))
+
+	// versions are not reused after the database is cleared
+	require.NoError(t, db.Put("key", []byte("value")))
+	version = db.Version("key")
+	require.NoError(t, db.Clear())
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.Greater(t, db.Version("key"), version)
 }
 
-// test that data can be written to the db
-func testPut(t *testing.T, cfg *beck.Config) {
+// test that batched puts and deletes are applied in order and survive a reopen
+func TestBatch(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_batch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	cfg := &beck.Config{DataDir: dataDir, SyncOnWrite: true}
 	db, err := beck.Open(cfg)
 	require.NoError(t, err)
+
+	require.NoError(t, db.Put("stale", []byte("value")))
+
+	batch := beck.NewBatch()
+	batch.Put("key1", []byte("value1"))
+	batch.Put("key2", []byte("value2"))
+	batch.Put("key1", []byte("updated_value1"))
+	batch.Delete("stale")
+	require.NoError(t, db.Write(batch))
+
+	// an invalid entry rejects the whole batch
+	invalid := beck.NewBatch()
+	invalid.Put("key3", []byte("value3"))
+	invalid.Put("", []byte("value"))
+	require.ErrorIs(t, db.Write(invalid), beck.ErrKeyRequired)
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
 	defer db.Close()
 
-	key := "name"
-	val := []byte("mrshabel")
+	val, err := db.Get("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated_value1"), val)
 
-	err = db.Put(key, val)
+	val, err = db.Get("key2")
 	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), val)
+
+	_, err = db.Get("stale")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	_, err = db.Get("key3")
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
 }
 
-// test that data can be retrieved from the db
-func testGet(t *testing.T, cfg *beck.Config) {
+// test that all keys under a prefix are deleted at once, stay deleted after a reopen and are reclaimed by a merge
+func TestDeletePrefix(t *testing.T) {
+	cfg := &beck.Config{DataDir: t.TempDir(), MaxFileSize: 1}
 	db, err := beck.Open(cfg)
 	require.NoError(t, err)
-	defer db.Close()
 
-	key := "name_test_not_found"
-	val := []byte("mrshabel")
-
-	// attempt to retrieve missing key
-	dbVal, err := db.Get(key)
-	require.ErrorIs(t, err, beck.ErrKeyNotFound)
-	require.Equal(t, []byte(nil), dbVal)
+	for _, key := range []string{"tenant1:a", "tenant1:b", "tenant1:c", "tenant2:a", "tenant"} {
+		require.NoError(t, db.Put(key, []byte("value")))
+	}
+	removed, err := db.DeletePrefix("tenant1:")
+	require.NoError(t, err)
+	require.Equal(t, 3, removed)
+	require.ElementsMatch(t, []string{"tenant", "tenant2:a"}, db.ListKeys())
 
-	// now we write val to db and attempt to retrieve it
-	err = db.Put(key, val)
+	removed, err = db.DeletePrefix("tenant1:")
 	require.NoError(t, err)
+	require.Zero(t, removed)
+	require.NoError(t, db.Close())
 
-	dbVal, err = db.Get(key)
+	db, err = beck.Open(cfg)
 	require.NoError(t, err)
-	require.Equal(t, val, dbVal)
+	t.Cleanup(func() { db.Close() })
+	require.ElementsMatch(t, []string{"tenant", "tenant2:a"}, db.ListKeys())
+
+	// the merge drops the deleted records and their tombstones
+	require.NoError(t, db.Put("tenant2:b", []byte("value")))
+	require.True(t, db.RotateActiveDatafile())
+	require.NoError(t, db.Compact())
+	stats := db.Stats()
+	require.Zero(t, stats.ReclaimableBytes)
+	require.Equal(t, stats.LiveBytes, stats.TotalBytes)
+	require.ElementsMatch(t, []string{"tenant", "tenant2:a", "tenant2:b"}, db.ListKeys())
 }
 
-// test that old datafiles can be merged
-func testMerge(t *testing.T, cfg *beck.Config) {
-	// small max file size for testing here
-	cp := *cfg
-	cp.MaxFileSize = 50
-	cp.SyncOnWrite = true
-	// disabled background merging to allow for predictable testing
-	cp.MergeInterval = 1 * time.Hour
-	cp.TrackActiveDatafileInterval = 1 * time.Hour
+// test that a renamed key keeps its value and expiry, replaces the destination and survives a reopen
+func TestRename(t *testing.T) {
+	cfg := &beck.Config{DataDir: t.TempDir()}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
 
-	db, err := beck.Open(&cp)
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	require.NoError(t, db.Put("old", []byte("value")))
+	require.NoError(t, db.SetExpiry("old", at))
+	require.NoError(t, db.Put("taken", []byte("other")))
+
+	require.ErrorIs(t, db.Rename("missing", "new"), beck.ErrKeyNotFound)
+	require.NoError(t, db.Rename("old", "new"))
+	require.False(t, db.Has("old"))
+	expiry, err := db.GetExpiry("new")
+	require.NoError(t, err)
+	require.True(t, at.Equal(expiry))
+
+	// renaming a key to itself leaves it in place
+	require.NoError(t, db.Rename("new", "new"))
+
+	renamed, err := db.RenameIfAbsent("new", "taken")
+	require.NoError(t, err)
+	require.False(t, renamed)
+	renamed, err = db.RenameIfAbsent("new", "renamed")
+	require.NoError(t, err)
+	require.True(t, renamed)
+	require.NoError(t, db.Rename("renamed", "taken"))
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
 	require.NoError(t, err)
 	defer db.Close()
+	require.Equal(t, []string{"taken"}, db.ListKeys())
+	val, err := db.Get("taken")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+	expiry, err = db.GetExpiry("taken")
+	require.NoError(t, err)
+	require.True(t, at.Equal(expiry))
+}
 
-	// seed 200 entries and rotate active datafile on each 10th entry
-	for idx := range 200 {
-		err = db.Put(fmt.Sprintf("key%d", idx), []byte(fmt.Sprintf("value%d", idx)))
+// test that a copied key keeps its value and expiry, and that the destination is only overwritten on request
+func TestCopy(t *testing.T) {
+	cfg := &beck.Config{DataDir: t.TempDir()}
+	db, err := beck.Open(cfg)
+	require.NoError(t, err)
+
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	require.NoError(t, db.Put("src", []byte("value")))
+	require.NoError(t, db.SetExpiry("src", at))
+	require.NoError(t, db.Put("taken", []byte("other")))
+
+	_, err = db.Copy("missing", "dst", false)
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	for _, dst := range []string{"src", "taken"} {
+		copied, err := db.Copy("src", dst, false)
+		require.NoError(t, err)
+		require.False(t, copied, dst)
+	}
+	copied, err := db.Copy("src", "dst", false)
+	require.NoError(t, err)
+	require.True(t, copied)
+	copied, err = db.Copy("src", "taken", true)
+	require.NoError(t, err)
+	require.True(t, copied)
+	require.NoError(t, db.Close())
+
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, key := range []string{"src", "dst", "taken"} {
+		val, err := db.Get(key)
 		require.NoError(t, err)
+		require.Equal(t, []byte("value"), val, key)
+		expiry, err := db.GetExpiry(key)
+		require.NoError(t, err)
+		require.True(t, at.Equal(expiry), key)
+	}
+}
 
-		if (idx+1)%10 == 0 {
-			db.RotateActiveDatafile()
+// test that ranges of a value are read with negative offsets counting back from the end, and that writing a range
+// pads the value with zero bytes and keeps its expiry
+func TestRanges(t *testing.T) {
+	db, err := beck.Open(&beck.Config{DataDir: t.TempDir(), MaxValueSize: 64})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
 
-		}
+	require.NoError(t, db.Put("key", []byte("This is a string")))
+	for _, tc := range []struct {
+		start, end int
+		want       string
+	}{
+		{0, 3, "This"},
+		{-3, -1, "ing"},
+		{0, -1, "This is a string"},
+		{10, 100, "string"},
+		{-100, 3, "This"},
+		{5, 3, ""},
+		{-1, -5, ""},
+		{100, 200, ""},
+	} {
+		val, err := db.GetRange("key", tc.start, tc.end)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, string(val), "range %d %d", tc.start, tc.end)
 	}
+	_, err = db.GetRange("missing", 0, -1)
+	require.ErrorIs(t, err, beck.ErrKeyNotFound)
 
-	// create tombstone records
-	err = db.Put("key1", []byte("updated_value1"))
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	require.NoError(t, db.SetExpiry("key", at))
+	n, err := db.SetRange("key", 10, []byte("bytes!"))
+	require.NoError(t, err)
+	require.Equal(t, 16, n)
+	n, err = db.SetRange("key", 18, []byte("end"))
 	require.NoError(t, err)
+	require.Equal(t, 21, n)
+	val, err := db.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("This is a bytes!\x00\x00end"), val)
+	expiry, err := db.GetExpiry("key")
+	require.NoError(t, err)
+	require.True(t, at.Equal(expiry))
 
-	err = db.Delete("key2")
+	// an empty write neither creates a key nor pads it
+	n, err = db.SetRange("missing", 5, nil)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.False(t, db.Has("missing"))
+	n, err = db.SetRange("new", 2, []byte("x"))
 	require.NoError(t, err)
+	require.Equal(t, 3, n)
 
-	// merge old datafiles
-	err = db.Compact()
+	_, err = db.SetRange("key", -1, []byte("x"))
+	require.ErrorIs(t, err, beck.ErrInvalidOffset)
+	_, err = db.SetRange("key", math.MaxInt, []byte("x"))
+	require.ErrorIs(t, err, beck.ErrValTooLarge)
+}
+
+// test that coalesced concurrent puts are all written and readable after a reopen
+func TestCoalesceWrites(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_coalesce")
 	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
 
-	// verify data after merge for both live and removed records
-	val, err := db.Get("key1")
+	cfg := &beck.Config{DataDir: dataDir, CoalesceWrites: true}
+	db, err := beck.Open(cfg)
 	require.NoError(t, err)
-	require.Equal(t, []byte("updated_value1"), val)
 
-	_, err = db.Get("key2")
-	require.ErrorIs(t, err, beck.ErrKeyNotFound)
+	var wg sync.WaitGroup
+	for writer := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range 100 {
+				require.NoError(t, db.Put(fmt.Sprintf("key%d-%d", writer, idx), []byte(fmt.Sprintf("value%d", idx))))
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 800, db.KeyCount())
+	require.NoError(t, db.Close())
 
-	// verify put/get still works after merge
-	err = db.Put("new_key", []byte("new_value"))
+	db, err = beck.Open(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, 800, db.KeyCount())
+	val, err := db.Get("key7-99")
 	require.NoError(t, err)
+	require.Equal(t, []byte("value99"), val)
+}
 
-	val, err = db.Get("new_key")
+// test that periodic read verification catches a keydir entry pointing at another key's record
+func TestReadVerification(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "beck_verify")
 	require.NoError(t, err)
-	require.Equal(t, []byte("new_value"), val)
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, ReadVerifyEveryN: 1})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put("key1", []byte("value1")))
+	require.NoError(t, db.Put("key2", []byte("value2")))
+
+	val, err := db.Get("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), val)
+
+	db.PointKeyAt("key1", "key2")
+	_, err = db.Get("key1")
+	require.ErrorIs(t, err, beck.ErrKeyMismatch)
+}
+
+type hintEntry struct {
+	key        string
+	recordSize uint64
+	offset     uint64
+	expiry     int64
+}
+
+// writeHintFile writes raw hint entries in the on-disk hint format
+func writeHintFile(t *testing.T, path string, entries []hintEntry) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(entry.key)))
+		binary.Write(&buf, binary.LittleEndian, entry.recordSize)
+		binary.Write(&buf, binary.LittleEndian, entry.offset)
+		binary.Write(&buf, binary.LittleEndian, entry.expiry)
+		buf.WriteString(entry.key)
+	}
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
 }
 
 // benchmarks
@@ -214,6 +3073,340 @@ func BenchmarkOpenClose(b *testing.B) {
 	}
 }
 
+// this benchmark measures read latency while a background writer performs durable writes
+func BenchmarkGetDuringDurableWrites(b *testing.B) {
+	for _, tt := range []struct {
+		name             string
+		concurrentWrites bool
+	}{
+		{name: "locked writes", concurrentWrites: false},
+		{name: "concurrent writes", concurrentWrites: true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			dataDir, err := os.MkdirTemp("", "beck_bench_rw")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dataDir)
+
+			db, err := beck.Open(&beck.Config{
+				DataDir:          dataDir,
+				MaxFileSize:      maxFileSize,
+				SyncOnWrite:      true,
+				ConcurrentWrites: tt.concurrentWrites,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			val := []byte("mrshabel")
+			if err := db.Put("name", val); err != nil {
+				b.Fatal(err)
+			}
+
+			// keep writing durably until the benchmark completes
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for idx := 0; ; idx++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					db.Put(fmt.Sprintf("key-%d", idx), val)
+				}
+			}()
+
+			b.ResetTimer()
+			for range b.N {
+				if _, err := db.Get("name"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// this benchmark performs 100k small concurrent puts per iteration with and without write coalescing
+func BenchmarkSmallPuts(b *testing.B) {
+	const (
+		puts    = 100_000
+		writers = 16
+	)
+
+	for _, tt := range []struct {
+		name     string
+		coalesce bool
+	}{
+		{name: "per call writes", coalesce: false},
+		{name: "coalesced writes", coalesce: true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			dataDir, err := os.MkdirTemp("", "beck_bench_small")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dataDir)
+
+			db, err := beck.Open(&beck.Config{
+				DataDir:        dataDir,
+				MaxFileSize:    maxFileSize,
+				CoalesceWrites: tt.coalesce,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			val := []byte("v")
+			b.ResetTimer()
+			for range b.N {
+				var wg sync.WaitGroup
+				for writer := range writers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for idx := writer; idx < puts; idx += writers {
+							if err := db.Put(fmt.Sprintf("k%d", idx), val); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+// this benchmark compares random reads from memory-mapped old datafiles against reads through the file
+func BenchmarkRandomGet(b *testing.B) {
+	const keys = 100_000
+
+	for _, tt := range []struct {
+		name    string
+		useMmap bool
+	}{
+		{name: "file reads", useMmap: false},
+		{name: "mmap reads", useMmap: true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			dataDir, err := os.MkdirTemp("", "beck_bench_random")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dataDir)
+
+			cfg := &beck.Config{DataDir: dataDir, MaxFileSize: maxFileSize, UseMmap: tt.useMmap}
+			db, err := beck.Open(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			val := []byte("mrshabel")
+			for idx := range keys {
+				if err := db.Put(fmt.Sprintf("key%d", idx), val); err != nil {
+					b.Fatal(err)
+				}
+			}
+			db.Close()
+
+			// reopen so every record lives in an old datafile
+			db, err = beck.Open(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for idx := range b.N {
+				if _, err := db.Get(fmt.Sprintf("key%d", (idx*7919)%keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// this benchmark compares reads of memory-mapped 4KB values with and without checksum verification
+func BenchmarkVerifyOnRead(b *testing.B) {
+	const keys = 10_000
+
+	for _, tt := range []struct {
+		name       string
+		skipVerify bool
+	}{
+		{name: "verified reads", skipVerify: false},
+		{name: "unverified reads", skipVerify: true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			dataDir := b.TempDir()
+			cfg := &beck.Config{DataDir: dataDir, MaxFileSize: maxFileSize, UseMmap: true, SkipVerifyOnRead: tt.skipVerify}
+			db, err := beck.Open(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			val := bytes.Repeat([]byte("v"), 4<<10)
+			for idx := range keys {
+				if err := db.Put(fmt.Sprintf("key%d", idx), val); err != nil {
+					b.Fatal(err)
+				}
+			}
+			db.Close()
+
+			// reopen so every record lives in an old datafile
+			db, err = beck.Open(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.SetBytes(int64(len(val)))
+			b.ResetTimer()
+			for idx := range b.N {
+				if _, err := db.Get(fmt.Sprintf("key%d", (idx*7919)%keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// this benchmark measures read throughput with many concurrent readers
+func BenchmarkParallelGet(b *testing.B) {
+	const keys = 10_000
+
+	dataDir, err := os.MkdirTemp("", "beck_bench_parallel")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, MaxFileSize: maxFileSize})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	val := []byte("mrshabel")
+	for idx := range keys {
+		if err := db.Put(fmt.Sprintf("key%d", idx), val); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for idx := 0; pb.Next(); idx++ {
+			if _, err := db.Get(fmt.Sprintf("key%d", idx%keys)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// this benchmark compares puts buffered in memory against writing each record directly to the active datafile
+func BenchmarkBufferedPuts(b *testing.B) {
+	for _, tt := range []struct {
+		name       string
+		bufferSize int
+	}{
+		{name: "direct writes", bufferSize: -1},
+		{name: "buffered writes", bufferSize: 0},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			dataDir, err := os.MkdirTemp("", "beck_bench_buffered")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dataDir)
+
+			db, err := beck.Open(&beck.Config{
+				DataDir:         dataDir,
+				MaxFileSize:     maxFileSize,
+				WriteBufferSize: tt.bufferSize,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			val := []byte("mrshabel")
+			b.ResetTimer()
+			for idx := range b.N {
+				if err := db.Put(fmt.Sprintf("key%d", idx), val); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// this benchmark compares merging with buffered writes to the merged files against writing each entry directly
+func BenchmarkCompact(b *testing.B) {
+	const (
+		entries   = 1_000_000
+		batchSize = 10_000
+	)
+
+	for _, tt := range []struct {
+		name       string
+		bufferSize int
+	}{
+		{name: "direct writes", bufferSize: -1},
+		{name: "buffered writes", bufferSize: 0},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				dataDir, err := os.MkdirTemp("", "beck_bench_compact")
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				db, err := beck.Open(&beck.Config{
+					DataDir:         dataDir,
+					MaxFileSize:     maxFileSize,
+					MergeBufferSize: tt.bufferSize,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// seed entries across many datafiles
+				val := []byte("mrshabel")
+				for start := 0; start < entries; start += batchSize {
+					batch := &beck.Batch{}
+					for idx := start; idx < start+batchSize; idx++ {
+						batch.Put(fmt.Sprintf("key%d", idx), val)
+					}
+					if err := db.Write(batch); err != nil {
+						b.Fatal(err)
+					}
+					db.RotateActiveDatafile()
+				}
+
+				b.StartTimer()
+				if err := db.Compact(); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+
+				db.Close()
+				os.RemoveAll(dataDir)
+			}
+		})
+	}
+}
+
 func benchmarkPut(b *testing.B, db *beck.BeckDB) {
 	key := "name"
 	val := []byte("mrshabel")
@@ -248,6 +3441,64 @@ func benchmarkGet(b *testing.B, db *beck.BeckDB) {
 	}
 }
 
+// this benchmark compares replaying a 100MB datafile on open with and without read-ahead
+func BenchmarkReplay(b *testing.B) {
+	const (
+		entries   = 100_000
+		batchSize = 1_000
+	)
+
+	dataDir := b.TempDir()
+	db, err := beck.Open(&beck.Config{DataDir: dataDir, MaxFileSize: 1 << 30})
+	if err != nil {
+		b.Fatal(err)
+	}
+	val := bytes.Repeat([]byte("v"), 1<<10)
+	for start := 0; start < entries; start += batchSize {
+		batch := &beck.Batch{}
+		for idx := start; idx < start+batchSize; idx++ {
+			batch.Put(fmt.Sprintf("key%d", idx), val)
+		}
+		if err := db.Write(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	// read-only opens replay the datafile without writing a hint file for it
+	hintFiles, err := filepath.Glob(filepath.Join(dataDir, "*.hint"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, path := range hintFiles {
+		if err := os.Remove(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name          string
+		readAheadSize int
+	}{
+		{name: "record reads", readAheadSize: -1},
+		{name: "read-ahead", readAheadSize: 0},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			for range b.N {
+				db, err := beck.Open(&beck.Config{DataDir: dataDir, ReadOnly: true, ReadAheadSize: tt.readAheadSize})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := db.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func benchmarkPutGet(b *testing.B, db *beck.BeckDB) {
 	key := "name_test"
 	val := []byte("mrshabel")
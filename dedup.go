@@ -0,0 +1,29 @@
+package beck
+
+// putShared stores val once under its content hash and appends a record of key referencing it. a value already
+// shared by another key is not written again. the entry must already be validated and the caller must hold the
+// write lock
+func (db *BeckDB) putShared(key string, val []byte, expiry int64) error {
+	valueHash := getValueHash(val)
+
+	// the shared value precedes the first record referencing it so replays see it first
+	records := []*record{newValueRefRecord(key, valueHash, expiry)}
+	shared := db.keyDir.value(valueHash) != nil
+	if !shared {
+		records = append([]*record{newSharedValueRecord(valueHash, val)}, records...)
+	}
+
+	sizes, offsets, err := db.activeDatafile.appendBatch(records)
+	if err != nil {
+		return err
+	}
+
+	if !shared {
+		db.keyDir.putValue(valueHash, db.activeIndex, sizes[0], len(val), offsets[0])
+	}
+	last := len(records) - 1
+	db.keyDir.putRef(key, valueHash, db.activeIndex, sizes[last], offsets[last], expiry)
+	db.cache.remove(key)
+	db.metrics.puts.Add(1)
+	return nil
+}
@@ -0,0 +1,45 @@
+package beck
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// bytes an encrypted value adds to the value it seals, for the nonce and tag of AES-GCM
+const encryptionOverhead = 12 + 16
+
+// newAEAD creates the AES-GCM cipher values are encrypted with. the key must be 16, 24 or 32 bytes long, selecting
+// AES-128, AES-192 or AES-256
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue seals val with a random nonce, which is stored ahead of the ciphertext. the key section of the record
+// is authenticated along with it, so a value cannot be moved to another key unnoticed
+// | nonce (12-byte) | ciphertext | tag (16-byte) |
+func encryptValue(aead cipher.AEAD, val []byte, keySection []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(val)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, val, keySection), nil
+}
+
+// decryptValue opens a value sealed by encryptValue. ErrDecryptionFailed is returned without a cipher, or when the
+// value was encrypted with another key
+func decryptValue(aead cipher.AEAD, data []byte, keySection []byte) ([]byte, error) {
+	if aead == nil || len(data) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	val, err := aead.Open(nil, nonce, ciphertext, keySection)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return val, nil
+}
@@ -5,18 +5,33 @@ import "errors"
 // general errors
 var (
 	ErrDatabaseDirectoryRequired = errors.New("database directory is required")
+	ErrInvalidConfig             = errors.New("invalid config")
 	ErrDatabaseNotOpen           = errors.New("database not open")
 	ErrInvalidRecord             = errors.New("invalid record format")
 	ErrInvalidChecksum           = errors.New("invalid value checksum. potential data corruption")
 	ErrIncompleteWrite           = errors.New("incomplete write")
 	ErrDatabaseReadOnly          = errors.New("database opened for read-only operations")
+	ErrHintMismatch              = errors.New("hint file does not match its datafile")
+	ErrHintChecksum              = errors.New("invalid hint checksum. hint file is corrupted")
+	ErrHintFileRequired          = errors.New("hint file is required to recover keys stored only in hint files")
+	ErrKeyMismatch               = errors.New("record on disk belongs to another key. potential index corruption")
+	ErrByteOrderMismatch         = errors.New("configured byte order does not match the datafiles")
+	ErrDecryptionFailed          = errors.New("failed to decrypt value. the encryption key is wrong or the value is corrupted")
+	ErrSnapshotClosed            = errors.New("snapshot closed")
+	ErrDirectoryNotEmpty         = errors.New("directory is not empty")
+	ErrRecordFormat              = errors.New("datafiles are written in an unsupported record format")
 )
 
 // key-val errors
 var (
-	ErrKeyNotFound = errors.New("key not found")
-	ErrInvalidKey  = errors.New("key is invalid")
-	ErrKeyRequired = errors.New("key is required")
-	ErrKeyTooLarge = errors.New("key is too large")
-	ErrValTooLarge = errors.New("value is too large")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrInvalidKey       = errors.New("key is invalid")
+	ErrKeyRequired      = errors.New("key is required")
+	ErrKeyTooLarge      = errors.New("key is too large")
+	ErrValTooLarge      = errors.New("value is too large")
+	ErrInvalidValueSize = errors.New("value size must not be negative")
+	ErrInvalidCursor    = errors.New("invalid or expired scan cursor")
+	ErrValueNotInteger  = errors.New("value is not an integer or out of range")
+	ErrInvalidTTL       = errors.New("ttl must be positive")
+	ErrInvalidOffset    = errors.New("offset must not be negative")
 )
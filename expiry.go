@@ -0,0 +1,68 @@
+package beck
+
+import (
+	"fmt"
+	"time"
+)
+
+// sweepExpiredKeys deletes a sample of the expired keys every expiry sweep interval until the database is closed
+func (db *BeckDB) sweepExpiredKeys() {
+	ticker := time.NewTicker(db.cfg.ExpirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			if err := db.sweepExpired(); err != nil {
+				db.reportError(fmt.Errorf("background expiry sweep: %w", err))
+			}
+		}
+	}
+}
+
+// sweepExpired deletes the expired keys of a random sample of the keys with an expiry. like redis, another sample
+// is taken while more than a quarter of the last one had expired, since many more expired keys are then likely left
+func (db *BeckDB) sweepExpired() error {
+	for range maxExpirySweepRounds {
+		db.mu.RLock()
+		keys, sampled := db.keyDir.sampleExpired(time.Now().UnixMilli())
+		db.mu.RUnlock()
+
+		if err := db.deleteExpired(keys); err != nil {
+			return err
+		}
+		if sampled == 0 || float64(len(keys))/float64(sampled) <= expirySweepRepeatRatio {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deleteExpired appends a tombstone for each key that is still expired, as keys may have been written again
+// since they were sampled
+func (db *BeckDB) deleteExpired(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		if !db.keyDir.expired(key, now) {
+			continue
+		}
+
+		size, _, err := db.activeDatafile.append(newRecord(key, tombstoneVal, 0))
+		if err != nil {
+			return err
+		}
+		db.keyDir.delete(key)
+		db.keyDir.markDead(db.activeIndex, size)
+		db.cache.remove(key)
+	}
+	return nil
+}
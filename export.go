@@ -0,0 +1,165 @@
+package beck
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// exports stream every live key-value pair in sorted key order. The entry format is shown below:
+// | keySize (4-byte) | valSize (8-byte) | key | val |
+// sizes are little-endian whatever the byte order of the datafiles, so exports read the same everywhere
+const exportHeaderLen = keySizeLen + valSizeLen
+
+// Fold calls fn for every live key and its value in sorted key order, stopping at the first error returned by fn.
+// Each value is read at the time it's visited, so concurrent writes can leave the visited pairs mixing states from
+// before and after a write. Use ExportConsistent for a point-in-time view
+func (db *BeckDB) Fold(fn func(key string, val []byte) error) error {
+	db.mu.RLock()
+	entries := db.keyDir.entries()
+	db.mu.RUnlock()
+
+	for _, entry := range entries {
+		val, err := db.Get(entry.key)
+		if errors.Is(err, ErrKeyNotFound) {
+			// deleted since the keys were listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(entry.key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportConsistent writes every live key-value pair to w as they were when the export started, even as writes
+// and merges proceed. The pairs are read from a snapshot taken when the export starts
+func (db *BeckDB) ExportConsistent(w io.Writer) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	bw := bufio.NewWriter(w)
+	err = snap.Fold(func(key string, val []byte) error {
+		return writeExportEntry(bw, key, val)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// pinEntries captures the live keydir entries and pins every datafile they point at. the caller must unpin the
+// returned datafiles
+func (db *BeckDB) pinEntries() ([]keyDirEntry, map[int]*datafile, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries := db.keyDir.entries()
+	files := make(map[int]*datafile)
+	for idx := range entries {
+		// the values of deduplicated keys are read from their shared value
+		h := entries[idx].header
+		if h.valueHash != "" {
+			h = db.keyDir.value(h.valueHash)
+			entries[idx].header = h
+		}
+
+		var df *datafile
+		if h != nil {
+			if _, ok := files[h.fileID]; ok {
+				continue
+			}
+			df = db.oldDataFiles[h.fileID]
+			if h.fileID == db.activeIndex {
+				df = db.activeDatafile
+			}
+		}
+		if df == nil || !df.pin() {
+			for _, pinned := range files {
+				pinned.unpin()
+			}
+			return nil, nil, ErrInvalidKey
+		}
+		files[h.fileID] = df
+	}
+	return entries, files, nil
+}
+
+// writeExportEntry writes a key-value pair in the export format
+func writeExportEntry(w io.Writer, key string, val []byte) error {
+	header := make([]byte, exportHeaderLen)
+	binary.LittleEndian.PutUint32(header[:keySizeLen], uint32(len(key)))
+	binary.LittleEndian.PutUint64(header[keySizeLen:], uint64(len(val)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, key); err != nil {
+		return err
+	}
+	_, err := w.Write(val)
+	return err
+}
+
+// ndjsonEntry is a key-value pair of an NDJSON export, encoded as a JSON object on its own line. values are base64
+// encoded, as are keys that are not valid UTF-8 and would not survive as JSON strings
+type ndjsonEntry struct {
+	Key       string `json:"key,omitempty"`
+	KeyBase64 []byte `json:"keyBase64,omitempty"`
+	Value     []byte `json:"value"`
+}
+
+// ExportNDJSON writes every live key-value pair to w as newline-delimited JSON in sorted key order, one
+// {"key":...,"value":...} object per line with the value base64 encoded. Keys that are not valid UTF-8 are written
+// base64 encoded as "keyBase64" instead. Pairs are read and written one at a time, so memory use does not grow
+// with the size of the database. Like Fold, the export does not reflect a single point in time
+func (db *BeckDB) ExportNDJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err := db.Fold(func(key string, val []byte) error {
+		entry := ndjsonEntry{Key: key, Value: val}
+		if !utf8.ValidString(key) {
+			entry = ndjsonEntry{KeyBase64: []byte(key), Value: val}
+		}
+		return enc.Encode(entry)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportNDJSON puts every key-value pair of an export written by ExportNDJSON, replacing the values of existing
+// keys. Entries are decoded and put one at a time, so memory use does not grow with the size of the import. The
+// import stops at the first invalid entry, leaving the entries before it in place
+func (db *BeckDB) ImportNDJSON(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		var entry ndjsonEntry
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid ndjson entry %d: %w", n, err)
+		}
+
+		key := entry.Key
+		if entry.KeyBase64 != nil {
+			key = string(entry.KeyBase64)
+		}
+		if err := db.Put(key, entry.Value); err != nil {
+			return fmt.Errorf("failed to import ndjson entry %d: %w", n, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package beck
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PointKeyAt redirects the keydir entry of key to the record of target, simulating keydir drift
+func (db *BeckDB) PointKeyAt(key, target string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	h := db.keyDir.get(target)
+	db.keyDir.put(key, h.fileID, h.recordSize, h.valSize, h.recordPosition, h.expiry)
+}
+
+// slowFile delays every write to simulate a slow disk
+type slowFile struct {
+	fileHandle
+	delay time.Duration
+}
+
+func (f *slowFile) Write(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.fileHandle.Write(p)
+}
+
+// SlowDownActiveDatafile makes every write to the active datafile take at least delay. writes are no longer buffered
+func (db *BeckDB) SlowDownActiveDatafile(delay time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.activeDatafile.flush()
+	db.activeDatafile.f = &slowFile{fileHandle: db.activeDatafile.f, delay: delay}
+	db.activeDatafile.w = nil
+}
+
+// countingFile counts the reads made from a file
+type countingFile struct {
+	fileHandle
+	reads *atomic.Int64
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads.Add(1)
+	return f.fileHandle.ReadAt(p, off)
+}
+
+// CountActiveDatafileReads counts every read made from the active datafile from now on
+func (db *BeckDB) CountActiveDatafileReads() *atomic.Int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	reads := &atomic.Int64{}
+	db.activeDatafile.f = &countingFile{fileHandle: db.activeDatafile.f, reads: reads}
+	return reads
+}
+
+// failingFile fails every sync with err
+type failingFile struct {
+	fileHandle
+	err error
+}
+
+func (f *failingFile) Sync() error {
+	return f.err
+}
+
+// FailActiveDatafileSyncs makes every sync of the active datafile fail with err
+func (db *BeckDB) FailActiveDatafileSyncs(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.activeDatafile.f = &failingFile{fileHandle: db.activeDatafile.f, err: err}
+}
+
+// OpenOldDatafiles returns the number of old datafiles whose file handle is open
+func (db *BeckDB) OpenOldDatafiles() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	open := 0
+	for _, df := range db.oldDataFiles {
+		if df.isOpen() {
+			open++
+		}
+	}
+	return open
+}
+
+// ActiveFileID returns the id of the active datafile
+func (db *BeckDB) ActiveFileID() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.activeIndex
+}
+
+// gatedFile blocks every read until the gate is released
+type gatedFile struct {
+	fileHandle
+	entered chan struct{}
+	once    *sync.Once
+	gate    <-chan struct{}
+}
+
+func (f *gatedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.once.Do(func() { close(f.entered) })
+	<-f.gate
+	return f.fileHandle.ReadAt(p, off)
+}
+
+// GateOldDatafileReads blocks every read from the old datafiles until release is called. entered is closed once
+// the first read is blocked
+func (db *BeckDB) GateOldDatafileReads() (entered <-chan struct{}, release func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	enteredCh := make(chan struct{})
+	gate := make(chan struct{})
+	once := &sync.Once{}
+	for _, df := range db.oldDataFiles {
+		df.mu.Lock()
+		df.munmap()
+		df.mapped = false
+		df.f = &gatedFile{fileHandle: df.f, entered: enteredCh, once: once, gate: gate}
+		df.mu.Unlock()
+	}
+	return enteredCh, func() { close(gate) }
+}
+
+// GetDatafiles lists the datafiles of a directory in the order they are loaded
+var GetDatafiles = getDatafiles
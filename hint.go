@@ -3,24 +3,43 @@ package beck
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
 )
 
 // hintfile contains a snapshot of the datafile for quick bootstrap when building the keydir from an existing datafile
-// | keySize (4-byte) | record size (8-byte) | record offset (8-byte) | key |
+// | crc (4-byte) | keySize (4-byte) | record size (8-byte) | record offset (8-byte) | expiry (8-byte) | key |
+// the crc covers everything in the entry after itself. keySize carries the flags of the datafile record. entries of
+// records referencing a shared value hold the 32-byte content hash of the value after the key, and entries of records
+// with a compressed value end with the 8-byte length of the value once decompressed.
+// hint files start with a magic header. files written before entries carried a crc have no header and are read
+// without verifying their entries
 
 // section lengths in bytes
 const (
 	hintRecordSizeLen   = 8
 	hintRecordOffsetLen = 8
-	// header size without actual key and data (20 bytes)
-	hintHeaderLen = keySizeLen + hintRecordSizeLen + hintRecordOffsetLen
+	// header size without actual key and data (32 bytes)
+	hintHeaderLen = crcLen + keySizeLen + hintRecordSizeLen + hintRecordOffsetLen + expiryLen
+	// header size of entries in hint files without a magic header (28 bytes)
+	legacyHintHeaderLen = hintHeaderLen - crcLen
 )
 
+// magic header of hint files whose entries carry a crc
+const hintFileMagic = "BECKHNT2"
+
+// length of the value length carried by entries of compressed records
+const hintValueLenLen = 8
+
 type hintFile struct {
 	f *os.File
 
+	// whether the entries carry a crc. false for hint files written before the magic header
+	checksummed bool
+	// byte order of the encoded entries
+	enc binary.ByteOrder
+
 	readOnly bool
 	mu       sync.RWMutex
 }
@@ -30,9 +49,29 @@ type hintRecord struct {
 	key            string
 	recordSize     int
 	recordPosition uint64
+	expiry         int64
+	// whether the datafile record stores the hash of the key instead of the key
+	keyHashed bool
+	// content hash of the shared value the record references, and whether the record holds a shared value keyed
+	// by its content hash
+	valueHash string
+	shared    bool
+	// whether the datafile record stores its value compressed and encrypted
+	compressed bool
+	encrypted  bool
+	// length of a compressed value once decompressed. unknownValSize for entries of hint files without a magic header
+	valSize int
+}
+
+// storedKeyLen returns the length of the key section of the datafile record
+func (h *hintRecord) storedKeyLen() int {
+	if h.keyHashed {
+		return keyHashLen
+	}
+	return len(h.key)
 }
 
-func NewHintFile(name string, readOnly bool) (*hintFile, error) {
+func NewHintFile(name string, readOnly bool, enc binary.ByteOrder) (*hintFile, error) {
 	// open file in append only mode if mode is rw
 	perm := os.O_RDONLY
 	if !readOnly {
@@ -47,32 +86,99 @@ func NewHintFile(name string, readOnly bool) (*hintFile, error) {
 	df := &hintFile{
 		f:        f,
 		readOnly: readOnly,
+		enc:      enc,
+	}
+	if err := df.readMagic(); err != nil {
+		f.Close()
+		return nil, err
 	}
 
 	return df, nil
 }
 
-// append writes a hint record to the file
-func (h *hintFile) append(key string, recordSize int, recordPosition uint64) (err error) {
-	// skip if hint file is opened in read-only mode
+// readMagic positions the file after its magic header and records whether its entries carry a crc. the header is
+// written to new files opened for writing
+func (h *hintFile) readMagic() error {
+	info, err := h.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 && !h.readOnly {
+		h.checksummed = true
+		_, err := io.WriteString(h.f, hintFileMagic)
+		return err
+	}
+
+	magic := make([]byte, len(hintFileMagic))
+	if _, err := io.ReadFull(h.f, magic); err == nil && string(magic) == hintFileMagic {
+		h.checksummed = true
+		return nil
+	}
+	// entries of legacy hint files start right away
+	_, err = h.f.Seek(0, io.SeekStart)
+	return err
+}
+
+// write appends already encoded hint records to the file
+func (h *hintFile) write(data []byte) error {
 	if h.readOnly {
 		return ErrDatabaseReadOnly
 	}
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	_, err := h.f.Write(data)
+	return err
+}
+
+// appendTo writes a hint record to w instead of the file. w is expected to be a buffer that is flushed to the file
+func (h *hintFile) appendTo(w io.Writer, hint *hintRecord) error {
+	if h.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	_, err := w.Write(encodeHint(hint, h.enc))
+	return err
+}
+
+// encodeHint returns the hint record encoded in the given byte order as specified in the documentation
+func encodeHint(hint *hintRecord, enc binary.ByteOrder) []byte {
 	var buf bytes.Buffer
-	keyBytes := []byte(key)
+	keyBytes := []byte(hint.key)
 
-	binary.Write(&buf, enc, uint32(len(keyBytes)))
-	binary.Write(&buf, enc, uint64(recordSize))
-	binary.Write(&buf, enc, recordPosition)
+	keySize := uint32(len(keyBytes))
+	if hint.keyHashed {
+		keySize |= keyHashedFlag
+	}
+	if hint.valueHash != "" {
+		keySize |= valueRefFlag
+	}
+	if hint.shared {
+		keySize |= sharedValueFlag
+	}
+	if hint.compressed {
+		keySize |= compressedFlag
+	}
+	if hint.encrypted {
+		keySize |= encryptedFlag
+	}
+	// leave room for the crc
+	buf.Write(make([]byte, crcLen))
+	binary.Write(&buf, enc, keySize)
+	binary.Write(&buf, enc, uint64(hint.recordSize))
+	binary.Write(&buf, enc, hint.recordPosition)
+	binary.Write(&buf, enc, hint.expiry)
 
-	// write key
+	// write key followed by the hash of a referenced shared value and the length of a compressed value
 	buf.Write(keyBytes)
+	buf.WriteString(hint.valueHash)
+	if hint.compressed {
+		binary.Write(&buf, enc, uint64(hint.valSize))
+	}
 
-	_, err = h.f.Write(buf.Bytes())
-	return err
+	data := buf.Bytes()
+	enc.PutUint32(data[:crcLen], getChecksum(data[crcLen:]))
+	return data
 }
 
 // readNext reads the next record from the hint file without resetting the offset position
@@ -80,19 +186,26 @@ func (h *hintFile) readNext() (*hintRecord, error) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	// extract header
-	header := make([]byte, hintHeaderLen)
-	n, err := h.f.Read(header)
+	// extract header. entries of legacy hint files have no crc
+	headerSize := hintHeaderLen
+	if !h.checksummed {
+		headerSize = legacyHintHeaderLen
+	}
+	entry := make([]byte, headerSize)
+	n, err := h.f.Read(entry)
 	if err != nil {
 		return nil, err
 	}
-	if n < hintHeaderLen {
+	if n < headerSize {
 		return nil, ErrInvalidRecord
 	}
+	header := entry[headerSize-legacyHintHeaderLen:]
 
-	keySize := int(enc.Uint32(header[:keySizeLen]))
-	recordSize := int(enc.Uint64(header[keySizeLen : keySizeLen+hintRecordSizeLen]))
-	recordPosition := int(enc.Uint64(header[keySizeLen+hintRecordSizeLen : keySizeLen+hintRecordSizeLen+hintRecordOffsetLen]))
+	rawKeySize := h.enc.Uint32(header[:keySizeLen])
+	keySize := int(rawKeySize &^ keyFlags)
+	recordSize := int(h.enc.Uint64(header[keySizeLen : keySizeLen+hintRecordSizeLen]))
+	recordPosition := int(h.enc.Uint64(header[keySizeLen+hintRecordSizeLen : keySizeLen+hintRecordSizeLen+hintRecordOffsetLen]))
+	expiry := int64(h.enc.Uint64(header[keySizeLen+hintRecordSizeLen+hintRecordOffsetLen:]))
 
 	// read key
 	keyBytes := make([]byte, keySize)
@@ -103,12 +216,54 @@ func (h *hintFile) readNext() (*hintRecord, error) {
 	if n < keySize {
 		return nil, ErrInvalidRecord
 	}
+	entry = append(entry, keyBytes...)
 
-	return &hintRecord{
+	hint := &hintRecord{
 		key:            string(keyBytes),
 		recordPosition: uint64(recordPosition),
 		recordSize:     recordSize,
-	}, nil
+		expiry:         expiry,
+		keyHashed:      rawKeySize&keyHashedFlag != 0,
+		shared:         rawKeySize&sharedValueFlag != 0,
+		compressed:     rawKeySize&compressedFlag != 0,
+		encrypted:      rawKeySize&encryptedFlag != 0,
+	}
+
+	// read the hash of the referenced shared value
+	if rawKeySize&valueRefFlag != 0 {
+		valueHash := make([]byte, valueHashLen)
+		n, err = h.f.Read(valueHash)
+		if err != nil {
+			return nil, err
+		}
+		if n < valueHashLen {
+			return nil, ErrInvalidRecord
+		}
+		hint.valueHash = string(valueHash)
+		entry = append(entry, valueHash...)
+	}
+
+	// read the length of a compressed value
+	if hint.compressed {
+		hint.valSize = unknownValSize
+	}
+	if hint.compressed && h.checksummed {
+		valueLen := make([]byte, hintValueLenLen)
+		n, err = h.f.Read(valueLen)
+		if err != nil {
+			return nil, err
+		}
+		if n < hintValueLenLen {
+			return nil, ErrInvalidRecord
+		}
+		hint.valSize = int(h.enc.Uint64(valueLen))
+		entry = append(entry, valueLen...)
+	}
+
+	if h.checksummed && h.enc.Uint32(entry[:crcLen]) != getChecksum(entry[crcLen:]) {
+		return nil, ErrHintChecksum
+	}
+	return hint, nil
 }
 
 // persist flushes all buffered writes to disk instantly
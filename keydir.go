@@ -3,6 +3,8 @@ package beck
 // keydir is the in-memory index handler of the entire database. It maps keys to their respective headers
 
 import (
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,15 +12,48 @@ import (
 type keyDir struct {
 	// map of key to header
 	data map[string]*header
-	mu   sync.RWMutex
+	// sorted key snapshots of in-progress scans keyed by their generation
+	scans   map[uint32][]string
+	scanGen uint32
+	// bytes of superseded, deleted and tombstone records per datafile, which a merge reclaims, and the bytes of the
+	// records the keydir points at
+	dead map[int]int64
+	live int64
+	// shared values of deduplicated keys by their content hash
+	values map[string]*sharedValue
+	// version of the last header set, and the version of the last key removed. removals take a version of their own
+	// so a key set and removed again never reports the version it had before
+	version uint64
+	deleted uint64
+	mu      sync.RWMutex
 }
 
+// valSize of values whose length is only known once they're read
+const unknownValSize = -1
+
 type header struct {
 	fileID     int
 	recordSize int
+	// length of the stored value. this allows size queries without reading the record from disk. unknownValSize
+	// for compressed values replayed from hint files, which are read to find their length
+	valSize int
 	// position marking the start of the full record on disk
 	recordPosition uint64
 	timestamp      int64
+	// unix timestamp in milliseconds after which the key is no longer visible. 0 if it never expires
+	expiry int64
+	// content hash of the shared value the record references or holds. empty unless the value is deduplicated
+	valueHash string
+	// increasing number assigned each time the key is set, so a changed key can be told apart from an unchanged one.
+	// it's kept when a merge moves the record
+	version uint64
+}
+
+// sharedValue is the record of a value stored once for every key holding it, along with the number of keys
+// referencing it
+type sharedValue struct {
+	header *header
+	refs   int
 }
 
 type keyDirEntry struct {
@@ -28,34 +63,68 @@ type keyDirEntry struct {
 
 func NewKeyDir() *keyDir {
 	return &keyDir{
-		data: make(map[string]*header),
+		data:   make(map[string]*header),
+		scans:  make(map[uint32][]string),
+		dead:   make(map[int]int64),
+		values: make(map[string]*sharedValue),
 	}
 }
 
+// get returns the header of a key. expired keys are treated as missing
 func (k *keyDir) get(key string) *header {
 	k.mu.RLock()
 	defer k.mu.RUnlock()
 	h, ok := k.data[key]
-	if !ok {
+	if !ok || expired(h.expiry, time.Now().UnixMilli()) {
 		return nil
 	}
 
 	return h
 }
 
-func (k *keyDir) put(key string, fileID int, recordSize int, recordPosition uint64) bool {
+func (k *keyDir) put(key string, fileID int, recordSize int, valSize int, recordPosition uint64, expiry int64) bool {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	// override if it exists
-	val := k.data[key]
+	return k.set(key, &header{
+		fileID:         fileID,
+		recordSize:     recordSize,
+		valSize:        valSize,
+		recordPosition: recordPosition,
+		timestamp:      time.Now().Unix(),
+		expiry:         expiry,
+	})
+}
 
-	k.data[key] = &header{
+// putRef points key at a record referencing the shared value with the given content hash. the shared value must
+// already be in the keydir
+func (k *keyDir) putRef(key string, valueHash string, fileID int, recordSize int, recordPosition uint64, expiry int64) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	h := &header{
 		fileID:         fileID,
 		recordSize:     recordSize,
 		recordPosition: recordPosition,
 		timestamp:      time.Now().Unix(),
+		expiry:         expiry,
+		valueHash:      valueHash,
 	}
+	if v, ok := k.values[valueHash]; ok {
+		h.valSize = v.header.valSize
+	}
+	return k.set(key, h)
+}
+
+// set points key at h. the caller must hold the write lock
+func (k *keyDir) set(key string, h *header) bool {
+	// override if it exists. the record of the previous value becomes reclaimable unless it's the same record
+	val := k.data[key]
+	k.supersede(val, h)
+
+	k.version++
+	h.version = k.version
+	k.data[key] = h
 	return val != nil
 }
 
@@ -65,6 +134,9 @@ func (k *keyDir) putBatch(entries []keyDirEntry) {
 	defer k.mu.Unlock()
 
 	for _, entry := range entries {
+		k.supersede(k.data[entry.key], entry.header)
+		k.version++
+		entry.header.version = k.version
 		k.data[entry.key] = entry.header
 	}
 }
@@ -72,21 +144,391 @@ func (k *keyDir) putBatch(entries []keyDirEntry) {
 func (k *keyDir) delete(key string) bool {
 	k.mu.Lock()
 	defer k.mu.Unlock()
-	if _, ok := k.data[key]; !ok {
+	h, ok := k.data[key]
+	if !ok {
 		return false
 	}
 
+	k.dead[h.fileID] += int64(h.recordSize)
+	k.live -= int64(h.recordSize)
+	k.unref(h.valueHash)
 	delete(k.data, key)
+	k.version++
+	k.deleted = k.version
 	return true
 }
 
+// supersede marks the record of prev reclaimable once a key points at next instead. replaying the same record twice
+// reclaims nothing. the caller must hold the write lock
+func (k *keyDir) supersede(prev *header, next *header) {
+	k.live += int64(next.recordSize)
+	k.ref(next.valueHash)
+	if prev == nil {
+		return
+	}
+	k.live -= int64(prev.recordSize)
+	k.unref(prev.valueHash)
+	if prev.fileID != next.fileID || prev.recordPosition != next.recordPosition {
+		k.dead[prev.fileID] += int64(prev.recordSize)
+	}
+}
+
+// putValue records the location of the shared value with the given content hash, keeping the keys referencing it.
+// a relocated shared value leaves its previous record reclaimable
+func (k *keyDir) putValue(valueHash string, fileID int, recordSize int, valSize int, recordPosition uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	h := &header{
+		fileID:         fileID,
+		recordSize:     recordSize,
+		valSize:        valSize,
+		recordPosition: recordPosition,
+		timestamp:      time.Now().Unix(),
+		valueHash:      valueHash,
+	}
+	k.live += int64(recordSize)
+
+	v, ok := k.values[valueHash]
+	if !ok {
+		k.values[valueHash] = &sharedValue{header: h}
+		return
+	}
+	k.live -= int64(v.header.recordSize)
+	if v.header.fileID != fileID || v.header.recordPosition != recordPosition {
+		k.dead[v.header.fileID] += int64(v.header.recordSize)
+	}
+	v.header = h
+}
+
+// value returns the header of the record holding the shared value with the given content hash, nil if no key
+// references it
+func (k *keyDir) value(valueHash string) *header {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	v, ok := k.values[valueHash]
+	if !ok {
+		return nil
+	}
+	return v.header
+}
+
+// ref adds a reference to the shared value with the given content hash. the caller must hold the write lock
+func (k *keyDir) ref(valueHash string) {
+	if v, ok := k.values[valueHash]; ok {
+		v.refs++
+	}
+}
+
+// unref removes a reference to the shared value with the given content hash. the record of a shared value no key
+// references anymore becomes reclaimable. the caller must hold the write lock
+func (k *keyDir) unref(valueHash string) {
+	v, ok := k.values[valueHash]
+	if !ok {
+		return
+	}
+	v.refs--
+	if v.refs <= 0 {
+		k.dropValue(valueHash, v)
+	}
+}
+
+// dropValue removes a shared value, leaving its record reclaimable. the caller must hold the write lock
+func (k *keyDir) dropValue(valueHash string, v *sharedValue) {
+	k.live -= int64(v.header.recordSize)
+	k.dead[v.header.fileID] += int64(v.header.recordSize)
+	delete(k.values, valueHash)
+}
+
+// dropUnreferencedValues removes the shared values no key references, such as the values of keys deleted before
+// the datafiles were replayed
+func (k *keyDir) dropUnreferencedValues() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for valueHash, v := range k.values {
+		if v.refs == 0 {
+			k.dropValue(valueHash, v)
+		}
+	}
+}
+
+// markDead records size bytes of a datafile as reclaimable. this accounts for records the keydir never points at,
+// such as tombstones
+func (k *keyDir) markDead(fileID int, size int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.dead[fileID] += int64(size)
+}
+
+// resetDead clears the reclaimable bytes of datafiles that were removed or rewritten by a merge
+func (k *keyDir) resetDead(fileIDs ...int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, fileID := range fileIDs {
+		delete(k.dead, fileID)
+	}
+}
+
+// liveBytes returns the size of the records the keydir points at
+func (k *keyDir) liveBytes() int64 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.live
+}
+
+// deadBytes returns the reclaimable bytes of a datafile
+func (k *keyDir) deadBytes(fileID int) int64 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.dead[fileID]
+}
+
+// sampleExpired visits keys with an expiry in the random order the keydir is iterated in, and returns those that
+// have expired along with the number of keys with an expiry visited. the sample ends after expirySampleSize keys
+// with an expiry or expirySampleVisits keys in all, so keydirs with few expiring keys are not scanned whole
+func (k *keyDir) sampleExpired(now int64) ([]string, int) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var keys []string
+	sampled, visited := 0, 0
+	for key, h := range k.data {
+		if sampled == expirySampleSize || visited == expirySampleVisits {
+			break
+		}
+		visited++
+		if h.expiry == 0 {
+			continue
+		}
+		sampled++
+		if expired(h.expiry, now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, sampled
+}
+
+// expired reports whether the key exists and has expired
+func (k *keyDir) expired(key string, now int64) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	h, ok := k.data[key]
+	return ok && expired(h.expiry, now)
+}
+
+// len returns the number of keys. like redis, expired keys that have not been reclaimed yet are counted
+func (k *keyDir) len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return len(k.data)
+}
+
 func (k *keyDir) listKeys() []string {
 	k.mu.RLock()
 	defer k.mu.RUnlock()
 
+	now := time.Now().UnixMilli()
 	keys := make([]string, 0, len(k.data))
-	for key := range k.data {
-		keys = append(keys, key)
+	for key, h := range k.data {
+		if !expired(h.expiry, now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// entries returns the headers of all live keys in sorted key order. headers are never modified in place, so the
+// entries are a point-in-time view of the keydir
+func (k *keyDir) entries() []keyDirEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	entries := make([]keyDirEntry, 0, len(k.data))
+	for key, h := range k.data {
+		if !expired(h.expiry, now) {
+			entries = append(entries, keyDirEntry{key: key, header: h})
+		}
+	}
+	slices.SortFunc(entries, func(a, b keyDirEntry) int { return strings.Compare(a.key, b.key) })
+	return entries
+}
+
+// prefixScan returns all keys starting with the given prefix in sorted order
+func (k *keyDir) prefixScan(prefix string) []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	keys := []string{}
+	for key, h := range k.data {
+		if strings.HasPrefix(key, prefix) && !expired(h.expiry, now) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// keyVersion returns the version of a key. missing and expired keys have the version of the last key removed
+func (k *keyDir) keyVersion(key string) uint64 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	h, ok := k.data[key]
+	if !ok || expired(h.expiry, time.Now().UnixMilli()) {
+		return k.deleted
+	}
+	return h.version
+}
+
+// prefixVersion returns the highest version among the keys starting with prefix and the last key removed
+func (k *keyDir) prefixVersion(prefix string) uint64 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	version := k.deleted
+	for key, h := range k.data {
+		if strings.HasPrefix(key, prefix) && !expired(h.expiry, now) {
+			version = max(version, h.version)
+		}
+	}
+	return version
+}
+
+// dropDangling removes keys whose headers point into any of the given files, except the keys to keep.
+// the removed keys are returned
+func (k *keyDir) dropDangling(fileIDs map[int]bool, keep map[string]bool) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	dropped := []string{}
+	for key, h := range k.data {
+		if fileIDs[h.fileID] && !keep[key] {
+			k.live -= int64(h.recordSize)
+			k.unref(h.valueHash)
+			delete(k.data, key)
+			dropped = append(dropped, key)
+		}
+	}
+	if len(dropped) > 0 {
+		k.version++
+		k.deleted = k.version
+	}
+	return dropped
+}
+
+// scan returns up to count keys from the scan identified by the cursor along with the cursor to resume from.
+// a zero cursor starts a new scan over a sorted snapshot of the keys and a zero cursor is returned once the scan
+// completes. the cursor holds the scan generation in its upper 32 bits and the snapshot position in the lower bits
+func (k *keyDir) scan(cursor uint64, count int) ([]string, uint64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if cursor == 0 {
+		if len(k.data) == 0 {
+			return []string{}, 0, nil
+		}
+		keys := make([]string, 0, len(k.data))
+		for key := range k.data {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		// start a new generation and evict the oldest abandoned scan
+		k.scanGen++
+		k.scans[k.scanGen] = keys
+		delete(k.scans, k.scanGen-maxScanSnapshots)
+		cursor = uint64(k.scanGen) << 32
+	}
+
+	gen, pos := uint32(cursor>>32), int(uint32(cursor))
+	keys, ok := k.scans[gen]
+	if !ok || pos > len(keys) {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	// skip keys removed or expired since the snapshot was taken
+	now := time.Now().UnixMilli()
+	end := min(pos+count, len(keys))
+	batch := []string{}
+	for _, key := range keys[pos:end] {
+		if h, exists := k.data[key]; exists && !expired(h.expiry, now) {
+			batch = append(batch, key)
+		}
+	}
+
+	if end == len(keys) {
+		delete(k.scans, gen)
+		return batch, 0, nil
+	}
+	return batch, uint64(gen)<<32 | uint64(end), nil
+}
+
+// recordLocation identifies a record by its datafile and offset
+type recordLocation struct {
+	fileID         int
+	recordPosition uint64
+}
+
+// relocation moves a key or shared value from the record it was merged from to its record in the merged datafile
+type relocation struct {
+	key    string
+	from   recordLocation
+	header *header
+	// whether key is the content hash of a shared value
+	shared bool
+}
+
+// relocate points keys and shared values at their merged records. those rewritten or removed since they were
+// merged keep their current record, leaving the merged record reclaimable. the caller must hold the write lock
+func (k *keyDir) relocate(relocations []relocation) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, r := range relocations {
+		var current *header
+		if r.shared {
+			if v, ok := k.values[r.key]; ok {
+				current = v.header
+			}
+		} else {
+			current = k.data[r.key]
+		}
+
+		if current == nil || current.fileID != r.from.fileID || current.recordPosition != r.from.recordPosition {
+			k.dead[r.header.fileID] += int64(r.header.recordSize)
+			continue
+		}
+
+		// the value reference is unchanged, so shared values keep their reference counts
+		k.live += int64(r.header.recordSize - current.recordSize)
+		r.header.version = current.version
+		if r.shared {
+			k.values[r.key].header = r.header
+		} else {
+			k.data[r.key] = r.header
+		}
+	}
+}
+
+// keysByLocation maps the location of every record the keydir points at to its key
+func (k *keyDir) keysByLocation() map[recordLocation]string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make(map[recordLocation]string, len(k.data))
+	for key, h := range k.data {
+		keys[recordLocation{fileID: h.fileID, recordPosition: h.recordPosition}] = key
 	}
 	return keys
 }
@@ -0,0 +1,230 @@
+package beck
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// the manifest records how the datafiles of a data directory are encoded, so every open reads them the way they
+// were written. directories created before the manifest hold little-endian datafiles in either record format, and
+// those holding the first format are refused rather than read as empty
+const manifestFileName = "MANIFEST"
+
+// record formats of the datafiles. the first has no expiry in its 24-byte header and its crc covers only the key
+// and the value
+const (
+	legacyRecordFormat = 1
+	recordFormat       = 2
+
+	legacyHeaderLen = crcLen + timestampLen + keySizeLen + valSizeLen
+)
+
+type manifest struct {
+	ByteOrder string `json:"byteOrder"`
+	// record format of the datafiles. 0 in manifests written before the format was recorded
+	Version int `json:"version"`
+	// ids of the datafiles discarded by a clear, recorded until they are all removed
+	Cleared []int `json:"cleared,omitempty"`
+}
+
+// supported byte orders by name
+var byteOrders = map[string]binary.ByteOrder{
+	binary.LittleEndian.String(): binary.LittleEndian,
+	binary.BigEndian.String():    binary.BigEndian,
+}
+
+// loadManifest settles the byte order of the datafiles from the manifest of the data directory, writing the
+// manifest when the directory has none. ErrByteOrderMismatch is returned if the configured byte order differs
+// from the one the datafiles were written in. the ids of datafiles left behind by an interrupted clear are returned
+func (db *BeckDB) loadManifest() ([]int, error) {
+	if db.cfg.ByteOrder != nil {
+		if _, ok := byteOrders[db.cfg.ByteOrder.String()]; !ok {
+			return nil, fmt.Errorf("unsupported byte order %s", db.cfg.ByteOrder)
+		}
+	}
+
+	path := filepath.Join(db.cfg.DataDir, manifestFileName)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	// directories with datafiles but no manifest predate it
+	if err != nil {
+		datafiles, err := getDatafiles(db.cfg.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		db.enc = db.cfg.ByteOrder
+		if db.enc == nil || len(datafiles) > 0 {
+			db.enc = binary.LittleEndian
+		}
+		if db.cfg.ByteOrder != nil && db.cfg.ByteOrder.String() != db.enc.String() {
+			return nil, ErrByteOrderMismatch
+		}
+		if err := checkRecordFormat(db.cfg.DataDir, 0); err != nil {
+			return nil, err
+		}
+		if db.cfg.ReadOnly {
+			return nil, nil
+		}
+		return nil, db.writeManifestCleared(nil)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	enc, ok := byteOrders[m.ByteOrder]
+	if !ok {
+		return nil, fmt.Errorf("unsupported byte order %q in manifest", m.ByteOrder)
+	}
+	if db.cfg.ByteOrder != nil && db.cfg.ByteOrder.String() != m.ByteOrder {
+		return nil, ErrByteOrderMismatch
+	}
+	if err := checkRecordFormat(db.cfg.DataDir, m.Version); err != nil {
+		return nil, err
+	}
+	db.enc = enc
+	// stamp the format on manifests written before it was recorded
+	if m.Version == 0 && !db.cfg.ReadOnly {
+		if err := db.writeManifestCleared(m.Cleared); err != nil {
+			return nil, err
+		}
+	}
+	return m.Cleared, nil
+}
+
+// readManifest returns the byte order recorded in the manifest of dataDir and the ids of the datafiles discarded by
+// an interrupted clear. directories without a manifest predate it and hold little-endian datafiles
+func readManifest(dataDir string) (binary.ByteOrder, []int, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return binary.LittleEndian, nil, checkRecordFormat(dataDir, 0)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	enc, ok := byteOrders[m.ByteOrder]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported byte order %q in manifest", m.ByteOrder)
+	}
+	if err := checkRecordFormat(dataDir, m.Version); err != nil {
+		return nil, nil, err
+	}
+	return enc, m.Cleared, nil
+}
+
+// checkRecordFormat returns ErrRecordFormat unless the datafiles of dataDir are written in the current record format.
+// an unrecorded version is settled from the first record of the datafiles
+func checkRecordFormat(dataDir string, version int) error {
+	if version == 0 {
+		var err error
+		if version, err = probeRecordFormat(dataDir); err != nil {
+			return err
+		}
+	}
+	if version != recordFormat {
+		return fmt.Errorf("%w: found version %d, expected version %d", ErrRecordFormat, version, recordFormat)
+	}
+	return nil
+}
+
+// probeRecordFormat reports the legacy format if the first record of the oldest non-empty datafile in dataDir
+// decodes with a valid checksum in it, and the current format otherwise. legacy datafiles are always little-endian
+func probeRecordFormat(dataDir string) (int, error) {
+	datafiles, err := getDatafiles(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range datafiles {
+		format, ok, err := probeDatafile(path)
+		if err != nil || ok {
+			return format, err
+		}
+	}
+	return recordFormat, nil
+}
+
+// writeManifestCleared records the ids of the datafiles discarded by a clear in the manifest. nil ids record that
+// none are left
+func (db *BeckDB) writeManifestCleared(fileIDs []int) error {
+	m := &manifest{ByteOrder: db.enc.String(), Version: recordFormat, Cleared: fileIDs}
+	return writeManifest(filepath.Join(db.cfg.DataDir, manifestFileName), m)
+}
+
+// removeCleared finishes a clear interrupted before it removed the datafiles it discarded
+func (db *BeckDB) removeCleared(fileIDs []int) error {
+	for _, fileID := range fileIDs {
+		for _, path := range []string{getDatafilePath(db.cfg.DataDir, fileID), getHintFilePath(db.cfg.DataDir, fileID)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove cleared datafile: %w", err)
+			}
+		}
+	}
+	return db.writeManifestCleared(nil)
+}
+
+// writeManifest atomically replaces the manifest at path
+func writeManifest(path string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + tempFileExt
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// probeDatafile reports the record format of the first record in the datafile at path. ok is false if the datafile
+// is too short to hold a record
+func probeDatafile(path string) (format int, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read datafile: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read datafile: %w", err)
+	}
+	header := make([]byte, legacyHeaderLen)
+	if fi.Size() < legacyHeaderLen {
+		return 0, false, nil
+	}
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0, false, fmt.Errorf("failed to read datafile: %w", err)
+	}
+
+	enc := binary.LittleEndian
+	checksum := enc.Uint32(header[:crcLen])
+	keySize := uint64(enc.Uint32(header[crcLen+timestampLen:]))
+	valSize := enc.Uint64(header[crcLen+timestampLen+keySizeLen:])
+	size := uint64(fi.Size()) - legacyHeaderLen
+	if keySize > size || valSize > size-keySize {
+		return recordFormat, true, nil
+	}
+	body := make([]byte, keySize+valSize)
+	if _, err := f.ReadAt(body, legacyHeaderLen); err != nil {
+		return 0, false, fmt.Errorf("failed to read datafile: %w", err)
+	}
+	if getChecksum(body) == checksum {
+		return legacyRecordFormat, true, nil
+	}
+	return recordFormat, true, nil
+}
@@ -1,129 +1,444 @@
 package beck
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 )
 
 type entry struct {
-	key string
-	val []byte
+	key    string
+	val    []byte
+	expiry int64
+	// whether val holds the content hash of a shared value, and whether the entry is a shared value keyed by its
+	// content hash
+	valueRef bool
+	shared   bool
+	// location of the record the entry was read from
+	from recordLocation
 }
 
-// compaction and background merging of old datafiles to produce a single datafile and hint file
+// record returns the record the entry is written as
+func (e entry) record() *record {
+	r := newRecord(e.key, e.val, e.expiry)
+	r.valueRef = e.valueRef
+	r.shared = e.shared
+	return r
+}
+
+// compaction and background merging of old datafiles to produce a single datafile and hint file.
+// old datafiles are never appended to, so they are read and the merged files are written without holding the db
+// lock. reads and writes proceed meanwhile, and the lock is only taken briefly to pick the datafiles to merge and to
+// swap in the merged file. concurrent calls are serialized
 func (db *BeckDB) Compact() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	defer db.trackSlow("compact", "", time.Now())
+
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
 
-	if len(db.oldDataFiles) < 2 {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	db.merging.Store(true)
+	defer db.merging.Store(false)
+
+	// the merged datafiles stay readable until the merge completes, even once they are retired
+	files := db.pinOldDatafiles()
+	if len(files) < 2 || !db.reclaimable(files) {
+		for _, df := range files {
+			df.unpin()
+		}
 		return nil
 	}
+	defer func() {
+		for _, df := range files {
+			df.unpin()
+		}
+	}()
+
+	entries, err := db.collectLiveEntries(files)
+	if err != nil {
+		return err
+	}
 
+	merged, relocations, err := db.writeMergedFiles(entries, files)
+	if err != nil {
+		return err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	if err := db.swapMergedFiles(files, merged, relocations); err != nil {
+		purgeMergedFiles(merged)
+		return err
+	}
+	db.metrics.merges.Add(1)
+	db.logger.Info("merged datafiles", "files", len(files), "mergedFiles", len(merged), "keys", len(entries))
+	return nil
+}
+
+// IsMerging reports whether a merge is running, whether started by Compact or by the background merge
+func (db *BeckDB) IsMerging() bool {
+	return db.merging.Load()
+}
+
+// WaitForMergeIdle blocks until no merge is running or ctx is done, in which case the context error is returned.
+// A merge may start again as soon as it returns
+func (db *BeckDB) WaitForMergeIdle(ctx context.Context) error {
+	if !db.IsMerging() {
+		return nil
+	}
+
+	ticker := time.NewTicker(mergeIdleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if !db.IsMerging() {
+				return nil
+			}
+		}
+	}
+}
+
+// reclaimable reports whether merging the given datafiles reclaims anything. rewriting merged datafiles that hold
+// only live records does not
+func (db *BeckDB) reclaimable(files map[int]*datafile) bool {
+	for fileID := range files {
+		if fileID > mergedFileID || db.keyDir.deadBytes(fileID) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pinOldDatafiles pins the current old datafiles and returns them by file id
+func (db *BeckDB) pinOldDatafiles() map[int]*datafile {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	files := make(map[int]*datafile, len(db.oldDataFiles))
+	for fileID, df := range db.oldDataFiles {
+		if df.pin() {
+			files[fileID] = df
+		}
+	}
+	return files
+}
+
+// collectLiveEntries reads the records of the given datafiles that the keydir still points at. shared values are
+// returned ahead of the records referencing them, so replays see them first
+func (db *BeckDB) collectLiveEntries(files map[int]*datafile) ([]entry, error) {
 	liveEntries := []entry{}
-	staleFileIDs := make([]int, 0, len(db.oldDataFiles))
+	sharedEntries := []entry{}
+
+	// records that store only a key hash are matched to their key by the location the keydir points at
+	var keysByLocation map[recordLocation]string
 
 	// begin merge by processing each file and checking if record's key matches the exact file and offset
-	for fileID, datafile := range db.oldDataFiles {
+	now := time.Now()
+	for fileID, datafile := range files {
 		// track offset for each entry and process until EOF or error is encountered
+		records := datafile.scan(0, db.cfg.ReadAheadSize)
 		var offset uint64
 		for {
-			record, size, err := datafile.readRecord(offset)
+			record, size, err := records.next()
 			if err == io.EOF {
 				break
 			}
 			if err != nil {
-				return fmt.Errorf("failed to read record from file %d: %w", fileID, err)
+				if !db.cfg.MergeReadRepair {
+					return nil, fmt.Errorf("failed to read record from file %d: %w", fileID, err)
+				}
+				// records past this point cannot be located so the rest of the file is skipped
+				db.logger.Warn("merge: skipping unreadable records", "fileID", fileID, "offset", offset, "error", err)
+				break
+			}
+			from := recordLocation{fileID: fileID, recordPosition: offset}
+
+			// shared values are kept while any key references them
+			if record.shared {
+				h := db.keyDir.value(record.key)
+				if h != nil && h.fileID == fileID && h.recordPosition == offset {
+					sharedEntries = append(sharedEntries, entry{key: record.key, val: record.val, shared: true, from: from})
+				}
+				offset += uint64(size)
+				continue
 			}
 
-			// write record only when its metadata matches what is in keydir
-			header := db.keyDir.get(record.key)
-			if header != nil && header.fileID == fileID && header.recordPosition == offset {
-				liveEntries = append(liveEntries, entry{key: record.key, val: record.val})
+			key := record.key
+			if record.keyHashed {
+				if keysByLocation == nil {
+					keysByLocation = db.keyDir.keysByLocation()
+				}
+				key = keysByLocation[from]
+			}
+
+			// write record only when its metadata matches what is in keydir. expired records are reclaimed
+			header := db.keyDir.get(key)
+			if header != nil && header.fileID == fileID && header.recordPosition == offset && record.hasKey(key) && !expired(record.expiry, now.UnixMilli()) {
+				liveEntries = append(liveEntries, entry{key: key, val: record.val, expiry: record.expiry, valueRef: record.valueRef, from: from})
 			}
 
 			// update size
 			offset += uint64(size)
 		}
+	}
 
-		// mark file as stale
-		staleFileIDs = append(staleFileIDs, fileID)
+	return append(sharedEntries, liveEntries...), nil
+}
+
+// mergedFile is a merged datafile and its hint file
+type mergedFile struct {
+	df   *datafile
+	hint *hintFile
+}
+
+// purge removes the merged datafile and its hint file
+func (m *mergedFile) purge() {
+	m.df.purge()
+	m.hint.purge()
+}
+
+// purgeMergedFiles removes the given merged files
+func purgeMergedFiles(files []*mergedFile) {
+	for _, m := range files {
+		m.purge()
+	}
+}
+
+// firstMergedFileID returns the id of the first of count merged datafiles written from the given datafiles. merged
+// datafiles are numbered down from the merged file id, each merge below the merged datafiles it rewrites. their
+// paths are then never in use while they are moved into place, and a crash before the rewritten ones are removed
+// leaves the newer merged records ahead of the datafiles they were merged from
+func firstMergedFileID(files map[int]*datafile, count int) int {
+	lowest := mergedFileID + 1
+	for fileID := range files {
+		lowest = min(lowest, fileID)
+	}
+	return lowest - count
+}
+
+// writeMergedFiles writes the entries of the given datafiles to new merged datafiles and hint files under temporary
+// names, so readers are unaffected until they are swapped in. a merged datafile is rolled over once it reaches the
+// max file size, and the relocations of the written entries point at the merged datafiles they were written to
+func (db *BeckDB) writeMergedFiles(entries []entry, files map[int]*datafile) ([]*mergedFile, []relocation, error) {
+	// leftovers of a failed merge are incomplete
+	leftovers, err := filepath.Glob(filepath.Join(db.cfg.DataDir, "*"+mergedFileExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range leftovers {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("failed to remove incomplete merged file: %w", err)
+		}
+	}
+
+	merged := []*mergedFile{}
+	relocations := make([]relocation, 0, len(entries))
+	for written := 0; len(merged) == 0 || written < len(entries); {
+		m, err := db.newMergedFile(len(merged))
+		if err != nil {
+			purgeMergedFiles(merged)
+			return nil, nil, err
+		}
+		merged = append(merged, m)
+
+		n, err := db.writeMergedEntries(m, entries[written:], len(merged)-1, &relocations)
+		if err != nil {
+			purgeMergedFiles(merged)
+			return nil, nil, err
+		}
+		written += n
 	}
 
-	// cleanup conflicting merged file if it exists
-	if existingMerged, exists := db.oldDataFiles[0]; exists {
-		existingMerged.purge()
-		delete(db.oldDataFiles, 0)
+	// entries were written with the position of their merged datafile as file id
+	firstFileID := firstMergedFileID(files, len(merged))
+	for idx := range relocations {
+		relocations[idx].header.fileID += firstFileID
 	}
+	return merged, relocations, nil
+}
 
-	// write live entries to new merged file and update keydir accordingly
-	mergedFileID := defaultMergedFileID
-	mergedDF, err := NewDatafile(getDatafilePath(db.cfg.DataDir, mergedFileID), false, false, 0)
+// newMergedFile creates the temporary merged datafile and hint file at the given position in the merge output
+func (db *BeckDB) newMergedFile(position int) (*mergedFile, error) {
+	df, err := NewDatafile(getDatafilePath(db.cfg.DataDir, position)+mergedFileExt, false, false, 0, db.enc)
 	if err != nil {
-		return fmt.Errorf("failed to create merged datafile: %w", err)
+		return nil, fmt.Errorf("failed to create merged datafile: %w", err)
 	}
-	hintf, err := NewHintFile(getHintFilePath(db.cfg.DataDir, mergedFileID), false)
+	df.hashKeys = db.cfg.HintOnlyKeys
+	df.compression = db.cfg.Compression
+	df.aead = db.aead
+	df.logger = db.logger
+	hintf, err := NewHintFile(getHintFilePath(db.cfg.DataDir, position)+mergedFileExt, false, db.enc)
 	if err != nil {
-		mergedDF.purge()
-		return fmt.Errorf("failed to create hint file: %w", err)
+		df.purge()
+		return nil, fmt.Errorf("failed to create hint file: %w", err)
 	}
-	defer hintf.close()
+	return &mergedFile{df: df, hint: hintf}, nil
+}
+
+// writeMergedEntries appends entries to the merged datafile and hint file until the datafile reaches the max file
+// size, then persists both. the relocations of the written entries are appended with the position of the file in
+// the merge output as their file id, and the number of entries written is returned
+func (db *BeckDB) writeMergedEntries(m *mergedFile, entries []entry, position int, relocations *[]relocation) (int, error) {
+	now := time.Now()
+
+	// buffer the writes to both files so a merge is not a pair of syscalls per entry. the merged file is not
+	// visible to readers until the merge completes, so offsets can be handed out before the bytes reach the file
+	dataW := bufio.NewWriterSize(m.df.f, db.cfg.MergeBufferSize)
+	hintW := bufio.NewWriterSize(m.hint.f, db.cfg.MergeBufferSize)
 
-	mergedKeyDirEntries := make([]keyDirEntry, 0, len(liveEntries))
-	now := time.Now().Unix()
+	written := 0
+	for _, entry := range entries {
+		if m.df.size >= int(db.cfg.MaxFileSize) {
+			break
+		}
 
-	for _, entry := range liveEntries {
-		// write to datafile and hintfile while removing both files on error
-		size, offset, err := mergedDF.append(entry.key, entry.val)
+		// write to datafile and hintfile
+		r := entry.record()
+		size, offset, err := m.df.appendTo(dataW, r)
 		if err != nil {
-			mergedDF.purge()
-			hintf.purge()
-			return fmt.Errorf("failed to append to merged datafile: %w", err)
+			return 0, fmt.Errorf("failed to append to merged datafile: %w", err)
 		}
-		if err := hintf.append(entry.key, size, offset); err != nil {
-			mergedDF.purge()
-			hintf.purge()
-			return fmt.Errorf("failed to append to hint file: %w", err)
+		if err := m.hint.appendTo(hintW, r.hint(size, offset)); err != nil {
+			return 0, fmt.Errorf("failed to append to hint file: %w", err)
+		}
+
+		// without buffering every entry goes straight to the files
+		if db.cfg.MergeBufferSize < 0 {
+			if err := errors.Join(dataW.Flush(), hintW.Flush()); err != nil {
+				return 0, fmt.Errorf("failed to write merged entry: %w", err)
+			}
 		}
 
-		mergedKeyDirEntries = append(mergedKeyDirEntries,
-			keyDirEntry{
-				key: entry.key,
-				header: &header{
-					fileID:         mergedFileID,
-					recordSize:     size,
-					recordPosition: offset,
-					timestamp:      now,
-				},
-			})
+		h := &header{
+			fileID:         position,
+			recordSize:     size,
+			valSize:        len(entry.val),
+			recordPosition: offset,
+			timestamp:      now.Unix(),
+			expiry:         entry.expiry,
+		}
+		switch {
+		case entry.shared:
+			h.valueHash = entry.key
+		case entry.valueRef:
+			h.valueHash = string(entry.val)
+			if v := db.keyDir.value(h.valueHash); v != nil {
+				h.valSize = v.valSize
+			}
+		}
+		*relocations = append(*relocations, relocation{key: entry.key, from: entry.from, header: h, shared: entry.shared})
+		written++
 	}
 
-	// sync all written entries
-	if err := mergedDF.persist(); err != nil {
-		mergedDF.purge()
-		hintf.purge()
-		return fmt.Errorf("failed to persist merged file: %w", err)
+	// flush buffered entries then sync all written entries
+	if err := dataW.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write merged file: %w", err)
+	}
+	if err := hintW.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write hint file: %w", err)
+	}
+	if err := m.df.persist(); err != nil {
+		return 0, fmt.Errorf("failed to persist merged file: %w", err)
+	}
+	if err := m.hint.sync(); err != nil {
+		return 0, fmt.Errorf("failed to persist hint file: %w", err)
+	}
+	return written, nil
+}
+
+// swapMergedFiles moves the merged datafiles and hint files into place, points the keydir at the merged records
+// and retires the merged datafiles. the caller must hold the db lock
+func (db *BeckDB) swapMergedFiles(files map[int]*datafile, merged []*mergedFile, relocations []relocation) error {
+	select {
+	case <-db.closed:
+		return ErrDatabaseNotOpen
+	default:
 	}
-	if err := hintf.sync(); err != nil {
-		mergedDF.purge()
-		hintf.purge()
-		return fmt.Errorf("failed to persist hint file: %w", err)
+	// a dataset swapped in during the merge holds none of the merged records
+	for fileID, df := range files {
+		if db.oldDataFiles[fileID] != df {
+			return fmt.Errorf("datafile %d was replaced during the merge", fileID)
+		}
 	}
 
-	// mark merged datafile as old datafile
-	db.oldDataFiles[mergedFileID] = mergedDF
+	// move the merged datafiles and hint files into place. a missing hint file is rebuilt from the datafile on the
+	// next open
+	firstFileID := firstMergedFileID(files, len(merged))
+	for idx, m := range merged {
+		if err := m.df.rename(getDatafilePath(db.cfg.DataDir, firstFileID+idx)); err != nil {
+			// the datafiles already moved are not in use yet
+			for _, placed := range merged[:idx] {
+				placed.df.purge()
+			}
+			for _, m := range merged[idx:] {
+				m.purge()
+			}
+			return fmt.Errorf("failed to move merged datafile into place: %w", err)
+		}
+	}
+	for idx, m := range merged {
+		fileID := firstFileID + idx
+		if err := os.Rename(m.hint.f.Name(), getHintFilePath(db.cfg.DataDir, fileID)); err != nil {
+			db.logger.Warn("merge: failed to move hint file into place", "fileID", fileID, "error", err)
+		}
+		m.hint.close()
 
-	// write all entries to key dir at once
-	db.keyDir.putBatch(mergedKeyDirEntries)
+		db.mapDatafile(m.df)
+		db.oldDataFiles[fileID] = m.df
+	}
 
+	// the merged datafiles leave nothing to reclaim. keys and shared values written or deleted during the merge
+	// keep their newer records
+	staleFileIDs := make([]int, 0, len(files))
+	for fileID := range files {
+		staleFileIDs = append(staleFileIDs, fileID)
+	}
+	db.keyDir.resetDead(staleFileIDs...)
+	db.keyDir.relocate(relocations)
+
+	// drop keydir entries that still point at the merged files without a live record carried over
+	if db.cfg.MergeReadRepair {
+		staleFiles := make(map[int]bool, len(staleFileIDs))
+		for _, fileID := range staleFileIDs {
+			staleFiles[fileID] = true
+		}
+		carried := make(map[string]bool, len(relocations))
+		for _, r := range relocations {
+			if !r.shared {
+				carried[r.key] = true
+			}
+		}
+		if dropped := db.keyDir.dropDangling(staleFiles, carried); len(dropped) > 0 {
+			db.logger.Warn("merge: dropped dangling keydir entries", "count", len(dropped))
+		}
+	}
+	db.lastMerge = time.Now()
+
+	// the rewritten merged datafiles are removed ahead of the datafiles merged after them, so a crash never leaves
+	// them replaying stale records over newer ones
+	slices.Sort(staleFileIDs)
 	return db.cleanupStaleDatafiles(staleFileIDs)
 }
 
-// replay the keydir from a hint file
-func (db *BeckDB) replayFromHintFile(path string, fileID int) error {
-	hintf, err := NewHintFile(path, true)
+// replay the keydir from a hint file. hint entries are verified against the datafile according to the configured
+// hint check before any of them is written to the keydir. the datafile offset following the last hinted record is
+// returned, as records appended after it are missing from a hint file cut short by a crash
+func (db *BeckDB) replayFromHintFile(path string, dfPath string, fileID int) (uint64, error) {
+	hintf, err := NewHintFile(path, true, db.enc)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer func() {
@@ -134,69 +449,317 @@ func (db *BeckDB) replayFromHintFile(path string, fileID int) error {
 	}()
 
 	// read hint file sequentially until end of file or error
+	hints := []*hintRecord{}
 	for {
 		hint, err := hintf.readNext()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
+			return 0, err
+		}
+		hints = append(hints, hint)
+	}
+
+	if err := db.verifyHints(hints, dfPath); err != nil {
+		return 0, err
+	}
+
+	var end uint64
+	now := time.Now().UnixMilli()
+	for _, hint := range hints {
+		end = max(end, hint.recordPosition+uint64(hint.recordSize))
+
+		// value length is everything in the record after the header and key. hints of tombstones remove the key.
+		// compressed values are shorter on disk, so their hints carry the length, unless written by older versions
+		valSize := hint.recordSize - headerLen - hint.storedKeyLen()
+		switch {
+		case hint.compressed:
+			valSize = hint.valSize
+		case hint.encrypted:
+			valSize -= encryptionOverhead
+		}
+		if hint.shared {
+			db.keyDir.putValue(hint.key, fileID, hint.recordSize, valSize, hint.recordPosition)
+			continue
+		}
+		if valSize == len(tombstoneVal) || expired(hint.expiry, now) {
+			db.keyDir.delete(hint.key)
+			db.keyDir.markDead(fileID, hint.recordSize)
+			continue
+		}
+		if hint.valueHash != "" {
+			db.keyDir.putRef(hint.key, hint.valueHash, fileID, hint.recordSize, hint.recordPosition, hint.expiry)
+			continue
+		}
+		db.keyDir.put(hint.key, fileID, hint.recordSize, valSize, hint.recordPosition, hint.expiry)
+	}
+	return end, nil
+}
+
+// verifyHints checks that the records at the offsets claimed by the hint entries exist in the datafile
+// and hold the claimed keys. ErrHintMismatch is returned on the first disagreement
+func (db *BeckDB) verifyHints(hints []*hintRecord, dfPath string) error {
+	if db.cfg.HintCheck == HintCheckNone || len(hints) == 0 {
+		return nil
+	}
+
+	df, err := NewDatafile(dfPath, true, false, 0, db.enc)
+	if err != nil {
+		return err
+	}
+	df.aead = db.aead
+	df.logger = db.logger
+	defer df.close()
+
+	// pick the entries to verify. sampling always includes the first and last entries
+	step := 1
+	if db.cfg.HintCheck == HintCheckSample && len(hints) > hintSampleSize {
+		step = len(hints) / hintSampleSize
+	}
+	for idx := 0; idx < len(hints); idx += step {
+		if err := verifyHint(df, hints[idx]); err != nil {
 			return err
 		}
+	}
+	return verifyHint(df, hints[len(hints)-1])
+}
 
-		db.keyDir.put(hint.key, fileID, hint.recordSize, hint.recordPosition)
+// verifyHint checks a single hint entry against the datafile
+func verifyHint(df *datafile, hint *hintRecord) error {
+	record, size, err := df.readRecord(hint.recordPosition)
+	if err != nil || size != hint.recordSize || !record.hasKey(hint.key) || record.keyHashed != hint.keyHashed || record.expiry != hint.expiry {
+		return ErrHintMismatch
+	}
+	if record.compressed != hint.compressed || record.encrypted != hint.encrypted {
+		return ErrHintMismatch
+	}
+	if record.shared != hint.shared || record.valueRef != (hint.valueHash != "") || (record.valueRef && string(record.val) != hint.valueHash) {
+		return ErrHintMismatch
 	}
 	return nil
 }
 
-// replay keydir from a datafile
-func (db *BeckDB) replayFromDataFile(dfPath string, fileID int) error {
+// replay keydir from the records of a datafile starting at offset. records that store only a key hash cannot be
+// recovered without their hint entries. when hinted is set they were lost with the end of a hint file cut short and
+// are skipped, otherwise ErrHintFileRequired is returned
+func (db *BeckDB) replayFromDataFile(dfPath string, fileID int, offset uint64, hinted bool) error {
 	// open datafile in read-only mode
-	df, err := NewDatafile(dfPath, true, false, 0)
+	df, err := NewDatafile(dfPath, true, false, 0, db.enc)
 	if err != nil {
 		return err
 	}
+	df.aead = db.aead
+	df.logger = db.logger
 	defer df.close()
 
 	// read until end of file or error
-	var offset uint64
+	records := df.scan(offset, db.cfg.ReadAheadSize)
+	now := time.Now().UnixMilli()
+	corrupted := 0
 	for {
-		record, size, err := df.readRecord(offset)
+		record, size, err := records.next()
 		if err == io.EOF {
 			break
 		}
+		// a header claiming sizes past the end of the file is either a record torn by a crash, which ends the
+		// replay, or a corrupted header, whose record can't be skipped by its size
+		if err == io.ErrUnexpectedEOF || (errors.Is(err, ErrInvalidRecord) && size == 0) {
+			next, torn, err := db.nextIntactRecord(df, offset)
+			if err != nil {
+				return err
+			}
+			if torn {
+				break
+			}
+			if db.cfg.StrictRecovery {
+				return fmt.Errorf("%w: corrupt record header at offset %d", ErrInvalidRecord, offset)
+			}
+			db.keyDir.markDead(fileID, int(next-offset))
+			corrupted++
+			offset = next
+			records = df.scan(offset, db.cfg.ReadAheadSize)
+			continue
+		}
+		// corrupt records are skipped unless recovery is strict. their bytes are reclaimed by the next merge. values
+		// that fail to decrypt point at the wrong encryption key rather than corruption
+		if err != nil && size > 0 && !db.cfg.StrictRecovery && !errors.Is(err, ErrDecryptionFailed) {
+			db.keyDir.markDead(fileID, size)
+			corrupted++
+			offset += uint64(size)
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
-		// write to keydir
-		db.keyDir.put(record.key, fileID, size, offset)
+		if record.keyHashed {
+			if !hinted {
+				return ErrHintFileRequired
+			}
+			offset += uint64(size)
+			continue
+		}
+
+		if record.shared {
+			db.keyDir.putValue(record.key, fileID, size, record.valSize, offset)
+			offset += uint64(size)
+			continue
+		}
+
+		// write to keydir. tombstones and expired records remove any earlier entry of the key
+		switch {
+		case record.valSize == len(tombstoneVal) || expired(record.expiry, now):
+			db.keyDir.delete(record.key)
+			db.keyDir.markDead(fileID, size)
+		case record.valueRef:
+			db.keyDir.putRef(record.key, string(record.val), fileID, size, offset, record.expiry)
+		default:
+			db.keyDir.put(record.key, fileID, size, record.valSize, offset, record.expiry)
+		}
 		offset += uint64(size)
 	}
+	if corrupted > 0 {
+		db.logger.Warn("skipped corrupt records", "datafile", dfPath, "count", corrupted)
+	}
+
+	// a crash mid-append leaves a torn record at the end of the file. it was never acknowledged, so it's dropped
+	// before anything is appended after it. strict recovery never truncates, leaving the bytes for inspection
+	torn := df.size - int(offset)
+	if torn <= 0 {
+		return nil
+	}
+	if db.cfg.ReadOnly || db.cfg.StrictRecovery {
+		db.logger.Warn("ignoring a torn record at the end of datafile", "datafile", dfPath, "bytes", torn)
+		return nil
+	}
+	if err := os.Truncate(dfPath, int64(offset)); err != nil {
+		return fmt.Errorf("failed to truncate torn record: %w", err)
+	}
+	db.logger.Warn("discarded a torn record at the end of datafile", "datafile", dfPath, "bytes", torn)
 	return nil
 }
 
+// nextIntactRecord finds where replay resumes after the record at offset, whose header is invalid or claims sizes past
+// the end of the datafile. the record is torn, left behind by a crash mid-append, if its header claims sizes a write
+// could have had and no intact record follows it. otherwise the header is corrupted and the offset of the next record
+// whose checksum matches is returned, or the end of the file if there's none
+func (db *BeckDB) nextIntactRecord(df *datafile, offset uint64) (uint64, bool, error) {
+	data, err := df.tail(offset)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(data) < headerLen {
+		return uint64(df.size), true, nil
+	}
+
+	// compression and encryption can grow a value slightly past its length
+	maxValSection := db.cfg.MaxValueSize + db.cfg.MaxValueSize/1000 + 64 + encryptionOverhead
+	_, _, _, keySize, _, valSize := decodeHeader(data, df.enc)
+	plausible := keySize <= max(db.cfg.MaxKeySize, valueHashLen) && valSize >= 0 && int64(valSize) <= maxValSection
+
+	for pos := 1; pos+headerLen <= len(data); pos++ {
+		checksum, _, _, keySize, _, valSize := decodeHeader(data[pos:], df.enc)
+		if keySize < 0 || valSize < 0 || keySize > len(data) || valSize > len(data) {
+			continue
+		}
+		end := pos + headerLen + keySize + valSize
+		if end <= len(data) && getChecksum(data[pos+crcLen:end]) == checksum {
+			return offset + uint64(pos), false, nil
+		}
+	}
+	return uint64(df.size), plausible, nil
+}
+
 // RotateActiveDatafile swaps the active bool into an old data if it's exceeded max datafile size
 func (db *BeckDB) RotateActiveDatafile() bool {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	rotated, _ := db.rotateActiveDatafile()
+	return rotated
+}
+
+// rotateActiveDatafile rotates the active datafile if it's exceeded max datafile size and reports whether it was
+// rotated. a failed rotation leaves the active datafile in place
+func (db *BeckDB) rotateActiveDatafile() (bool, error) {
+	if db.cfg.ReadOnly {
+		return false, nil
+	}
+
+	db.lock()
+	defer db.unlock()
 
 	if db.activeDatafile.size < int(db.cfg.MaxFileSize) {
-		return false
+		return false, nil
 	}
 
 	// move active file to old datafile and create a new datafile
-	activeFileID := db.activeIndex + 1
-	newActiveDatafile, err := NewDatafile(getDatafilePath(db.cfg.DataDir, activeFileID), false, db.cfg.SyncOnWrite, db.cfg.SyncInterval)
+	activeFileID := nextActiveFileID(db.activeIndex)
+	newActiveDatafile, err := db.openActiveDatafile(activeFileID)
 	if err != nil {
-		// fail silently
-		return false
+		return false, fmt.Errorf("failed to create datafile %d: %w", activeFileID, err)
+	}
+
+	// records still buffered in the outgoing file must reach it before it is only read from. its hint file is
+	// synced before it's old, so every old datafile can be replayed from a hint file
+	if err := db.activeDatafile.persist(); err != nil {
+		newActiveDatafile.purge()
+		return false, fmt.Errorf("failed to persist datafile %d: %w", db.activeIndex, err)
+	}
+	if db.activeDatafile.hint == nil {
+		if err := db.writeHintFile(db.activeDatafile, db.activeIndex); err != nil {
+			newActiveDatafile.purge()
+			return false, fmt.Errorf("failed to write hint file of datafile %d: %w", db.activeIndex, err)
+		}
 	}
 
+	db.mapDatafile(db.activeDatafile)
 	db.oldDataFiles[db.activeIndex] = db.activeDatafile
 	db.activeDatafile = newActiveDatafile
 	db.activeIndex = activeFileID
 
-	return true
+	db.logger.Info("rotated active datafile", "fileID", activeFileID)
+	return true, nil
+}
+
+// writeHintFile writes the hint file of a datafile that's no longer appended to. it's written under a temporary
+// name and moved into place once synced, so an interrupted write never leaves a partial hint file behind
+func (db *BeckDB) writeHintFile(df *datafile, fileID int) error {
+	path := getHintFilePath(db.cfg.DataDir, fileID)
+	tmp := path + tempFileExt
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	hintf, err := NewHintFile(tmp, false, db.enc)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(hintf.f)
+	records := df.scan(0, db.cfg.ReadAheadSize)
+	var offset uint64
+	for {
+		record, size, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && record.keyHashed {
+			// only the hint file written alongside the records holds their keys
+			err = ErrHintFileRequired
+		}
+		if err == nil {
+			err = hintf.appendTo(w, record.hint(size, offset))
+		}
+		if err != nil {
+			hintf.purge()
+			return err
+		}
+		offset += uint64(size)
+	}
+
+	if err := errors.Join(w.Flush(), hintf.close()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 // remove all stale datafiles
@@ -212,6 +775,10 @@ func (db *BeckDB) cleanupStaleDatafiles(fileIDs []int) error {
 		if err := datafile.purge(); err != nil {
 			knownErr = err
 		}
+		// remove the hint file of datafiles that kept their keys in one
+		if err := os.Remove(getHintFilePath(db.cfg.DataDir, fileID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			knownErr = err
+		}
 
 		delete(db.oldDataFiles, fileID)
 	}
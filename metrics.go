@@ -0,0 +1,73 @@
+package beck
+
+import "sync/atomic"
+
+// Metrics holds counters of the work done by the database since it was opened, along with the number of keys.
+// Counters only grow, so rates are derived by sampling them, and they map directly onto Prometheus counters
+type Metrics struct {
+	// Gets is the number of reads of a key, including reads of missing keys
+	Gets uint64
+	// Puts is the number of keys written, counting each key of a batch
+	Puts uint64
+	// Deletes is the number of keys deleted, counting each key of a batch. Expired keys removed by the expiry
+	// sweep are not counted
+	Deletes uint64
+	// CacheHits and CacheMisses are the number of reads of existing keys served from the value cache and from
+	// disk. Both stay zero while the cache is disabled
+	CacheHits   uint64
+	CacheMisses uint64
+	// Merges is the number of merges completed, whether started by Compact or by the background merge
+	Merges uint64
+	// BytesWritten is the size of the records appended to the active datafile. Records rewritten by merges are not
+	// counted
+	BytesWritten uint64
+	// BytesRead is the size of the records read from datafiles to serve reads
+	BytesRead uint64
+	// Keys is the number of keys, including expired keys not reclaimed yet
+	Keys int
+}
+
+// metrics holds the counters behind Metrics. they are atomics so the hot paths update them without the database
+// lock
+type metrics struct {
+	gets         atomic.Uint64
+	puts         atomic.Uint64
+	deletes      atomic.Uint64
+	cacheHits    atomic.Uint64
+	cacheMisses  atomic.Uint64
+	merges       atomic.Uint64
+	bytesWritten atomic.Uint64
+	bytesRead    atomic.Uint64
+}
+
+// Metrics returns a snapshot of the counters of the database. Each counter is read atomically, but the counters are
+// not read at a single point in time
+func (db *BeckDB) Metrics() Metrics {
+	db.mu.RLock()
+	keys := db.keyDir.len()
+	db.mu.RUnlock()
+
+	return Metrics{
+		Gets:         db.metrics.gets.Load(),
+		Puts:         db.metrics.puts.Load(),
+		Deletes:      db.metrics.deletes.Load(),
+		CacheHits:    db.metrics.cacheHits.Load(),
+		CacheMisses:  db.metrics.cacheMisses.Load(),
+		Merges:       db.metrics.merges.Load(),
+		BytesWritten: db.metrics.bytesWritten.Load(),
+		BytesRead:    db.metrics.bytesRead.Load(),
+		Keys:         keys,
+	}
+}
+
+// cacheLookup counts a read of an existing key as a cache hit or miss. reads are not counted while the cache is
+// disabled
+func (db *BeckDB) cacheLookup(hit bool) {
+	switch {
+	case db.cache == nil:
+	case hit:
+		db.metrics.cacheHits.Add(1)
+	default:
+		db.metrics.cacheMisses.Add(1)
+	}
+}
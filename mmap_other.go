@@ -0,0 +1,20 @@
+//go:build !unix
+
+package beck
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// mmapFile is not supported on this platform, so reads fall back to ReadAt
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmapFile is a no-op since nothing is ever mapped on this platform
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package beck
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowOp is an operation that took longer than the configured slow operation threshold
+type SlowOp struct {
+	// ID is a unique, increasing identifier of the entry
+	ID uint64
+	// Op is the name of the operation, such as get or put
+	Op string
+	// Key is the key the operation was called with. It is empty for operations on the whole database
+	Key      string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// slowLog is a fixed-size ring buffer of the most recent slow operations
+type slowLog struct {
+	entries []SlowOp
+	// position of the next entry to overwrite and the total number of entries ever added
+	next  int
+	count uint64
+	mu    sync.Mutex
+}
+
+func newSlowLog(size int) *slowLog {
+	return &slowLog{entries: make([]SlowOp, 0, size)}
+}
+
+// add records an operation, overwriting the oldest entry once the buffer is full
+func (s *slowLog) add(op SlowOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count++
+	op.ID = s.count
+	if len(s.entries) < cap(s.entries) {
+		s.entries = append(s.entries, op)
+		return
+	}
+	s.entries[s.next] = op
+	s.next = (s.next + 1) % len(s.entries)
+}
+
+// list returns the recorded operations, newest first
+func (s *slowLog) list() []SlowOp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := make([]SlowOp, 0, len(s.entries))
+	for idx := range s.entries {
+		pos := (s.next - 1 - idx + 2*len(s.entries)) % len(s.entries)
+		ops = append(ops, s.entries[pos])
+	}
+	return ops
+}
+
+// reset discards all recorded operations
+func (s *slowLog) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = s.entries[:0]
+	s.next = 0
+}
+
+// trackSlow logs and records the operation if it has run for longer than the slow operation threshold.
+// it is meant to be deferred at the start of the operation
+func (db *BeckDB) trackSlow(op, key string, start time.Time) {
+	threshold := time.Duration(db.slowOpThreshold.Load())
+	if threshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < threshold {
+		return
+	}
+
+	db.logger.Warn("slow operation", "op", op, "key", key, "took", elapsed)
+	db.slowLog.add(SlowOp{Op: op, Key: key, Start: start, Duration: elapsed})
+}
+
+// SlowLog returns the most recent operations that exceeded Config.SlowOpThreshold, newest first
+func (db *BeckDB) SlowLog() []SlowOp {
+	return db.slowLog.list()
+}
+
+// ResetSlowLog discards all recorded slow operations
+func (db *BeckDB) ResetSlowLog() {
+	db.slowLog.reset()
+}
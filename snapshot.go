@@ -0,0 +1,91 @@
+package beck
+
+import (
+	"sync"
+)
+
+// Snapshot is a point-in-time view of the database. It sees every key as it was when the snapshot was taken, even
+// as writes and merges proceed, and must be closed once it's no longer needed
+type Snapshot struct {
+	// captured entries in sorted key order, and their headers by key
+	entries []keyDirEntry
+	headers map[string]*header
+	// datafiles the captured entries point at, which stay readable until the snapshot is closed
+	files map[int]*datafile
+	// reads hold the lock so the datafiles are not unpinned under them
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Snapshot captures the live keys of the database. Records are never modified once written, so the snapshot only
+// copies the keydir and pins the datafiles it points at, which are then kept on disk until the snapshot is closed
+// even if a merge or clear discards them. Keys expiring after the snapshot is taken are still seen by it
+func (db *BeckDB) Snapshot() (*Snapshot, error) {
+	entries, files, err := db.pinEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]*header, len(entries))
+	for _, entry := range entries {
+		headers[entry.key] = entry.header
+	}
+	return &Snapshot{entries: entries, headers: headers, files: files}, nil
+}
+
+// Get returns the value of key when the snapshot was taken. ErrKeyNotFound is returned if it did not exist then
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	h, ok := s.headers[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return s.files[h.fileID].read(h.recordPosition, h.recordSize, true)
+}
+
+// Fold calls fn for every key of the snapshot and its value in sorted key order, stopping at the first error
+// returned by fn
+func (s *Snapshot) Fold(fn func(key string, val []byte) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	for _, entry := range s.entries {
+		h := entry.header
+		val, err := s.files[h.fileID].read(h.recordPosition, h.recordSize, true)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry.key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys in the snapshot
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+// Close releases the datafiles held by the snapshot. Reads from a closed snapshot fail with ErrSnapshotClosed
+func (s *Snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, df := range s.files {
+		df.unpin()
+	}
+	return nil
+}
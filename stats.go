@@ -0,0 +1,59 @@
+package beck
+
+import "time"
+
+// Stats holds storage metrics of the database
+type Stats struct {
+	// Keys is the number of keys, including expired keys not reclaimed yet
+	Keys int
+	// Datafiles is the number of datafiles, including the active datafile
+	Datafiles int
+	// TotalBytes is the size of all datafiles, including writes not flushed to disk yet
+	TotalBytes int64
+	// ReclaimableBytes is the size of the superseded, deleted and tombstone records a merge would reclaim.
+	// Records of the active datafile are only reclaimed once it's rotated
+	ReclaimableBytes int64
+	// LiveBytes is the size of the records holding the current value of every key
+	LiveBytes int64
+	// LastMerge is the time the last merge completed. It's zero if no merge completed since the database was opened
+	LastMerge time.Time
+}
+
+// Stats returns the current storage metrics. Live and reclaimable bytes are tracked as keys are written and deleted,
+// so this does not scan the datafiles
+func (db *BeckDB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		Keys:      db.keyDir.len(),
+		Datafiles: len(db.oldDataFiles),
+		LiveBytes: db.keyDir.liveBytes(),
+		LastMerge: db.lastMerge,
+	}
+	// read-only databases have no active datafile
+	if db.activeDatafile != nil {
+		stats.Datafiles++
+		stats.TotalBytes = int64(db.activeDatafile.bufferedSize())
+		stats.ReclaimableBytes = db.keyDir.deadBytes(db.activeIndex)
+	}
+	for fileID, df := range db.oldDataFiles {
+		stats.TotalBytes += int64(df.bufferedSize())
+		stats.ReclaimableBytes += db.keyDir.deadBytes(fileID)
+	}
+	return stats
+}
+
+// reclaimableRatio returns the ratio of reclaimable bytes to the total size of the old datafiles, which are the only
+// ones a merge rewrites. the caller must hold at least the read lock
+func (db *BeckDB) reclaimableRatio() float64 {
+	var total, dead int64
+	for fileID, df := range db.oldDataFiles {
+		total += int64(df.bufferedSize())
+		dead += db.keyDir.deadBytes(fileID)
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(dead) / float64(total)
+}
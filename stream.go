@@ -0,0 +1,127 @@
+package beck
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// PutReader stores a key and the next size bytes of r as its value, replacing the value if the key already exists.
+// The value is spooled to a temporary file in the data directory while its checksum is computed, then appended to
+// the active datafile, so it's never held in memory whole. Values that are compressed, encrypted or deduplicated
+// are read into memory since they can only be processed whole
+func (db *BeckDB) PutReader(key string, r io.Reader, size int64) error {
+	defer db.trackSlow("put", key, time.Now())
+
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	if size < 0 {
+		return ErrInvalidValueSize
+	}
+	if err := db.validateEntrySize(key, size); err != nil {
+		return err
+	}
+
+	if db.cfg.Compression != CompressionNone || db.aead != nil || db.cfg.DedupValues {
+		val := make([]byte, size)
+		if _, err := io.ReadFull(r, val); err != nil {
+			return unexpectedEOF(err)
+		}
+
+		db.lock()
+		defer db.unlock()
+		return db.put(key, val, 0)
+	}
+
+	// the checksum leads the record, so the value is checksummed as it's spooled and only appended once it's known
+	rec := newRecord(key, nil, 0)
+	keySection, flags := rec.keySection(db.cfg.HintOnlyKeys, db.enc)
+	head := rec.encodeHead(keySection, flags, int(size), db.enc)
+	crc := crc32.NewIEEE()
+	crc.Write(head[crcLen:])
+
+	spool, err := os.CreateTemp(db.cfg.DataDir, "*"+streamFileExt+tempFileExt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	if _, err := io.CopyN(io.MultiWriter(spool, crc), r, size); err != nil {
+		return unexpectedEOF(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	rec.checksum = crc.Sum32()
+	db.enc.PutUint32(head[:crcLen], rec.checksum)
+
+	db.lock()
+	defer db.unlock()
+
+	recordSize, offset, err := db.activeDatafile.appendStream(rec, head, spool, size)
+	if err != nil {
+		return err
+	}
+	db.keyDir.put(key, db.activeIndex, recordSize, int(size), offset, 0)
+	db.cache.remove(key)
+	db.metrics.puts.Add(1)
+	return nil
+}
+
+// GetReader returns a reader over the value of key. The value is read from disk as the reader is consumed rather
+// than loaded into memory, and its checksum is verified once it's read to the end, returning ErrInvalidChecksum
+// instead of io.EOF on a mismatch. Compressed and encrypted values are read into memory. The reader must be closed
+func (db *BeckDB) GetReader(key string) (io.ReadCloser, error) {
+	defer db.trackSlow("get", key, time.Now())
+	db.metrics.gets.Add(1)
+
+	// the pinned datafile outlives merges, so the lock is only needed to look the key up
+	db.mu.RLock()
+	header, df, err := db.lookup(key)
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := db.cache.get(key, header)
+	db.cacheLookup(ok)
+	if ok {
+		df.unpin()
+		return io.NopCloser(bytes.NewReader(val)), nil
+	}
+
+	r, err := df.openValue(header.recordPosition, header.recordSize)
+	if err != nil {
+		df.unpin()
+		return nil, err
+	}
+	db.metrics.bytesRead.Add(uint64(header.recordSize))
+	return &pinnedReader{Reader: r, df: df}, nil
+}
+
+// pinnedReader reads from a pinned datafile, unpinning it once closed
+type pinnedReader struct {
+	io.Reader
+	df   *datafile
+	once sync.Once
+}
+
+func (r *pinnedReader) Close() error {
+	r.once.Do(r.df.unpin)
+	return nil
+}
+
+// unexpectedEOF reports a reader that ended before the size of its value as io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
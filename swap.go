@@ -0,0 +1,91 @@
+package beck
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// swapSuffix is appended to the data directory to hold the replaced dataset while a swap is in progress
+const swapSuffix = ".swap"
+
+// SwapDir atomically replaces the entire dataset with the datafiles in newDir and reloads the keydir from them.
+// newDir must be on the same filesystem as the data directory and must not be in use by another open database.
+// It is moved into place, so it no longer exists once the swap succeeds. A crash during the swap leaves either
+// the old or the new dataset intact, and the next Open finishes or rolls back the swap
+func (db *BeckDB) SwapDir(newDir string) error {
+	if db.cfg.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	fi, err := os.Stat(newDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("swap source %s is not a directory", newDir)
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	if err := db.closeFiles(); err != nil {
+		return err
+	}
+
+	// move the current dataset aside then move the new dataset into its place. each rename is atomic
+	dataDir := filepath.Clean(db.cfg.DataDir)
+	backupDir := dataDir + swapSuffix
+	if err := os.RemoveAll(backupDir); err != nil {
+		return err
+	}
+	if err := os.Rename(dataDir, backupDir); err != nil {
+		return err
+	}
+	if err := os.Rename(newDir, dataDir); err != nil {
+		// restore the old dataset
+		if restoreErr := os.Rename(backupDir, dataDir); restoreErr != nil {
+			return fmt.Errorf("failed to restore data directory after swap error %v: %w", err, restoreErr)
+		}
+		if loadErr := db.load(); loadErr != nil {
+			return fmt.Errorf("failed to reload data directory after swap error %v: %w", err, loadErr)
+		}
+		return err
+	}
+	if err := syncDir(filepath.Dir(dataDir)); err != nil {
+		return err
+	}
+
+	// the new dataset is in place, so the old one can go
+	if err := os.RemoveAll(backupDir); err != nil {
+		return err
+	}
+
+	return db.load()
+}
+
+// recoverSwap completes a swap interrupted by a crash. if the data directory is missing the old dataset is
+// restored, otherwise the new dataset was already moved into place and the leftover old dataset is removed
+func recoverSwap(dataDir string) error {
+	dataDir = filepath.Clean(dataDir)
+	backupDir := dataDir + swapSuffix
+	if !fileExists(backupDir) {
+		return nil
+	}
+
+	if !fileExists(dataDir) {
+		return os.Rename(backupDir, dataDir)
+	}
+	return os.RemoveAll(backupDir)
+}
+
+// syncDir flushes the directory entries of path to disk so renames within it are durable
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -1,9 +1,11 @@
 package beck
 
 import (
-	"bytes"
+	"cmp"
+	"crypto/sha256"
 	"fmt"
 	"hash/crc32"
+	"hash/fnv"
 	"os"
 	"path/filepath"
 	"slices"
@@ -11,55 +13,91 @@ import (
 	"strings"
 )
 
-// get datafiles retrieves all datafiles in the specified directory in their sorted order. oldest to latest
+// get datafiles retrieves all datafiles in the specified directory in their sorted order. oldest to latest, starting
+// with the merged datafiles which have the lowest ids. files with the datafile extension whose name is not a file
+// id, such as stray copies, are skipped
 func getDatafiles(path string) ([]string, error) {
 	// get all files matching the datafile extension
-	dirs, err := filepath.Glob(filepath.Join(path, "*"+datafileExt))
+	paths, err := filepath.Glob(filepath.Join(path, "*"+datafileExt))
 	if err != nil {
 		return nil, err
 	}
 
+	ids := make(map[string]int, len(paths))
+	dirs := make([]string, 0, len(paths))
+	for _, path := range paths {
+		id, err := getFileID(path)
+		if err != nil {
+			continue
+		}
+		ids[path] = id
+		dirs = append(dirs, path)
+	}
+
 	// sort files by file id
 	slices.SortFunc(dirs, func(a, b string) int {
-		idA, _ := getFileID(a)
-		idB, _ := getFileID(b)
-		return idA - idB
+		return cmp.Compare(ids[a], ids[b])
 	})
 	return dirs, nil
 }
 
-// getFileID retrieves the file id from a given datafile path
+// getFileID retrieves the file id from a given datafile path. only names written by getDatafilePath are accepted, so
+// each id has a single path
 func getFileID(path string) (int, error) {
-	filename := filepath.Base(path)
-	id, err := strconv.ParseInt(strings.TrimSuffix(filename, datafileExt), 10, 64)
+	name := strings.TrimSuffix(filepath.Base(path), datafileExt)
+	id, err := strconv.Atoi(name)
 	if err != nil {
 		return 0, err
 	}
-	return int(id), nil
+	if strconv.Itoa(id) != name {
+		return 0, fmt.Errorf("invalid file id %q", name)
+	}
+	return id, nil
 }
 
-// getChecksum computes the checksum of key and value combination as byte slice
-func getChecksum(key string, val []byte) uint32 {
-	// compute checksum of key and value combination as byte slice
-	rawData := [][]byte{[]byte(key), val}
-	data := bytes.Join(rawData, []byte(""))
+// getChecksum computes the checksum of the encoded record data
+func getChecksum(data []byte) uint32 {
 	return crc32.ChecksumIEEE(data)
 }
 
+// getKeyHash computes the hash stored in place of a key in datafiles that keep keys only in hint files
+func getKeyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// nextActiveFileID returns the id of the active datafile following the datafile with the given id. the merged
+// datafile id is never handed out
+func nextActiveFileID(fileID int) int {
+	return max(fileID, mergedFileID) + 1
+}
+
+// getValueHash computes the content hash shared values are keyed by
+func getValueHash(val []byte) string {
+	h := sha256.Sum256(val)
+	return string(h[:])
+}
+
 // getDatafilePath composes the filepath for the specified datafile based on the index
 func getDatafilePath(dataDir string, index int) string {
 	return filepath.Join(dataDir, fmt.Sprintf("%d%s", index, datafileExt))
 }
 
 // validateEntry runs the key-value pair against all constraints
-func validateEntry(key string, val []byte) error {
+func (db *BeckDB) validateEntry(key string, val []byte) error {
+	return db.validateEntrySize(key, int64(len(val)))
+}
+
+// validateEntrySize runs the key and the size of its value against all constraints
+func (db *BeckDB) validateEntrySize(key string, valSize int64) error {
 	if key == "" {
 		return ErrKeyRequired
 	}
-	if len(key) > maxKeySize {
+	if len(key) > db.cfg.MaxKeySize {
 		return ErrKeyTooLarge
 	}
-	if len(val) > maxValueSize {
+	if valSize > db.cfg.MaxValueSize {
 		return ErrValTooLarge
 	}
 